@@ -0,0 +1,169 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"strings"
+
+	"golang.org/x/crypto/openpgp"
+)
+
+// ArchiveKeyringName returns the name of the keyring clients install the repository key as, without extension.
+func (c conf) ArchiveKeyringName() string {
+	if c.KeyringName == "" {
+		return "deb-simple-archive-keyring"
+	}
+	return c.KeyringName
+}
+
+// KeyringPath returns where clients install the repository keyring, which apt sources refer to in Signed-By.
+func (c conf) KeyringPath() string {
+	return "/usr/share/keyrings/" + c.ArchiveKeyringName() + ".gpg"
+}
+
+// repositoryPublicKeys returns the public keys Release files are signed with: those of every configured
+// signing key, including those not valid yet or anymore so clients can trust a new key before it is used,
+// or the public key configured for the external signer.
+func repositoryPublicKeys(config conf) (openpgp.EntityList, error) {
+	if config.ExternalSigner != nil {
+		if config.ExternalSigner.PublicKey == "" {
+			return nil, errors.New("no publicKey is configured for the externalSigner")
+		}
+		return loadKeyring(config.ExternalSigner.PublicKey)
+	}
+	var keys openpgp.EntityList
+	seen := make(map[string]bool)
+	for _, key := range config.ReleaseSigningKeys() {
+		signingKey, err := readSigningKey(key.Path, key.Fingerprint)
+		if err != nil {
+			return nil, err
+		}
+		if fingerprint := keyFingerprint(signingKey.Entity); !seen[fingerprint] {
+			seen[fingerprint] = true
+			keys = append(keys, signingKey.Entity)
+		}
+	}
+	return keys, nil
+}
+
+// writePublicKeys writes the public part of keys, ASCII armored or as a binary keyring.
+func writePublicKeys(w io.Writer, keys openpgp.EntityList, armored bool) error {
+	serialize := func(w io.Writer) error {
+		for _, key := range keys {
+			if err := key.Serialize(w); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	if armored {
+		return writeArmored(w, openpgp.PublicKeyType, serialize)
+	}
+	return serialize(w)
+}
+
+// publicKeyHandler serves the repository public keys, ASCII armored at /keys/repository.asc and as a
+// binary keyring for /usr/share/keyrings at /keys/repository.gpg.
+func publicKeyHandler(config conf) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		log.Printf("%s %s %s\n", r.RemoteAddr, r.Method, r.URL)
+		if r.Method != "GET" && r.Method != "HEAD" {
+			http.Error(w, "method not supported", http.StatusMethodNotAllowed)
+			return
+		}
+		var armored bool
+		switch r.URL.Path {
+		case "/keys/repository.asc":
+			armored = true
+			w.Header().Set("Content-Type", "application/pgp-keys")
+		case "/keys/repository.gpg":
+			w.Header().Set("Content-Type", "application/octet-stream")
+		default:
+			http.NotFound(w, r)
+			return
+		}
+		if !config.EnableSigning {
+			http.Error(w, "Release signing is not enabled", http.StatusNotFound)
+			return
+		}
+		keys, err := repositoryPublicKeys(config)
+		if err != nil {
+			httpErrorf(w, "error reading signing keys: %s", err)
+			return
+		}
+		if err := writePublicKeys(w, keys, armored); err != nil {
+			log.Printf("error writing public keys: %s", err)
+		}
+	})
+}
+
+// repositoryURL returns the URL clients reach the repository at: publicURL if it is configured, as it
+// has to be behind a reverse proxy, or the scheme and host the request was made to.
+func repositoryURL(config conf, r *http.Request) string {
+	return baseURL(config, r.TLS != nil, r.Host)
+}
+
+// baseURL returns publicURL if it is configured, or the URL of host otherwise.
+func baseURL(config conf, tls bool, host string) string {
+	if config.PublicURL != "" {
+		return strings.TrimSuffix(config.PublicURL, "/") + "/"
+	}
+	scheme := "http"
+	if tls || config.EnableSSL {
+		scheme = "https"
+	}
+	return scheme + "://" + host + "/"
+}
+
+// aptListEntry returns the one-line sources.list entry of a distro.
+func aptListEntry(config conf, url, distro string) string {
+	option := "trusted=yes"
+	if config.EnableSigning {
+		option = "signed-by=" + config.KeyringPath()
+	}
+	return fmt.Sprintf("deb [%s] %s %s %s\n", option, url, distro, strings.Join(config.Sections, " "))
+}
+
+// aptSourcesEntry returns the deb822 style .sources entry of a distro.
+func aptSourcesEntry(config conf, url, distro string) string {
+	fields := []controlField{
+		{"Types", "deb"},
+		{"URIs", url},
+		{"Suites", distro},
+		{"Components", strings.Join(config.Sections, " ")},
+	}
+	if config.EnableSigning {
+		fields = append(fields, controlField{"Signed-By", config.KeyringPath()})
+	} else {
+		fields = append(fields, controlField{"Trusted", "yes"})
+	}
+	return formatControlFields(fields)
+}
+
+// aptSourceHandler serves the apt source configuration of each distro, as a one-line entry for
+// /etc/apt/sources.list.d at /apt/<distro>.list and in the deb822 format at /apt/<distro>.sources.
+func aptSourceHandler(config conf) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		log.Printf("%s %s %s\n", r.RemoteAddr, r.Method, r.URL)
+		if r.Method != "GET" && r.Method != "HEAD" {
+			http.Error(w, "method not supported", http.StatusMethodNotAllowed)
+			return
+		}
+		name := strings.TrimPrefix(r.URL.Path, "/apt/")
+		entry := aptListEntry
+		distro := strings.TrimSuffix(name, ".list")
+		if distro == name {
+			entry = aptSourcesEntry
+			distro = strings.TrimSuffix(name, ".sources")
+		}
+		if distro == name || !contains(config.DistroNames, distro) {
+			http.NotFound(w, r)
+			return
+		}
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		io.WriteString(w, entry(config, repositoryURL(config, r), distro))
+	})
+}
@@ -0,0 +1,94 @@
+package main
+
+import (
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"golang.org/x/crypto/openpgp"
+)
+
+func TestPublicKeyHandler(t *testing.T) {
+	config := conf{DistroNames: []string{"stable"}, Sections: []string{"main"}, EnableSigning: true,
+		PrivateKey: "samples/subkeys.key", PrivateKeyFingerprint: "1690882091F99489CDA0A1D8FAE5382CAC76BC7E"}
+	get := func(config conf, url string) *httptest.ResponseRecorder {
+		req, _ := http.NewRequest("GET", url, nil)
+		w := httptest.NewRecorder()
+		publicKeyHandler(config).ServeHTTP(w, req)
+		return w
+	}
+
+	for _, url := range []string{"/keys/repository.asc", "/keys/repository.gpg"} {
+		w := get(config, url)
+		if w.Code != http.StatusOK {
+			t.Errorf("publicKeyHandler GET %s returned %v, should be %v", url, w.Code, http.StatusOK)
+			continue
+		}
+		var keys openpgp.EntityList
+		var err error
+		if url == "/keys/repository.asc" {
+			keys, err = openpgp.ReadArmoredKeyRing(w.Body)
+		} else {
+			keys, err = openpgp.ReadKeyRing(w.Body)
+		}
+		// the key is derived from the private key, and holds the whole public key with its subkeys
+		if err != nil || len(keys) != 1 || keyFingerprint(keys[0]) != "C75E922E23F9CEB9653D3325B431A69C48950176" || len(keys[0].Subkeys) != 3 {
+			t.Errorf("publicKeyHandler GET %s did not return the public key of the signing key: %v", url, err)
+			continue
+		}
+		if keys[0].PrivateKey != nil {
+			t.Errorf("publicKeyHandler GET %s returned the private key", url)
+		}
+	}
+	if w := get(config, "/keys/private.key"); w.Code != http.StatusNotFound {
+		t.Errorf("publicKeyHandler GET of an unknown key returned %v, should be %v", w.Code, http.StatusNotFound)
+	}
+
+	// the public key of an external signer is configured
+	config.ExternalSigner = &externalSignerConf{DetachSign: []string{"false"}, ClearSign: []string{"false"}, PublicKey: "samples/encrypted.pub"}
+	w := get(config, "/keys/repository.gpg")
+	keys, err := openpgp.ReadKeyRing(w.Body)
+	if err != nil || len(keys) != 1 || keyFingerprint(keys[0]) != "52CEA5CB74B8708E0F9C7F4C10F29421393A28E6" {
+		t.Errorf("publicKeyHandler GET did not return the key of the external signer: %v", err)
+	}
+
+	config.EnableSigning = false
+	if w := get(config, "/keys/repository.asc"); w.Code != http.StatusNotFound {
+		t.Errorf("publicKeyHandler GET without signing returned %v, should be %v", w.Code, http.StatusNotFound)
+	}
+}
+
+func TestAptSourceHandler(t *testing.T) {
+	config := conf{DistroNames: []string{"stable", "testing"}, Sections: []string{"main", "contrib"}, EnableSigning: true}
+	tests := []struct {
+		config conf
+		url    string
+		tls    bool
+		code   int
+		want   string
+	}{
+		{config, "/apt/stable.list", false, http.StatusOK, "deb [signed-by=/usr/share/keyrings/deb-simple-archive-keyring.gpg] http://repo.example.com:9090/ stable main contrib\n"},
+		{config, "/apt/testing.sources", true, http.StatusOK, "Types: deb\nURIs: https://repo.example.com:9090/\nSuites: testing\nComponents: main contrib\nSigned-By: /usr/share/keyrings/deb-simple-archive-keyring.gpg\n"},
+		{conf{DistroNames: []string{"stable"}, Sections: []string{"main"}, EnableSigning: true, KeyringName: "example-archive-keyring", PublicURL: "https://apt.example.com/repo"},
+			"/apt/stable.list", false, http.StatusOK, "deb [signed-by=/usr/share/keyrings/example-archive-keyring.gpg] https://apt.example.com/repo/ stable main\n"},
+		{conf{DistroNames: []string{"stable"}, Sections: []string{"main"}}, "/apt/stable.sources", false, http.StatusOK, "Types: deb\nURIs: http://repo.example.com:9090/\nSuites: stable\nComponents: main\nTrusted: yes\n"},
+		{config, "/apt/unstable.list", false, http.StatusNotFound, ""},
+		{config, "/apt/stable", false, http.StatusNotFound, ""},
+	}
+	for _, test := range tests {
+		req, _ := http.NewRequest("GET", "http://repo.example.com:9090"+test.url, nil)
+		if test.tls {
+			req = httptest.NewRequest("GET", "https://repo.example.com:9090"+test.url, nil)
+		}
+		w := httptest.NewRecorder()
+		aptSourceHandler(test.config).ServeHTTP(w, req)
+		if w.Code != test.code {
+			t.Errorf("aptSourceHandler GET %s returned %v, should be %v", test.url, w.Code, test.code)
+			continue
+		}
+		if test.code == http.StatusOK && !bytes.Equal(w.Body.Bytes(), []byte(test.want)) {
+			t.Errorf("aptSourceHandler GET %s returned:\n%s\nshould be:\n%s", test.url, w.Body, test.want)
+		}
+	}
+}
@@ -0,0 +1,92 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+)
+
+// byHashPath returns where the copy of an index file with the given digest is stored,
+// by-hash/<checksum>/<digest> next to the index file itself, where checksum is named as in the
+// Release file, such as SHA256.
+func byHashPath(indexPath string, checksum checksumType, digest string) string {
+	return filepath.Join(filepath.Dir(indexPath), "by-hash", checksum.release, digest)
+}
+
+// stageByHash stages a by-hash copy of every index file listed in the Release file for each configured
+// checksum, keyed by the digest it is listed with, as apt fetches index files by the strongest checksum
+// it finds. That way a client which fetched an older Release file can still download the index files it
+// describes. Copies that are no longer current are kept for the configured number of generations, and
+// older ones are removed.
+func stageByHash(pub *publication, config conf, indexHashes map[string]fileHashes) error {
+	current := make(map[string]map[string]bool)
+	for indexPath, hashes := range indexHashes {
+		for _, checksum := range config.Checksums() {
+			digest := hashes.get(checksum.name)
+			hashPath := byHashPath(indexPath, checksum, digest)
+			hashDir := filepath.Dir(hashPath)
+			if current[hashDir] == nil {
+				current[hashDir] = make(map[string]bool)
+			}
+			current[hashDir][digest] = true
+
+			if _, err := os.Stat(hashPath); err == nil {
+				// the same content has been published before
+				continue
+			}
+			if err := os.MkdirAll(hashDir, 0755); err != nil {
+				return fmt.Errorf("failed to create %s: %s", hashDir, err)
+			}
+			if err := copyStaged(pub, indexPath, hashPath); err != nil {
+				return err
+			}
+		}
+	}
+
+	for hashDir, digests := range current {
+		files, err := ioutil.ReadDir(hashDir)
+		if err != nil {
+			return fmt.Errorf("scanning: %s: %s", hashDir, err)
+		}
+		var old []os.FileInfo
+		for _, file := range files {
+			if !file.IsDir() && !digests[file.Name()] && file.Name()[0] != '.' {
+				old = append(old, file)
+			}
+		}
+		// every generation holds one file per index variant, so keep as many of the newest old
+		// files as the configured generations need
+		keep := config.ByHashGenerations() * len(digests)
+		if len(old) <= keep {
+			continue
+		}
+		sort.Slice(old, func(i, j int) bool {
+			return old[i].ModTime().After(old[j].ModTime())
+		})
+		for _, file := range old[keep:] {
+			pub.remove(filepath.Join(hashDir, file.Name()))
+		}
+	}
+	return nil
+}
+
+// copyStaged stages a copy of src, as staged in pub, at dst.
+func copyStaged(pub *publication, src, dst string) error {
+	in, err := pub.open(src)
+	if err != nil {
+		return fmt.Errorf("failed to open %s: %s", filepath.Base(src), err)
+	}
+	defer in.Close()
+	out, err := pub.create(dst)
+	if err != nil {
+		return fmt.Errorf("failed to create %s: %s", dst, err)
+	}
+	defer out.Close()
+	if _, err := io.Copy(out, in); err != nil {
+		return fmt.Errorf("failed to copy %s to %s: %s", filepath.Base(src), dst, err)
+	}
+	return out.Close()
+}
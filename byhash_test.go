@@ -0,0 +1,102 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestCreateReleaseByHash(t *testing.T) {
+	pwd, err := os.Getwd()
+	if err != nil {
+		t.Errorf("Unable to get current working directory: %s", err)
+	}
+	config := conf{RootRepoPath: pwd + "/testing", SupportArch: []string{"cats"}, DistroNames: []string{"stable"}, Sections: []string{"main"}, EnableSigning: true, PrivateKey: pwd + "/testing/private.key", ByHashRetention: 1, Hashes: []string{"sha256", "sha512"}}
+	if err := createDirs(config); err != nil {
+		t.Errorf("createDirs() failed: %s", err)
+	}
+	createKeyHandler(pwd+"/testing", "deb-simple test", "blah@blah.com")
+	archPath := config.ArchPath("stable", "main", "cats")
+	hashDir := filepath.Join(archPath, "by-hash", "SHA256")
+	sha512Dir := filepath.Join(archPath, "by-hash", "SHA512")
+
+	generation := func(add, remove string) {
+		if add != "" {
+			data, err := ioutil.ReadFile("samples/" + add)
+			if err != nil {
+				t.Errorf("error reading sample deb: %s", err)
+			}
+			if err := ioutil.WriteFile(filepath.Join(archPath, add), data, 0644); err != nil {
+				t.Errorf("error writing deb: %s", err)
+			}
+		}
+		if remove != "" {
+			os.Remove(filepath.Join(archPath, remove))
+		}
+		rebuildRepoMetadata(config, nil, filepath.Join(archPath, "test.deb"))
+	}
+
+	generation("vim-tiny_7.4.052-1ubuntu3_amd64.deb", "")
+	release, err := ioutil.ReadFile(config.RootRepoPath + "/dists/stable/Release")
+	if err != nil {
+		t.Errorf("error reading Release file: %s", err)
+	}
+	if !strings.Contains(string(release), "\nAcquire-By-Hash: yes\n") {
+		t.Errorf("Release should enable Acquire-By-Hash, returned value is:\n %s", release)
+	}
+	for _, name := range []string{"Packages", "Packages.gz"} {
+		hashes, err := hashFile(filepath.Join(archPath, name))
+		if err != nil {
+			t.Errorf("error hashing %s: %s", name, err)
+		}
+		if !strings.Contains(string(release), " "+hashes.SHA256+" ") {
+			t.Errorf("%s is not listed in the Release file", name)
+		}
+		stored, err := hashFile(filepath.Join(hashDir, hashes.SHA256))
+		if err != nil || stored.SHA256 != hashes.SHA256 {
+			t.Errorf("by-hash copy of %s is missing or wrong: %s", name, err)
+		}
+		// apt fetches by the strongest checksum in the Release file
+		stored, err = hashFile(filepath.Join(sha512Dir, hashes.SHA512))
+		if err != nil || stored.SHA512 != hashes.SHA512 {
+			t.Errorf("SHA512 by-hash copy of %s is missing or wrong: %s", name, err)
+		}
+	}
+
+	// one superseded generation is kept, older ones are removed
+	generation("hello-zst_1.0-1_all.deb", "")
+	if files, _ := ioutil.ReadDir(hashDir); len(files) != 4 {
+		t.Errorf("by-hash should hold two generations, found %d files", len(files))
+	}
+	firstGeneration, _ := ioutil.ReadDir(hashDir)
+	generation("", "vim-tiny_7.4.052-1ubuntu3_amd64.deb")
+	files, _ := ioutil.ReadDir(hashDir)
+	if len(files) != 4 {
+		t.Errorf("by-hash should hold two generations, found %d files", len(files))
+	}
+	if files, _ := ioutil.ReadDir(sha512Dir); len(files) != 4 {
+		t.Errorf("SHA512 by-hash should hold two generations, found %d files", len(files))
+	}
+	if _, err := os.Stat(filepath.Join(archPath, "by-hash", "MD5Sum")); !os.IsNotExist(err) {
+		t.Errorf("by-hash should only hold the configured checksums")
+	}
+	current, _ := hashFile(filepath.Join(archPath, "Packages"))
+	if _, err := os.Stat(filepath.Join(hashDir, current.SHA256)); err != nil {
+		t.Errorf("current Packages is missing from by-hash: %s", err)
+	}
+	remaining := 0
+	for _, file := range firstGeneration {
+		if _, err := os.Stat(filepath.Join(hashDir, file.Name())); err == nil {
+			remaining++
+		}
+	}
+	if remaining != 2 {
+		t.Errorf("only the second generation should be left from before, found %d files", remaining)
+	}
+
+	if err := os.RemoveAll(config.RootRepoPath); err != nil {
+		t.Errorf("error cleaning up after createRelease(): %s", err)
+	}
+}
@@ -0,0 +1,147 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+
+	"github.com/boltdb/bolt"
+)
+
+const packageCacheBucket = "PackageCache"
+
+// packageCacheEntry holds everything createPackagesGz needs to know about a single .deb, so that
+// unchanged packages don't have to be opened, decompressed and hashed on every rebuild.
+type packageCacheEntry struct {
+	Size    int64  `json:"size"`
+	ModTime int64  `json:"modTime"`
+	Control string `json:"control"`
+	MD5     string `json:"md5"`
+	SHA1    string `json:"sha1"`
+	SHA256  string `json:"sha256"`
+	SHA512  string `json:"sha512"`
+	// Inode and ChangeTime tell a file apart from one replaced with the same size and modification
+	// time, they are zero where fileIdentity doesn't know them
+	Inode      uint64 `json:"inode"`
+	ChangeTime int64  `json:"changeTime"`
+	// Contents lists the files in the package, it is only filled in when Contents indexes are enabled
+	Contents []string `json:"contents"`
+	// Signer is the fingerprint of the key the package is signed with, it is only checked when package
+	// signatures are verified
+	Signer           string `json:"signer"`
+	SignatureChecked bool   `json:"signatureChecked"`
+}
+
+// newPackageCacheEntry returns an entry without any package data for the file described by info.
+func newPackageCacheEntry(info os.FileInfo) packageCacheEntry {
+	inode, changeTime := fileIdentity(info)
+	return packageCacheEntry{Size: info.Size(), ModTime: info.ModTime().UnixNano(), Inode: inode, ChangeTime: changeTime}
+}
+
+// matches reports whether the cached entry still describes the file on disk. Size and modification
+// time alone don't tell, as tools like rsync and cp -p carry the modification time over; a file
+// replaced by another gets a new inode, and one rewritten in place a new change time.
+func (e packageCacheEntry) matches(info os.FileInfo) bool {
+	inode, changeTime := fileIdentity(info)
+	return e.Size == info.Size() && e.ModTime == info.ModTime().UnixNano() && e.Inode == inode && e.ChangeTime == changeTime && e.SHA256 != ""
+}
+
+// hashes returns the size and checksums of the cached package.
+func (e packageCacheEntry) hashes() fileHashes {
+	return fileHashes{Size: e.Size, MD5: e.MD5, SHA1: e.SHA1, SHA256: e.SHA256, SHA512: e.SHA512}
+}
+
+// hasChecksums reports whether the entry holds every one of the given checksums, which it won't when
+// more checksums have been configured since it was cached.
+func (e packageCacheEntry) hasChecksums(checksums []checksumType) bool {
+	for _, checksum := range checksums {
+		if e.hashes().get(checksum.name) == "" {
+			return false
+		}
+	}
+	return true
+}
+
+// packageCacheKey returns the cache key for a file, which is its path relative to the repo root.
+func packageCacheKey(config conf, path string) string {
+	relPath, err := filepath.Rel(config.RootRepoPath, path)
+	if err != nil {
+		return filepath.ToSlash(path)
+	}
+	return filepath.ToSlash(relPath)
+}
+
+// readPackageCache returns every cached entry whose key starts with prefix.
+// A missing bucket is not an error, it simply means nothing has been cached yet.
+func readPackageCache(db *bolt.DB, prefix string) (map[string]packageCacheEntry, error) {
+	entries := make(map[string]packageCacheEntry)
+	err := db.View(func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte(packageCacheBucket))
+		if b == nil {
+			return nil
+		}
+		c := b.Cursor()
+		for k, v := c.Seek([]byte(prefix)); k != nil && bytes.HasPrefix(k, []byte(prefix)); k, v = c.Next() {
+			var entry packageCacheEntry
+			if err := json.Unmarshal(v, &entry); err != nil {
+				// a corrupt entry is treated as a cache miss
+				continue
+			}
+			entries[string(k)] = entry
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("error reading package cache: %s", err)
+	}
+	return entries, nil
+}
+
+// writePackageCache replaces every cached entry under prefix with entries, in a single transaction.
+// Keys under prefix that are not in entries belong to packages that have been removed, and are dropped.
+func writePackageCache(db *bolt.DB, prefix string, entries map[string]packageCacheEntry) error {
+	err := db.Update(func(tx *bolt.Tx) error {
+		b, err := tx.CreateBucketIfNotExists([]byte(packageCacheBucket))
+		if err != nil {
+			return err
+		}
+		var stale [][]byte
+		c := b.Cursor()
+		for k, _ := c.Seek([]byte(prefix)); k != nil && bytes.HasPrefix(k, []byte(prefix)); k, _ = c.Next() {
+			if _, ok := entries[string(k)]; !ok {
+				stale = append(stale, append([]byte(nil), k...))
+			}
+		}
+		for _, k := range stale {
+			if err := b.Delete(k); err != nil {
+				return err
+			}
+		}
+		for key, entry := range entries {
+			value, err := json.Marshal(entry)
+			if err != nil {
+				return err
+			}
+			if err := b.Put([]byte(key), value); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return fmt.Errorf("error writing package cache: %s", err)
+	}
+	return nil
+}
+
+// clearPackageCache drops every cached entry, forcing the next rebuild to inspect every package.
+func clearPackageCache(db *bolt.DB) error {
+	return db.Update(func(tx *bolt.Tx) error {
+		if tx.Bucket([]byte(packageCacheBucket)) == nil {
+			return nil
+		}
+		return tx.DeleteBucket([]byte(packageCacheBucket))
+	})
+}
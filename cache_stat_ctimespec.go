@@ -0,0 +1,20 @@
+//go:build darwin || freebsd || netbsd
+
+package main
+
+import (
+	"os"
+	"syscall"
+)
+
+// statIdentityKnown is whether fileIdentity knows the inode and change time of files.
+const statIdentityKnown = true
+
+// fileIdentity returns the inode and change time of the file described by info.
+func fileIdentity(info os.FileInfo) (uint64, int64) {
+	stat, ok := info.Sys().(*syscall.Stat_t)
+	if !ok {
+		return 0, 0
+	}
+	return uint64(stat.Ino), stat.Ctimespec.Nano()
+}
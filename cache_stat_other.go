@@ -0,0 +1,14 @@
+//go:build !(linux || openbsd || solaris || dragonfly || darwin || freebsd || netbsd)
+
+package main
+
+import "os"
+
+// statIdentityKnown is whether fileIdentity knows the inode and change time of files. It doesn't
+// here, so cached packages are only compared by size and modification time.
+const statIdentityKnown = false
+
+// fileIdentity returns zeroes, as the inode and change time of files aren't available.
+func fileIdentity(info os.FileInfo) (uint64, int64) {
+	return 0, 0
+}
@@ -0,0 +1,150 @@
+package main
+
+import (
+	"io"
+	"io/ioutil"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/boltdb/bolt"
+)
+
+func TestPackageCache(t *testing.T) {
+	pwd, err := os.Getwd()
+	if err != nil {
+		t.Errorf("Unable to get current working directory: %s", err)
+	}
+	config := conf{ListenPort: "9666", RootRepoPath: pwd + "/testing", SupportArch: []string{"cats"}, DistroNames: []string{"stable"}, Sections: []string{"main"}, EnablePackageCache: true}
+
+	// create temp db
+	db, err := bolt.Open(tempfile(), 0666, nil)
+	if err != nil {
+		t.Fatalf("error creating tempdb: %s", err)
+	}
+	defer db.Close()
+
+	// do not use the built-in createDirs() in case it is broken
+	if err := os.MkdirAll(config.ArchPath("stable", "main", "cats"), 0755); err != nil {
+		t.Errorf("error creating directory: %s\n", err)
+	}
+	origDeb, err := os.Open("samples/vim-tiny_7.4.052-1ubuntu3_amd64.deb")
+	if err != nil {
+		t.Errorf("error opening up sample deb: %s", err)
+	}
+	defer origDeb.Close()
+	debPath := config.ArchPath("stable", "main", "cats") + "/test.deb"
+	copyDeb, err := os.Create(debPath)
+	if err != nil {
+		t.Errorf("error creating copy of deb: %s", err)
+	}
+	if _, err := io.Copy(copyDeb, origDeb); err != nil {
+		t.Errorf("error writing copy of deb: %s", err)
+	}
+	copyDeb.Close()
+
+	if err := createPackagesGz(config, db, "stable", "main", "cats"); err != nil {
+		t.Errorf("error creating Packages: %s", err)
+	}
+	entries, err := readPackageCache(db, "dists/stable/main/binary-cats/")
+	if err != nil {
+		t.Errorf("error reading package cache: %s", err)
+	}
+	entry, ok := entries["dists/stable/main/binary-cats/test.deb"]
+	if !ok {
+		t.Fatalf("package was not cached, cache contains: %v", entries)
+	}
+	if entry.Control != goodOutputGz {
+		t.Errorf("cached control data does not match, cached value is:\n %s", entry.Control)
+	}
+
+	// tamper with the cached entry, an unchanged file should be served from the cache
+	entry.Control = "Package: from-the-cache\n"
+	entries["dists/stable/main/binary-cats/test.deb"] = entry
+	if err := writePackageCache(db, "dists/stable/main/binary-cats/", entries); err != nil {
+		t.Errorf("error writing package cache: %s", err)
+	}
+	if err := createPackagesGz(config, db, "stable", "main", "cats"); err != nil {
+		t.Errorf("error creating Packages: %s", err)
+	}
+	pkgFile, _ := ioutil.ReadFile(config.ArchPath("stable", "main", "cats") + "/Packages")
+	if !strings.HasPrefix(string(pkgFile), "Package: from-the-cache\n") {
+		t.Errorf("Packages was not built from the cache, returned value is:\n %s", pkgFile)
+	}
+
+	// a changed mtime invalidates the entry
+	later := time.Now().Add(time.Hour)
+	if err := os.Chtimes(debPath, later, later); err != nil {
+		t.Errorf("error touching deb: %s", err)
+	}
+	if err := createPackagesGz(config, db, "stable", "main", "cats"); err != nil {
+		t.Errorf("error creating Packages: %s", err)
+	}
+	pkgFile, _ = ioutil.ReadFile(config.ArchPath("stable", "main", "cats") + "/Packages")
+	if string(pkgFile) != goodPkgGzOutput {
+		t.Errorf("Packages does not match, returned value is:\n %s \n\n should be:\n %s", pkgFile, goodPkgGzOutput)
+	}
+
+	// a different file with the same size and modification time invalidates the entry too, whether it
+	// replaces the package, as rsync does, or is written over it in place, as cp -p does
+	if statIdentityKnown {
+		info, err := os.Stat(debPath)
+		if err != nil {
+			t.Fatalf("error reading deb: %s", err)
+		}
+		original, _ := ioutil.ReadFile(debPath)
+		changed := append([]byte(nil), original...)
+		changed[len(changed)-1] ^= 0xff
+		for _, replace := range []struct {
+			name    string
+			content []byte
+			write   func(content []byte) error
+		}{
+			{"replaced", changed, func(content []byte) error {
+				if err := ioutil.WriteFile(debPath+".tmp", content, 0644); err != nil {
+					return err
+				}
+				if err := os.Chtimes(debPath+".tmp", info.ModTime(), info.ModTime()); err != nil {
+					return err
+				}
+				return os.Rename(debPath+".tmp", debPath)
+			}},
+			{"rewritten", original, func(content []byte) error {
+				if err := ioutil.WriteFile(debPath, content, 0644); err != nil {
+					return err
+				}
+				return os.Chtimes(debPath, info.ModTime(), info.ModTime())
+			}},
+		} {
+			if err := replace.write(replace.content); err != nil {
+				t.Fatalf("error writing %s deb: %s", replace.name, err)
+			}
+			if err := createPackagesGz(config, db, "stable", "main", "cats"); err != nil {
+				t.Errorf("error creating Packages: %s", err)
+			}
+			entries, _ = readPackageCache(db, "dists/stable/main/binary-cats/")
+			want, _ := hashFile(debPath)
+			if got := entries["dists/stable/main/binary-cats/test.deb"].SHA256; got != want.SHA256 {
+				t.Errorf("cache entry of the %s deb has SHA256 %s, should be %s", replace.name, got, want.SHA256)
+			}
+		}
+	}
+
+	// removed packages are dropped from the cache
+	if err := os.Remove(debPath); err != nil {
+		t.Errorf("error removing deb: %s", err)
+	}
+	if err := createPackagesGz(config, db, "stable", "main", "cats"); err != nil {
+		t.Errorf("error creating Packages: %s", err)
+	}
+	entries, _ = readPackageCache(db, "dists/stable/main/binary-cats/")
+	if len(entries) != 0 {
+		t.Errorf("package cache should be empty, contains: %v", entries)
+	}
+
+	// cleanup
+	if err := os.RemoveAll(config.RootRepoPath); err != nil {
+		t.Errorf("error cleaning up after createPackagesGz(): %s", err)
+	}
+}
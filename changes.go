@@ -0,0 +1,429 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/boltdb/bolt"
+)
+
+// changesComponent returns the component, or section in deb-simple terms, of a file listed in a
+// .changes. The Files field lists sections such as "utils" or "contrib/net", where anything outside
+// of main is prefixed with its component.
+func changesComponent(section string) string {
+	if i := strings.Index(section, "/"); i >= 0 {
+		return section[:i]
+	}
+	return "main"
+}
+
+// readChanges reads the .changes at path and returns its fields and the files it lists.
+func readChanges(path string) ([]controlField, []sourceFile, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, nil, fmt.Errorf("error reading %s: %s", filepath.Base(path), err)
+	}
+	fields := parseControlFields(dscText(data))
+	files, err := listedFiles(fields, ".changes")
+	if err != nil {
+		return nil, nil, err
+	}
+	return fields, files, nil
+}
+
+// pendingPackage is a binary package of a .changes upload that has been checked and is waiting to be
+// moved into place.
+type pendingPackage struct {
+	name    string
+	section string
+	arch    string
+	control string
+	// conflicts are the packages a forced upload replaces
+	conflicts []string
+}
+
+// processChanges publishes the upload described by the .changes in dir, which also holds the files it
+// lists. It has to be called with the global mutex held. Every file is checked against the sizes and
+// checksums of the .changes, the packages and source packages are checked the way individual uploads
+// are, and only once all of them passed and have been staged is anything moved into the distro named
+// by the Distribution field. The upload is published as a whole: if moving a file into place fails,
+// the files placed before it are taken out again. Listed files that are neither packages nor part of
+// a source package, such as .buildinfo files, are checked but not published.
+func processChanges(config conf, db *bolt.DB, dir, changesName string, force bool) error {
+	fields, files, err := readChanges(filepath.Join(dir, changesName))
+	if err != nil {
+		return err
+	}
+	var distros []string
+	for _, field := range fields {
+		if field.Name == "Distribution" {
+			distros = strings.Fields(field.Value)
+		}
+	}
+	if len(distros) != 1 {
+		return uploadErrorf(http.StatusBadRequest, "%s has to name exactly one distribution", changesName)
+	}
+	distro := distros[0]
+	if !contains(config.DistroNames, distro) {
+		return uploadErrorf(http.StatusBadRequest, "%s is for %s, which is not a distribution of this repository", changesName, distro)
+	}
+	// the checksums of a signed .changes vouch for the files it lists
+	if config.RequireSignedUploads {
+		if err := verifyUpload(config, filepath.Join(dir, changesName), nil, distro); err != nil {
+			return err
+		}
+	}
+
+	var sourceSection string
+	var sources []string
+	var pending []pendingPackage
+	for _, file := range files {
+		path := filepath.Join(dir, file.Name)
+		if _, err := os.Stat(path); os.IsNotExist(err) {
+			return uploadErrorf(http.StatusBadRequest, "%s lists %s, which was not uploaded", changesName, file.Name)
+		}
+		if err := verifySourceFile(path, file); err != nil {
+			return err
+		}
+		section := changesComponent(file.Section)
+		if !contains(config.Sections, section) {
+			return uploadErrorf(http.StatusBadRequest, "%s is in %s, which is not a section of this repository", file.Name, section)
+		}
+
+		switch {
+		case strings.HasSuffix(file.Name, ".deb"):
+			control, err := inspectPackage(path)
+			if err != nil {
+				return uploadErrorf(http.StatusBadRequest, "error inspecting %s: %s", file.Name, err)
+			}
+			if control == "" {
+				return uploadErrorf(http.StatusBadRequest, "%s has no control file", file.Name)
+			}
+			arch, err := routePackage(config, distro, section, "", file.Name, control)
+			if err != nil {
+				return err
+			}
+			if config.VerifyPackageSignatures {
+				if err := requirePackageSignature(config, path, file.Name); err != nil {
+					return err
+				}
+			}
+			pending = append(pending, pendingPackage{name: file.Name, section: section, arch: arch, control: control})
+		case isSourceFile(file.Name):
+			sources = append(sources, file.Name)
+			if strings.HasSuffix(file.Name, ".dsc") {
+				sourceSection = section
+			}
+		}
+	}
+
+	// the source package is staged on its own, like a regular upload
+	var stagingDir string
+	if len(sources) > 0 {
+		if sourceSection == "" {
+			return uploadErrorf(http.StatusBadRequest, "%s lists source files without a .dsc", changesName)
+		}
+		stagingDir, err = createStagingDir(config)
+		if err != nil {
+			return fmt.Errorf("error creating staging directory: %s", err)
+		}
+		defer os.RemoveAll(stagingDir)
+		for _, name := range sources {
+			if err := os.Rename(filepath.Join(dir, name), filepath.Join(stagingDir, name)); err != nil {
+				return fmt.Errorf("error staging %s: %s", name, err)
+			}
+		}
+		if err := verifySourceUpload(config, distro, sourceSection, stagingDir); err != nil {
+			return err
+		}
+	}
+
+	// duplicates are checked last, but nothing is replaced until the upload is published
+	var uploads []pendingPackage
+	for _, pkg := range pending {
+		duplicate, conflicts, err := findConflicts(config, db, distro, pkg.section, pkg.arch, filepath.Join(dir, pkg.name), pkg.name, pkg.control, force)
+		if err != nil {
+			return err
+		}
+		if !duplicate {
+			pkg.conflicts = conflicts
+			uploads = append(uploads, pkg)
+		}
+	}
+
+	// the packages are staged too, so the incoming directory can't change them while they are placed
+	packageDir, err := createStagingDir(config)
+	if err != nil {
+		return fmt.Errorf("error creating staging directory: %s", err)
+	}
+	defer os.RemoveAll(packageDir)
+	for _, pkg := range uploads {
+		if err := os.Rename(filepath.Join(dir, pkg.name), filepath.Join(packageDir, pkg.name)); err != nil {
+			return fmt.Errorf("error staging %s: %s", pkg.name, err)
+		}
+	}
+
+	// everything has been checked, so publish it all. A failure partway undoes whatever was done so
+	// far, and the metadata of everything that was touched is rebuilt either way.
+	var published []string
+	var undo []func() error
+	defer func() {
+		if len(published) > 0 && !parsedconfig.EnableDirectoryWatching {
+			rebuildRepoMetadata(config, db, published...)
+			if *verbose {
+				log.Printf("Repository %s has been rebuilt for %s", distro, changesName)
+			}
+		}
+	}()
+	rollback := func(err error) error {
+		for i := len(undo) - 1; i >= 0; i-- {
+			if err := undo[i](); err != nil {
+				log.Printf("error rolling back %s: %s", changesName, err)
+			}
+		}
+		return err
+	}
+	for _, pkg := range uploads {
+		for _, filename := range pkg.conflicts {
+			restore, err := movePackageAside(config, distro, pkg.section, pkg.arch, filename, packageDir)
+			if err != nil {
+				return rollback(fmt.Errorf("error replacing %s: %s", filename, err))
+			}
+			undo = append(undo, restore)
+			published = append(published, filepath.Join(config.ArchPath(distro, pkg.section, pkg.arch), filename))
+			if *verbose {
+				log.Printf("%s has been replaced by %s in %s %s %s", filename, pkg.name, distro, pkg.section, pkg.arch)
+			}
+		}
+	}
+	if stagingDir != "" {
+		// files that were already there are identical to the uploaded ones, and stay
+		sourcePath := config.SourcePath(distro, sourceSection)
+		var added []string
+		for _, name := range sources {
+			if _, err := os.Lstat(filepath.Join(sourcePath, name)); os.IsNotExist(err) {
+				added = append(added, name)
+			}
+		}
+		undo = append(undo, func() error {
+			for _, name := range added {
+				if err := os.Remove(filepath.Join(sourcePath, name)); err != nil && !os.IsNotExist(err) {
+					return err
+				}
+			}
+			return nil
+		})
+		published = append(published, filepath.Join(sourcePath, "Sources"))
+		if err := moveSourceUpload(config, distro, sourceSection, stagingDir); err != nil {
+			return rollback(err)
+		}
+	}
+	for _, pkg := range uploads {
+		// a forced upload may replace a pool file other distros link to, keep it to put it back
+		if config.UsePool && force {
+			restore, err := keepPoolFile(config, pkg.section, pkg.name, pkg.control, packageDir)
+			if err != nil {
+				return rollback(err)
+			}
+			undo = append(undo, restore)
+		}
+		paths, err := placePackage(config, distro, pkg.section, pkg.arch, filepath.Join(packageDir, pkg.name), pkg.name, force)
+		if err != nil {
+			return rollback(err)
+		}
+		section, arch, name := pkg.section, pkg.arch, pkg.name
+		undo = append(undo, func() error {
+			return removePackage(config, distro, section, arch, name)
+		})
+		published = append(published, paths...)
+		if *verbose {
+			log.Printf("Deb package %s has been uploaded to %s %s %s", pkg.name, distro, pkg.section, pkg.arch)
+		}
+	}
+
+	// the retention policy is only applied once the whole upload is in place, as what it removes
+	// can't be put back
+	var pruned error
+	if stagingDir != "" {
+		removed, err := applySourceRetention(config, distro, sourceSection)
+		if err != nil {
+			log.Printf("error applying retention policy: %s", err)
+		}
+		pruned = prunedUpload(removed, sources, distro, sourceSection)
+	}
+	for _, pkg := range uploads {
+		removed, err := applyRetention(config, db, distro, pkg.section, pkg.arch)
+		if err != nil {
+			log.Printf("error applying retention policy: %s", err)
+		}
+		if err := prunedUpload(removed, []string{pkg.name}, distro, pkg.section); err != nil && pruned == nil {
+			pruned = err
+		}
+	}
+	return pruned
+}
+
+// discardChanges removes a .changes from dir along with the files it lists.
+func discardChanges(dir, changesName string) {
+	if _, files, err := readChanges(filepath.Join(dir, changesName)); err == nil {
+		for _, file := range files {
+			os.Remove(filepath.Join(dir, file.Name))
+		}
+	}
+	os.Remove(filepath.Join(dir, changesName))
+}
+
+// writeIncoming writes an uploaded file into dir under name, through a temporary file so a partly
+// written file never shows up under its final name.
+func writeIncoming(dir, name string, r io.Reader) error {
+	if name != filepath.Base(name) || name == "" || strings.HasPrefix(name, ".") {
+		return uploadErrorf(http.StatusBadRequest, "invalid file name %s", name)
+	}
+	tmp, err := ioutil.TempFile(dir, ".upload-")
+	if err != nil {
+		return fmt.Errorf("error creating %s: %s", name, err)
+	}
+	defer os.Remove(tmp.Name())
+	_, err = io.Copy(tmp, r)
+	tmp.Close()
+	if err != nil {
+		return fmt.Errorf("error writing %s: %s", name, err)
+	}
+	if err := os.Chmod(tmp.Name(), 0644); err != nil {
+		return fmt.Errorf("error writing %s: %s", name, err)
+	}
+	if err := os.Rename(tmp.Name(), filepath.Join(dir, name)); err != nil {
+		return fmt.Errorf("error writing %s: %s", name, err)
+	}
+	return nil
+}
+
+// expireIncoming removes files that have been in the incoming directory for longer than maxAge, as
+// the .changes listing them is never going to arrive.
+func expireIncoming(config conf, maxAge time.Duration) {
+	files, err := ioutil.ReadDir(config.IncomingPath())
+	if err != nil {
+		log.Printf("error reading incoming directory: %s", err)
+		return
+	}
+	for _, file := range files {
+		if file.IsDir() || Now().Sub(file.ModTime()) <= maxAge {
+			continue
+		}
+		if err := os.Remove(filepath.Join(config.IncomingPath(), file.Name())); err != nil {
+			log.Printf("error removing %s: %s", file.Name(), err)
+		} else if *verbose {
+			log.Printf("Removed %s from the incoming directory, its .changes never arrived", file.Name())
+		}
+	}
+}
+
+// changesHandler accepts uploads described by a .changes file. A POST carries the .changes and the
+// files it lists as a multipart form, as the upload endpoint does. dput's http method instead PUTs
+// each file to /changes/<name>, the .changes last, so files are kept in the incoming directory until
+// their .changes arrives. As dput can't add query parameters, the API key can be given as part of
+// the path too, as /changes/<key>/<name>.
+func changesHandler(config conf, db *bolt.DB) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		log.Printf("%s %s %s\n", r.RemoteAddr, r.Method, r.URL)
+		if r.Method != "POST" && r.Method != "PUT" {
+			http.Error(w, "method not supported", http.StatusMethodNotAllowed)
+			return
+		}
+		apiKey := r.URL.Query().Get("key")
+		var name string
+		if r.Method == "PUT" {
+			pathParts := strings.Split(strings.Trim(strings.TrimPrefix(r.URL.Path, "/changes"), "/"), "/")
+			switch len(pathParts) {
+			case 1:
+				name = pathParts[0]
+			case 2:
+				apiKey, name = pathParts[0], pathParts[1]
+			default:
+				http.Error(w, "invalid upload path", http.StatusBadRequest)
+				return
+			}
+		}
+		if config.EnableAPIKeys {
+			if apiKey == "" {
+				http.Error(w, "api key not present", http.StatusUnauthorized)
+				return
+			}
+			if !validateAPIkey(db, apiKey) {
+				http.Error(w, "api key not valid", http.StatusUnauthorized)
+				return
+			}
+		}
+		// force replaces existing packages with the same name, version and architecture
+		force, _ := strconv.ParseBool(r.URL.Query().Get("force"))
+
+		if r.Method == "PUT" {
+			if err := writeIncoming(config.IncomingPath(), name, r.Body); err != nil {
+				uploadFailed(w, err)
+				return
+			}
+			if !strings.HasSuffix(name, ".changes") {
+				return
+			}
+			defer discardChanges(config.IncomingPath(), name)
+			mutex.Lock()
+			defer mutex.Unlock()
+			if err := processChanges(config, db, config.IncomingPath(), name, force); err != nil {
+				uploadFailed(w, err)
+				return
+			}
+			return
+		}
+
+		reader, err := r.MultipartReader()
+		if err != nil {
+			httpErrorf(w, "error creating multipart reader: %s", err)
+			return
+		}
+		stagingDir, err := createStagingDir(config)
+		if err != nil {
+			httpErrorf(w, "error creating staging directory: %s", err)
+			return
+		}
+		defer os.RemoveAll(stagingDir)
+		var changes []string
+		for {
+			part, err := reader.NextPart()
+			if err == io.EOF {
+				break
+			}
+			if err != nil {
+				httpErrorf(w, "error reading multipart body: %s", err)
+				return
+			}
+			if part.FileName() == "" {
+				continue
+			}
+			if err := writeIncoming(stagingDir, part.FileName(), part); err != nil {
+				uploadFailed(w, err)
+				return
+			}
+			if strings.HasSuffix(part.FileName(), ".changes") {
+				changes = append(changes, part.FileName())
+			}
+		}
+		if len(changes) != 1 {
+			http.Error(w, "exactly one .changes file has to be uploaded", http.StatusBadRequest)
+			return
+		}
+		mutex.Lock()
+		defer mutex.Unlock()
+		if err := processChanges(config, db, stagingDir, changes[0], force); err != nil {
+			uploadFailed(w, err)
+			return
+		}
+	})
+}
@@ -0,0 +1,254 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/boltdb/bolt"
+)
+
+// writeTestChanges writes a .changes for distro to path, listing the given files under the utils section.
+func writeTestChanges(t testing.TB, path, distro string, files ...string) {
+	var sums, sha256s strings.Builder
+	for _, file := range files {
+		hashes, err := hashFile(file)
+		if err != nil {
+			t.Fatalf("error hashing %s: %s", file, err)
+		}
+		fmt.Fprintf(&sums, "\n %s %d utils optional %s", hashes.MD5, hashes.Size, filepath.Base(file))
+		fmt.Fprintf(&sha256s, "\n %s %d %s", hashes.SHA256, hashes.Size, filepath.Base(file))
+	}
+	changes := "Format: 1.8\nSource: hello\nVersion: 1.0-1\nDistribution: " + distro +
+		"\nChecksums-Sha256:" + sha256s.String() + "\nFiles:" + sums.String() + "\n"
+	if err := ioutil.WriteFile(path, []byte(changes), 0644); err != nil {
+		t.Fatalf("error writing %s: %s", path, err)
+	}
+}
+
+func TestChangesHandler(t *testing.T) {
+	pwd, err := os.Getwd()
+	if err != nil {
+		t.Errorf("Unable to get current working directory: %s", err)
+	}
+	config := conf{ListenPort: "9666", RootRepoPath: pwd + "/testing", SupportArch: []string{"all", "amd64"}, DistroNames: []string{"stable", "testing"}, Sections: []string{"main"}, EnableDirectoryWatching: false}
+	if err := createDirs(config); err != nil {
+		t.Errorf("createDirs() failed: %s", err)
+	}
+	db, err := bolt.Open(tempfile(), 0666, nil)
+	if err != nil {
+		t.Fatalf("error creating tempdb: %s", err)
+	}
+	defer db.Close()
+	changesHandle := changesHandler(config, db)
+
+	// GET
+	req, _ := http.NewRequest("GET", "/changes", nil)
+	w := httptest.NewRecorder()
+	changesHandle.ServeHTTP(w, req)
+	if w.Code != http.StatusMethodNotAllowed {
+		t.Errorf("changesHandler GET returned %v, should be %v", w.Code, http.StatusMethodNotAllowed)
+	}
+
+	// a .changes whose files don't match is rejected, and nothing is published
+	uploadFiles := []string{"samples/hello-src_1.0-1.dsc", "samples/hello-src_1.0.orig.tar.gz", "samples/hello-src_1.0-1.debian.tar.xz", "samples/hello-zst_1.0-1_all.deb"}
+	changesPath := filepath.Join(config.RootRepoPath, "hello_1.0-1_amd64.changes")
+	writeTestChanges(t, changesPath, "stable", "samples/hello-src_1.0-1.dsc", "samples/hello-src_1.0.orig.tar.gz", "samples/vim-tiny_7.4.052-1ubuntu3_amd64.deb")
+	body, contentType := multipartBody(t, append([]string{changesPath, "hello-src_1.0.orig.tar.gz=samples/hello-src_1.0-1.debian.tar.xz"}, uploadFiles[0], "samples/vim-tiny_7.4.052-1ubuntu3_amd64.deb")...)
+	req, _ = http.NewRequest("POST", "/changes", body)
+	req.Header.Add("Content-Type", contentType)
+	w = httptest.NewRecorder()
+	changesHandle.ServeHTTP(w, req)
+	if w.Code != http.StatusBadRequest {
+		t.Errorf("changesHandler POST with a bad checksum returned %v, should be %v", w.Code, http.StatusBadRequest)
+	}
+	for _, path := range []string{
+		filepath.Join(config.SourcePath("stable", "main"), "hello-src_1.0-1.dsc"),
+		filepath.Join(config.ArchPath("stable", "main", "amd64"), "vim-tiny_7.4.052-1ubuntu3_amd64.deb"),
+	} {
+		if _, err := os.Stat(path); !os.IsNotExist(err) {
+			t.Errorf("%s should not have been published", path)
+		}
+	}
+
+	// a complete upload publishes the source and binary packages together
+	writeTestChanges(t, changesPath, "stable", uploadFiles...)
+	body, contentType = multipartBody(t, append([]string{changesPath}, uploadFiles...)...)
+	req, _ = http.NewRequest("POST", "/changes", body)
+	req.Header.Add("Content-Type", contentType)
+	w = httptest.NewRecorder()
+	changesHandle.ServeHTTP(w, req)
+	if w.Code != http.StatusOK {
+		t.Errorf("changesHandler POST returned %v, should be %v: %s", w.Code, http.StatusOK, w.Body.String())
+	}
+	packages, _ := ioutil.ReadFile(filepath.Join(config.ArchPath("stable", "main", "all"), "Packages"))
+	if !strings.Contains(string(packages), "Package: hello-zst\n") {
+		t.Errorf("Packages should list hello-zst:\n%s", packages)
+	}
+	sources, _ := ioutil.ReadFile(filepath.Join(config.SourcePath("stable", "main"), "Sources"))
+	if !strings.Contains(string(sources), "Package: hello-src\n") {
+		t.Errorf("Sources should list hello-src:\n%s", sources)
+	}
+
+	// dput PUTs each file, followed by the .changes
+	writeTestChanges(t, changesPath, "testing", "samples/vim-tiny_7.4.052-1ubuntu3_amd64.deb")
+	for _, file := range []string{"samples/vim-tiny_7.4.052-1ubuntu3_amd64.deb", changesPath} {
+		f, err := os.Open(file)
+		if err != nil {
+			t.Fatalf("error opening %s: %s", file, err)
+		}
+		req, _ = http.NewRequest("PUT", "/changes/"+filepath.Base(file), f)
+		w = httptest.NewRecorder()
+		changesHandle.ServeHTTP(w, req)
+		f.Close()
+		if w.Code != http.StatusOK {
+			t.Errorf("changesHandler PUT of %s returned %v, should be %v: %s", file, w.Code, http.StatusOK, w.Body.String())
+		}
+	}
+	if _, err := os.Stat(filepath.Join(config.ArchPath("testing", "main", "amd64"), "vim-tiny_7.4.052-1ubuntu3_amd64.deb")); err != nil {
+		t.Errorf("vim-tiny should have been published to testing: %s", err)
+	}
+	if files, _ := ioutil.ReadDir(config.IncomingPath()); len(files) != 0 {
+		t.Errorf("incoming directory should be empty after processing the .changes, holds %d files", len(files))
+	}
+
+	// cleanup
+	if err := os.RemoveAll(config.RootRepoPath); err != nil {
+		t.Errorf("error cleaning up after changesHandler(): %s", err)
+	}
+}
+
+func TestProcessChangesRollback(t *testing.T) {
+	pwd, err := os.Getwd()
+	if err != nil {
+		t.Errorf("Unable to get current working directory: %s", err)
+	}
+	config := conf{ListenPort: "9666", RootRepoPath: pwd + "/testing", SupportArch: []string{"all", "amd64"}, DistroNames: []string{"stable"}, Sections: []string{"main"}, UsePool: true}
+	if err := createDirs(config); err != nil {
+		t.Errorf("createDirs() failed: %s", err)
+	}
+	db, err := bolt.Open(tempfile(), 0666, nil)
+	if err != nil {
+		t.Fatalf("error creating tempdb: %s", err)
+	}
+	defer db.Close()
+
+	// a different package under the name of hello-zst, which the forced upload replaces
+	replaced := filepath.Join(config.ArchPath("stable", "main", "all"), "hello-zst_1.0-1_all.deb")
+	other, _ := ioutil.ReadFile("samples/vim-tiny_7.4.052-1ubuntu3_amd64.deb")
+	if err := ioutil.WriteFile(replaced, other, 0644); err != nil {
+		t.Fatalf("error writing %s: %s", replaced, err)
+	}
+	// vim-tiny is placed last, and can't go into the pool
+	if err := os.MkdirAll(filepath.Join(config.PoolPath(), "main"), 0755); err != nil {
+		t.Fatalf("error creating pool: %s", err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(config.PoolPath(), "main", "v"), nil, 0644); err != nil {
+		t.Fatalf("error blocking the pool: %s", err)
+	}
+
+	stagingDir, err := createStagingDir(config)
+	if err != nil {
+		t.Fatalf("error creating staging directory: %s", err)
+	}
+	defer os.RemoveAll(stagingDir)
+	uploadFiles := []string{"samples/hello-src_1.0-1.dsc", "samples/hello-src_1.0.orig.tar.gz", "samples/hello-src_1.0-1.debian.tar.xz", "samples/hello-zst_1.0-1_all.deb", "samples/vim-tiny_7.4.052-1ubuntu3_amd64.deb"}
+	for _, file := range uploadFiles {
+		data, _ := ioutil.ReadFile(file)
+		if err := ioutil.WriteFile(filepath.Join(stagingDir, filepath.Base(file)), data, 0644); err != nil {
+			t.Fatalf("error staging %s: %s", file, err)
+		}
+	}
+	writeTestChanges(t, filepath.Join(stagingDir, "hello_1.0-1_amd64.changes"), "stable", uploadFiles...)
+
+	if err := processChanges(config, db, stagingDir, "hello_1.0-1_amd64.changes", true); err == nil {
+		t.Errorf("processChanges() should fail when a package can't be placed")
+	}
+	for _, path := range []string{
+		filepath.Join(config.SourcePath("stable", "main"), "hello-src_1.0-1.dsc"),
+		filepath.Join(config.SourcePath("stable", "main"), "hello-src_1.0.orig.tar.gz"),
+		filepath.Join(config.PoolPath(), "main", "h", "hello-zst", "hello-zst_1.0-1_all.deb"),
+	} {
+		if _, err := os.Lstat(path); !os.IsNotExist(err) {
+			t.Errorf("%s should have been rolled back", path)
+		}
+	}
+	if data, err := ioutil.ReadFile(replaced); err != nil {
+		t.Errorf("the replaced package should have been restored: %s", err)
+	} else if !bytes.Equal(data, other) {
+		t.Errorf("the replaced package should have been restored, found the upload")
+	}
+	// the metadata of everything that was touched is rebuilt
+	packages, err := ioutil.ReadFile(filepath.Join(config.ArchPath("stable", "main", "all"), "Packages"))
+	if err != nil {
+		t.Errorf("Packages should have been rebuilt: %s", err)
+	}
+	if !strings.Contains(string(packages), "Package: vim-tiny\n") || strings.Contains(string(packages), "Package: hello-zst\n") {
+		t.Errorf("Packages should list the restored package only:\n%s", packages)
+	}
+
+	// cleanup
+	if err := os.RemoveAll(config.RootRepoPath); err != nil {
+		t.Errorf("error cleaning up after processChanges(): %s", err)
+	}
+}
+
+func TestExpireIncoming(t *testing.T) {
+	defer func(now func() time.Time) { Now = now }(Now)
+	pwd, err := os.Getwd()
+	if err != nil {
+		t.Errorf("Unable to get current working directory: %s", err)
+	}
+	config := conf{ListenPort: "9666", RootRepoPath: pwd + "/testing", SupportArch: []string{"amd64"}, DistroNames: []string{"stable"}, Sections: []string{"main"}}
+	if err := createDirs(config); err != nil {
+		t.Fatalf("createDirs() failed: %s", err)
+	}
+	if strings.HasPrefix(config.IncomingPath(), config.RootRepoPath+"/") {
+		t.Errorf("incoming directory %s should not be served from %s", config.IncomingPath(), config.RootRepoPath)
+	}
+	for _, name := range []string{"old_1.0_amd64.deb", "new_1.0_amd64.deb"} {
+		if err := writeIncoming(config.IncomingPath(), name, strings.NewReader(name)); err != nil {
+			t.Fatalf("writeIncoming() failed: %s", err)
+		}
+	}
+	old := time.Now().Add(-25 * time.Hour)
+	if err := os.Chtimes(filepath.Join(config.IncomingPath(), "old_1.0_amd64.deb"), old, old); err != nil {
+		t.Fatalf("error setting modification time: %s", err)
+	}
+	maxAge, err := config.IncomingExpiry()
+	if err != nil || maxAge != 24*time.Hour {
+		t.Errorf("IncomingExpiry() returned %v, %v, should default to 24h", maxAge, err)
+	}
+
+	expireIncoming(config, maxAge)
+	if _, err := os.Stat(filepath.Join(config.IncomingPath(), "old_1.0_amd64.deb")); !os.IsNotExist(err) {
+		t.Errorf("old_1.0_amd64.deb should have expired")
+	}
+	if _, err := os.Stat(filepath.Join(config.IncomingPath(), "new_1.0_amd64.deb")); err != nil {
+		t.Errorf("new_1.0_amd64.deb should still be there: %s", err)
+	}
+	Now = func() time.Time {
+		return time.Now().Add(25 * time.Hour)
+	}
+	expireIncoming(config, maxAge)
+	if files, _ := ioutil.ReadDir(config.IncomingPath()); len(files) != 0 {
+		t.Errorf("incoming directory should be empty once everything expired, holds %d files", len(files))
+	}
+
+	config.IncomingMaxAge = "a while"
+	if _, err := config.IncomingExpiry(); err == nil {
+		t.Errorf("IncomingExpiry() should fail for an invalid incomingMaxAge")
+	}
+
+	// cleanup
+	if err := os.RemoveAll(config.RootRepoPath); err != nil {
+		t.Errorf("error cleaning up after expireIncoming(): %s", err)
+	}
+}
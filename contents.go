@@ -0,0 +1,205 @@
+package main
+
+import (
+	"archive/tar"
+	"bufio"
+	"compress/gzip"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/blakesmith/ar"
+)
+
+// inspectPackageContents lists the files shipped in the data.tar member of a package.
+// Paths are relative to the filesystem root, and directories are left out, as in a Contents index.
+func inspectPackageContents(filename string) ([]string, error) {
+	f, err := os.Open(filename)
+	if err != nil {
+		return nil, fmt.Errorf("error opening package file %s: %s", filename, err)
+	}
+	defer f.Close()
+
+	if *verbose {
+		log.Printf("Listing contents of package file \"%s\"", filename)
+	}
+
+	arReader := ar.NewReader(f)
+	for {
+		header, err := arReader.Next()
+
+		if err == io.EOF {
+			break
+		}
+
+		if err != nil {
+			return nil, fmt.Errorf("error in inspectPackageContents loop: %s", err)
+		}
+
+		if strings.HasPrefix(header.Name, "data.tar") {
+			compression, err := compressionFromName(header.Name)
+			if err != nil {
+				return nil, fmt.Errorf("No data file found: %s", err)
+			}
+			return inspectPackageData(compression, arReader)
+		}
+	}
+	return nil, errors.New("No data file found")
+}
+
+// inspectPackageData lists the files in a compressed data.tar stream.
+func inspectPackageData(compression Compression, r io.Reader) ([]string, error) {
+	compFile, err := decompressReader(compression, r)
+	if err != nil {
+		return nil, fmt.Errorf("error creating %s reader: %s", compression, err)
+	}
+	defer compFile.Close()
+
+	files := []string{}
+	tarReader := tar.NewReader(compFile)
+	for {
+		header, err := tarReader.Next()
+
+		if err == io.EOF {
+			break
+		}
+
+		if err != nil {
+			return nil, fmt.Errorf("failed to list package contents: %s", err)
+		}
+
+		if header.Typeflag == tar.TypeDir {
+			continue
+		}
+		name := strings.TrimPrefix(path.Clean("/"+header.Name), "/")
+		if name != "" {
+			files = append(files, name)
+		}
+	}
+	return files, nil
+}
+
+// contentsLocation returns the qualified package name used in Contents indexes, [section/]name.
+func contentsLocation(control string) string {
+	fields := parseControl(control)
+	if fields["Section"] == "" {
+		return fields["Package"]
+	}
+	return fields["Section"] + "/" + fields["Package"]
+}
+
+// contentsIndex maps each file path to the qualified names of the packages shipping it.
+type contentsIndex map[string]map[string]bool
+
+func (ci contentsIndex) add(file, location string) {
+	if ci[file] == nil {
+		ci[file] = make(map[string]bool)
+	}
+	ci[file][location] = true
+}
+
+// writeContents stages the index, sorted by path, as a gzipped Contents file.
+func (ci contentsIndex) writeContents(pub *publication, filename string) error {
+	f, err := pub.create(filename)
+	if err != nil {
+		return fmt.Errorf("failed to create %s: %s", filepath.Base(filename), err)
+	}
+	defer f.Close()
+	gzOut := gzip.NewWriter(f)
+
+	files := make([]string, 0, len(ci))
+	for file := range ci {
+		files = append(files, file)
+	}
+	sort.Strings(files)
+	for _, file := range files {
+		locations := make([]string, 0, len(ci[file]))
+		for location := range ci[file] {
+			locations = append(locations, location)
+		}
+		sort.Strings(locations)
+		fmt.Fprintf(gzOut, "%s\t%s\n", file, strings.Join(locations, ","))
+	}
+
+	if err := gzOut.Close(); err != nil {
+		return fmt.Errorf("failed to write %s: %s", filepath.Base(filename), err)
+	}
+	return f.Close()
+}
+
+// readContents merges a gzipped Contents file, as staged in pub, into the index.
+func (ci contentsIndex) readContents(pub *publication, filename string) error {
+	f, err := pub.open(filename)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	gzIn, err := gzip.NewReader(f)
+	if err != nil {
+		return fmt.Errorf("error reading %s: %s", filename, err)
+	}
+	scanner := bufio.NewScanner(gzIn)
+	for scanner.Scan() {
+		line := scanner.Text()
+		sep := strings.LastIndexAny(line, " \t")
+		if sep == -1 {
+			continue
+		}
+		for _, location := range strings.Split(line[sep+1:], ",") {
+			ci.add(strings.TrimRight(line[:sep], " \t"), location)
+		}
+	}
+	return scanner.Err()
+}
+
+// createSectionContents stages dists/<distro>/<section>/Contents-<arch>.gz from the cache entries
+// of the packages in the arch directory.
+func createSectionContents(pub *publication, config conf, distro, section, arch string, entries map[string]packageCacheEntry) error {
+	if *verbose {
+		log.Printf("Rebuilding Contents-%s.gz file for %s %s", arch, distro, section)
+	}
+
+	index := make(contentsIndex)
+	for _, entry := range entries {
+		location := contentsLocation(entry.Control)
+		for _, file := range entry.Contents {
+			index.add(file, location)
+		}
+	}
+	return index.writeContents(pub, filepath.Join(config.RootRepoPath, "dists", distro, section, "Contents-"+arch+".gz"))
+}
+
+// createContents rebuilds and publishes the top-level Contents files of a distro.
+func createContents(config conf, distro string) error {
+	return publish(func(pub *publication) error {
+		return stageContents(pub, config, distro)
+	})
+}
+
+// stageContents merges the Contents-<arch>.gz files of every section of a distro into a
+// top-level dists/<distro>/Contents-<arch>.gz.
+func stageContents(pub *publication, config conf, distro string) error {
+	if *verbose {
+		log.Printf("Rebuilding Contents files for \"%s\"", distro)
+	}
+
+	for _, arch := range config.SupportArch {
+		index := make(contentsIndex)
+		for _, section := range config.Sections {
+			err := index.readContents(pub, filepath.Join(config.RootRepoPath, "dists", distro, section, "Contents-"+arch+".gz"))
+			if err != nil && !os.IsNotExist(err) {
+				return err
+			}
+		}
+		if err := index.writeContents(pub, filepath.Join(config.RootRepoPath, "dists", distro, "Contents-"+arch+".gz")); err != nil {
+			return err
+		}
+	}
+	return nil
+}
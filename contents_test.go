@@ -0,0 +1,99 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"io"
+	"io/ioutil"
+	"os"
+	"reflect"
+	"testing"
+)
+
+var goodContentsOutput = "usr/bin/hello-zst\tutils/hello-zst\nusr/share/doc/hello-zst/README\tutils/hello-zst\n"
+
+func TestInspectPackageContents(t *testing.T) {
+	files, err := inspectPackageContents("samples/hello-zst_1.0-1_all.deb")
+	if err != nil {
+		t.Errorf("inspectPackageContents() error: %s", err)
+	}
+	if !reflect.DeepEqual(files, []string{"usr/bin/hello-zst", "usr/share/doc/hello-zst/README"}) {
+		t.Errorf("package contents do not match, returned value is: %v", files)
+	}
+
+	files, err = inspectPackageContents("samples/vim-tiny_7.4.052-1ubuntu3_amd64.deb")
+	if err != nil {
+		t.Errorf("inspectPackageContents() error: %s", err)
+	}
+	if len(files) != 10 || files[0] != "usr/bin/vim.tiny" || files[9] != "usr/share/doc/vim-tiny" {
+		t.Errorf("package contents do not match, returned value is: %v", files)
+	}
+
+	_, err = inspectPackageContents("thisfileshouldnotexist")
+	if err == nil {
+		t.Error("inspectPackageContents() should have failed, it did not")
+	}
+}
+
+func TestCreateContents(t *testing.T) {
+	pwd, err := os.Getwd()
+	if err != nil {
+		t.Errorf("Unable to get current working directory: %s", err)
+	}
+	config := conf{ListenPort: "9666", RootRepoPath: pwd + "/testing", SupportArch: []string{"cats"}, DistroNames: []string{"stable"}, Sections: []string{"main", "blah"}, EnableContents: true}
+
+	// do not use the built-in createDirs() in case it is broken
+	for _, section := range config.Sections {
+		if err := os.MkdirAll(config.ArchPath("stable", section, "cats"), 0755); err != nil {
+			t.Errorf("error creating directory: %s\n", err)
+		}
+	}
+	origDeb, err := os.Open("samples/hello-zst_1.0-1_all.deb")
+	if err != nil {
+		t.Errorf("error opening up sample deb: %s", err)
+	}
+	defer origDeb.Close()
+	copyDeb, err := os.Create(config.ArchPath("stable", "main", "cats") + "/hello-zst_1.0-1_all.deb")
+	if err != nil {
+		t.Errorf("error creating copy of deb: %s", err)
+	}
+	if _, err := io.Copy(copyDeb, origDeb); err != nil {
+		t.Errorf("error writing copy of deb: %s", err)
+	}
+	copyDeb.Close()
+
+	for _, section := range config.Sections {
+		if err := createPackagesGz(config, nil, "stable", section, "cats"); err != nil {
+			t.Errorf("error creating Packages: %s", err)
+		}
+	}
+	if err := createContents(config, "stable"); err != nil {
+		t.Errorf("error creating Contents: %s", err)
+	}
+
+	for file, want := range map[string]string{
+		"/dists/stable/main/Contents-cats.gz": goodContentsOutput,
+		"/dists/stable/blah/Contents-cats.gz": "",
+		"/dists/stable/Contents-cats.gz":      goodContentsOutput,
+	} {
+		contentsGz, err := ioutil.ReadFile(config.RootRepoPath + file)
+		if err != nil {
+			t.Errorf("error reading %s: %s", file, err)
+			continue
+		}
+		contentsReader, err := gzip.NewReader(bytes.NewReader(contentsGz))
+		if err != nil {
+			t.Errorf("error reading %s: %s", file, err)
+			continue
+		}
+		contents, _ := ioutil.ReadAll(contentsReader)
+		if string(contents) != want {
+			t.Errorf("%s does not match, returned value is:\n %s \n\n should be:\n %s", file, contents, want)
+		}
+	}
+
+	// cleanup
+	if err := os.RemoveAll(config.RootRepoPath); err != nil {
+		t.Errorf("error cleaning up after createContents(): %s", err)
+	}
+}
@@ -0,0 +1,58 @@
+package main
+
+import (
+	"strings"
+)
+
+// controlField is a single field of a control stanza, in the order it appeared.
+type controlField struct {
+	Name  string
+	Value string
+}
+
+// parseControlFields parses a single control stanza into its fields, keeping their order.
+// Continuation lines are kept and joined to the field value with newlines, so a multi-line
+// field like Files has a value starting with a newline.
+func parseControlFields(stanza string) []controlField {
+	var fields []controlField
+	for _, line := range strings.Split(stanza, "\n") {
+		if line == "" {
+			continue
+		}
+		if line[0] == ' ' || line[0] == '\t' {
+			if len(fields) > 0 {
+				fields[len(fields)-1].Value += "\n" + line
+			}
+			continue
+		}
+		parts := strings.SplitN(line, ":", 2)
+		if len(parts) != 2 {
+			continue
+		}
+		fields = append(fields, controlField{Name: strings.TrimSpace(parts[0]), Value: strings.TrimSpace(parts[1])})
+	}
+	return fields
+}
+
+// parseControl parses a single control stanza, such as the one returned by inspectPackage, into
+// a map of its fields.
+func parseControl(stanza string) map[string]string {
+	fields := make(map[string]string)
+	for _, field := range parseControlFields(stanza) {
+		fields[field.Name] = field.Value
+	}
+	return fields
+}
+
+// formatControlFields turns fields back into a stanza, terminated by a newline.
+func formatControlFields(fields []controlField) string {
+	var sb strings.Builder
+	for _, field := range fields {
+		if strings.HasPrefix(field.Value, "\n") || field.Value == "" {
+			sb.WriteString(field.Name + ":" + field.Value + "\n")
+		} else {
+			sb.WriteString(field.Name + ": " + field.Value + "\n")
+		}
+	}
+	return sb.String()
+}
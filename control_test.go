@@ -0,0 +1,22 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestParseControl(t *testing.T) {
+	fields := parseControl(goodOutputLzma)
+	if fields["Package"] != "ifupdown2" {
+		t.Errorf("Package is %s, should be ifupdown2", fields["Package"])
+	}
+	if fields["Depends"] != "python3:any, iproute2" {
+		t.Errorf("Depends is %s, should be python3:any, iproute2", fields["Depends"])
+	}
+	if !strings.HasPrefix(fields["Description"], "Network Interface Management tool similar to ifupdown\n ifupdown2 is") {
+		t.Errorf("Description is %s", fields["Description"])
+	}
+	if len(fields) != 14 {
+		t.Errorf("parsed %d fields, should be 14", len(fields))
+	}
+}
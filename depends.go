@@ -0,0 +1,314 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"sort"
+	"strings"
+
+	"github.com/boltdb/bolt"
+)
+
+// dependency is a single package in a relation such as "libc6 (>= 2.34)".
+type dependency struct {
+	name     string
+	operator string
+	version  string
+}
+
+// parseRelations parses a relationship field such as Depends into its relations, each a list of
+// alternatives. Architecture qualifiers such as ":any" are dropped, as only packages of the arch
+// being checked are considered anyway.
+func parseRelations(field string) [][]dependency {
+	var relations [][]dependency
+	for _, relation := range strings.Split(field, ",") {
+		var alternatives []dependency
+		for _, alternative := range strings.Split(relation, "|") {
+			alternative = strings.TrimSpace(alternative)
+			if alternative == "" {
+				continue
+			}
+			var dep dependency
+			if i := strings.Index(alternative, "("); i != -1 {
+				constraint := strings.TrimSpace(strings.Trim(alternative[i:], "()"))
+				alternative = alternative[:i]
+				for _, op := range []string{"<<", "<=", ">=", ">>", "=", "<", ">"} {
+					if strings.HasPrefix(constraint, op) {
+						dep.operator = op
+						dep.version = strings.TrimSpace(constraint[len(op):])
+						break
+					}
+				}
+			}
+			name := strings.Fields(alternative)
+			if len(name) == 0 {
+				continue
+			}
+			dep.name = name[0]
+			if i := strings.Index(dep.name, ":"); i != -1 {
+				dep.name = dep.name[:i]
+			}
+			alternatives = append(alternatives, dep)
+		}
+		if len(alternatives) > 0 {
+			relations = append(relations, alternatives)
+		}
+	}
+	return relations
+}
+
+// satisfiedBy reports whether version meets the version constraint of the dependency.
+func (d dependency) satisfiedBy(version string) bool {
+	if d.operator == "" {
+		return true
+	}
+	cmp := compareVersions(version, d.version)
+	switch d.operator {
+	case "<<":
+		return cmp < 0
+	case "<=", "<":
+		return cmp <= 0
+	case "=":
+		return cmp == 0
+	case ">=", ">":
+		return cmp >= 0
+	case ">>":
+		return cmp > 0
+	}
+	return false
+}
+
+// String formats the dependency the way it is written in a control file.
+func (d dependency) String() string {
+	if d.operator == "" {
+		return d.name
+	}
+	return fmt.Sprintf("%s (%s %s)", d.name, d.operator, d.version)
+}
+
+// packageUniverse holds every version of every package, real or provided, that can be installed.
+type packageUniverse struct {
+	// versions holds the versions of each real package
+	versions map[string][]string
+	// provided holds the versions virtual packages are provided with, an empty version for an
+	// unversioned Provides
+	provided map[string][]string
+}
+
+func newPackageUniverse() *packageUniverse {
+	return &packageUniverse{versions: make(map[string][]string), provided: make(map[string][]string)}
+}
+
+// add makes the package described by a control stanza available.
+func (u *packageUniverse) add(fields map[string]string) {
+	u.versions[fields["Package"]] = append(u.versions[fields["Package"]], fields["Version"])
+	for _, provides := range parseRelations(fields["Provides"]) {
+		for _, provide := range provides {
+			u.provided[provide.name] = append(u.provided[provide.name], provide.version)
+		}
+	}
+}
+
+// satisfies reports whether any package in the universe satisfies the dependency. As in dpkg, an
+// unversioned Provides only satisfies dependencies without a version constraint.
+func (u *packageUniverse) satisfies(dep dependency) bool {
+	for _, version := range u.versions[dep.name] {
+		if dep.satisfiedBy(version) {
+			return true
+		}
+	}
+	for _, version := range u.provided[dep.name] {
+		if dep.operator == "" || (version != "" && dep.satisfiedBy(version)) {
+			return true
+		}
+	}
+	return false
+}
+
+// unsatisfiedDependency is a relation of a package in the repo that no available package satisfies.
+type unsatisfiedDependency struct {
+	Distro   string `json:"distro"`
+	Section  string `json:"section"`
+	Arch     string `json:"arch"`
+	Package  string `json:"package"`
+	Version  string `json:"version"`
+	Field    string `json:"field"`
+	Relation string `json:"relation"`
+}
+
+func (u unsatisfiedDependency) String() string {
+	return fmt.Sprintf("%s %s %s: %s %s %s: %s", u.Distro, u.Section, u.Arch, u.Package, u.Version, u.Field, u.Relation)
+}
+
+// readPackagesFile reads the stanzas of a Packages file, which may be compressed, as its extension
+// tells.
+func readPackagesFile(path string) ([]map[string]string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("error opening %s: %s", path, err)
+	}
+	defer f.Close()
+	compression, err := compressionFromName(path)
+	if err != nil {
+		compression = NONE
+	}
+	r, err := decompressReader(compression, f)
+	if err != nil {
+		return nil, fmt.Errorf("error creating %s reader for %s: %s", compression, path, err)
+	}
+	defer r.Close()
+
+	var stanzas []map[string]string
+	var stanza strings.Builder
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 64*1024), 16*1024*1024)
+	for scanner.Scan() {
+		if strings.TrimSpace(scanner.Text()) != "" {
+			stanza.WriteString(scanner.Text() + "\n")
+			continue
+		}
+		if stanza.Len() > 0 {
+			stanzas = append(stanzas, parseControl(stanza.String()))
+			stanza.Reset()
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("error reading %s: %s", path, err)
+	}
+	if stanza.Len() > 0 {
+		stanzas = append(stanzas, parseControl(stanza.String()))
+	}
+	return stanzas, nil
+}
+
+// checkDependencies evaluates the Depends and Pre-Depends of every package in the given distros and
+// arches, or every configured one when none are given, against the packages of the same distro and arch,
+// the arch independent packages of the distro, and the packages of the base Packages files.
+func checkDependencies(config conf, db *bolt.DB, distros, arches []string) ([]unsatisfiedDependency, error) {
+	if len(distros) == 0 {
+		distros = config.DistroNames
+	}
+	if len(arches) == 0 {
+		for _, arch := range config.SupportArch {
+			// arch independent packages are checked along with each arch they can be installed on
+			if arch != "all" || len(config.SupportArch) == 1 {
+				arches = append(arches, arch)
+			}
+		}
+	}
+
+	var base []map[string]string
+	for _, path := range config.BasePackages {
+		stanzas, err := readPackagesFile(path)
+		if err != nil {
+			return nil, err
+		}
+		base = append(base, stanzas...)
+	}
+
+	var report []unsatisfiedDependency
+	for _, distro := range distros {
+		for _, arch := range arches {
+			type repoPackage struct {
+				section string
+				fields  map[string]string
+			}
+			var packages []repoPackage
+			universe := newPackageUniverse()
+			for _, fields := range base {
+				if fields["Architecture"] == arch || fields["Architecture"] == "all" {
+					universe.add(fields)
+				}
+			}
+			for _, section := range config.Sections {
+				dirArchs := []string{arch}
+				if arch != "all" {
+					dirArchs = append(dirArchs, "all")
+				}
+				for _, dirArch := range dirArchs {
+					if _, err := os.Stat(config.ArchPath(distro, section, dirArch)); os.IsNotExist(err) {
+						continue
+					}
+					entries, err := readArchEntries(config, db, distro, section, dirArch)
+					if err != nil {
+						return nil, err
+					}
+					for _, entry := range entries {
+						fields := parseControl(entry.Control)
+						universe.add(fields)
+						packages = append(packages, repoPackage{section: section, fields: fields})
+					}
+				}
+			}
+
+			for _, pkg := range packages {
+				for _, field := range []string{"Pre-Depends", "Depends"} {
+					for _, alternatives := range parseRelations(pkg.fields[field]) {
+						satisfied := false
+						var relation []string
+						for _, dep := range alternatives {
+							satisfied = satisfied || universe.satisfies(dep)
+							relation = append(relation, dep.String())
+						}
+						if !satisfied {
+							report = append(report, unsatisfiedDependency{
+								Distro:   distro,
+								Section:  pkg.section,
+								Arch:     arch,
+								Package:  pkg.fields["Package"],
+								Version:  pkg.fields["Version"],
+								Field:    field,
+								Relation: strings.Join(relation, " | "),
+							})
+						}
+					}
+				}
+			}
+		}
+	}
+	sort.SliceStable(report, func(i, j int) bool {
+		return report[i].String() < report[j].String()
+	})
+	return report, nil
+}
+
+// dependenciesHandler reports the unsatisfiable dependencies of the repo as JSON, optionally limited
+// to a distro and arch.
+func dependenciesHandler(config conf, db *bolt.DB) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		log.Printf("%s %s %s\n", r.RemoteAddr, r.Method, r.URL)
+		if r.Method != "GET" {
+			http.Error(w, "method not supported", http.StatusMethodNotAllowed)
+			return
+		}
+		var distros, arches []string
+		if distro := r.URL.Query().Get("distro"); distro != "" {
+			if !contains(config.DistroNames, distro) {
+				http.Error(w, "unknown distro", http.StatusBadRequest)
+				return
+			}
+			distros = []string{distro}
+		}
+		if arch := r.URL.Query().Get("arch"); arch != "" {
+			if !contains(config.SupportArch, arch) {
+				http.Error(w, "unknown arch", http.StatusBadRequest)
+				return
+			}
+			arches = []string{arch}
+		}
+		report, err := checkDependencies(config, db, distros, arches)
+		if err != nil {
+			httpErrorf(w, "error checking dependencies: %s", err)
+			return
+		}
+		if report == nil {
+			report = []unsatisfiedDependency{}
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(report)
+	})
+}
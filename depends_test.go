@@ -0,0 +1,92 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestParseRelations(t *testing.T) {
+	relations := parseRelations("libc6 (>= 2.34), libfoo:any (<< 2~) | libbar,\n python3:any, default-mta | mail-transport-agent")
+	var got []string
+	for _, alternatives := range relations {
+		var relation []string
+		for _, dep := range alternatives {
+			relation = append(relation, dep.String())
+		}
+		got = append(got, strings.Join(relation, " | "))
+	}
+	want := []string{"libc6 (>= 2.34)", "libfoo (<< 2~) | libbar", "python3", "default-mta | mail-transport-agent"}
+	if strings.Join(got, ", ") != strings.Join(want, ", ") {
+		t.Errorf("parseRelations() returned %v, should be %v", got, want)
+	}
+}
+
+func TestCheckDependencies(t *testing.T) {
+	pwd, err := os.Getwd()
+	if err != nil {
+		t.Errorf("Unable to get current working directory: %s", err)
+	}
+	config := conf{RootRepoPath: pwd + "/testing", SupportArch: []string{"all", "amd64"}, DistroNames: []string{"stable"}, Sections: []string{"main"},
+		BasePackages: []string{pwd + "/testing/base-Packages"}}
+	if err := createDirs(config); err != nil {
+		t.Errorf("createDirs() failed: %s", err)
+	}
+	base := "Package: base-files\nVersion: 12\nArchitecture: amd64\n\nPackage: libc6\nVersion: 2.36-9\nArchitecture: amd64\n"
+	if err := ioutil.WriteFile(config.BasePackages[0], []byte(base), 0644); err != nil {
+		t.Fatalf("error writing base Packages file: %s", err)
+	}
+	for name, control := range map[string]string{
+		"app_1.0_amd64.deb":     "Package: app\nVersion: 1.0\nArchitecture: amd64\nPre-Depends: libc6 (>= 2.34)\nDepends: libfoo (>= 2) | libbar, mail-transport-agent,\n base-files (>= 10), virtual (>= 1), missing\n",
+		"libfoo_1.0_amd64.deb":  "Package: libfoo\nVersion: 1.0\nArchitecture: amd64\n",
+		"postfix_3.7_amd64.deb": "Package: postfix\nVersion: 3.7\nArchitecture: amd64\nProvides: mail-transport-agent, virtual\n",
+	} {
+		writeTestDeb(t, filepath.Join(config.ArchPath("stable", "main", "amd64"), name), control)
+	}
+	writeTestDeb(t, filepath.Join(config.ArchPath("stable", "main", "all"), "tool_1.0_all.deb"), "Package: tool\nVersion: 1.0\nArchitecture: all\nDepends: app (= 1.0), libc6 (>> 3)\n")
+
+	report, err := checkDependencies(config, nil, nil, nil)
+	if err != nil {
+		t.Errorf("checkDependencies() failed: %s", err)
+	}
+	var got []string
+	for _, unsatisfied := range report {
+		got = append(got, unsatisfied.String())
+	}
+	want := []string{
+		"stable main amd64: app 1.0 Depends: libfoo (>= 2) | libbar",
+		"stable main amd64: app 1.0 Depends: missing",
+		"stable main amd64: app 1.0 Depends: virtual (>= 1)",
+		"stable main amd64: tool 1.0 Depends: libc6 (>> 3)",
+	}
+	if strings.Join(got, "\n") != strings.Join(want, "\n") {
+		t.Errorf("checkDependencies() returned\n%s\nshould be\n%s", strings.Join(got, "\n"), strings.Join(want, "\n"))
+	}
+
+	// the same report over HTTP
+	req, _ := http.NewRequest("GET", "/dependencies?distro=stable&arch=amd64", nil)
+	w := httptest.NewRecorder()
+	dependenciesHandler(config, nil).ServeHTTP(w, req)
+	var served []unsatisfiedDependency
+	if err := json.NewDecoder(w.Body).Decode(&served); err != nil {
+		t.Errorf("error decoding dependency report: %s", err)
+	}
+	if len(served) != len(want) || served[0].Package != "app" || served[0].Field != "Depends" {
+		t.Errorf("dependenciesHandler returned %v", served)
+	}
+	req, _ = http.NewRequest("GET", "/dependencies?distro=unstable", nil)
+	w = httptest.NewRecorder()
+	dependenciesHandler(config, nil).ServeHTTP(w, req)
+	if w.Code != http.StatusBadRequest {
+		t.Errorf("dependenciesHandler GET of an unknown distro returned %v, should be %v", w.Code, http.StatusBadRequest)
+	}
+
+	if err := os.RemoveAll(config.RootRepoPath); err != nil {
+		t.Errorf("error cleaning up after checkDependencies(): %s", err)
+	}
+}
@@ -0,0 +1,128 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/boltdb/bolt"
+)
+
+// readArchEntries returns the control data of every package in an arch directory, keyed by file name.
+// Entries come from the package cache when it is enabled and still current; packages that have to be
+// inspected get an entry without checksums, as hashing every package would be too slow for a lookup.
+func readArchEntries(config conf, db *bolt.DB, distro, section, arch string) (map[string]packageCacheEntry, error) {
+	archPath := config.ArchPath(distro, section, arch)
+	cachePrefix := packageCacheKey(config, archPath) + "/"
+	cached := map[string]packageCacheEntry{}
+	if config.EnablePackageCache && db != nil {
+		var err error
+		if cached, err = readPackageCache(db, cachePrefix); err != nil {
+			return nil, err
+		}
+	}
+
+	dirList, err := ioutil.ReadDir(archPath)
+	if err != nil {
+		return nil, fmt.Errorf("scanning: %s: %s", archPath, err)
+	}
+	entries := make(map[string]packageCacheEntry)
+	for _, dirEntry := range dirList {
+		if !strings.HasSuffix(dirEntry.Name(), ".deb") {
+			continue
+		}
+		debPath, _, err := resolvePackage(config, filepath.Join(archPath, dirEntry.Name()))
+		if err != nil {
+			return nil, fmt.Errorf("error resolving %s: %s", dirEntry.Name(), err)
+		}
+		info, err := os.Stat(debPath)
+		if err != nil {
+			return nil, fmt.Errorf("error reading %s: %s", dirEntry.Name(), err)
+		}
+		entry, ok := cached[cachePrefix+dirEntry.Name()]
+		if !ok || !entry.matches(info) {
+			entry = newPackageCacheEntry(info)
+			if entry.Control, err = inspectPackage(debPath); err != nil {
+				return nil, err
+			}
+		}
+		entries[dirEntry.Name()] = entry
+	}
+	return entries, nil
+}
+
+// packageKey identifies a package by the fields apt tells packages apart with: name, version and
+// architecture.
+func packageKey(control string) string {
+	fields := parseControl(control)
+	return fields["Package"] + " " + fields["Version"] + " " + fields["Architecture"]
+}
+
+// checkDuplicate compares an uploaded package, with the given control file, against the packages already
+// in the arch directory it is uploaded to. It reports whether an identical package is already there, in
+// which case the upload has nothing left to do. A different package with the same name, version and
+// architecture, or under the same file name, is a conflict; with force set the existing package is
+// removed to make way for the upload.
+func checkDuplicate(config conf, db *bolt.DB, distro, section, arch, uploadPath, name, control string, force bool) (bool, error) {
+	duplicate, conflicts, err := findConflicts(config, db, distro, section, arch, uploadPath, name, control, force)
+	if err != nil || duplicate {
+		return duplicate, err
+	}
+	for _, filename := range conflicts {
+		if err := removePackage(config, distro, section, arch, filename); err != nil {
+			return false, fmt.Errorf("error replacing %s: %s", filename, err)
+		}
+		if *verbose {
+			log.Printf("%s has been replaced by %s in %s %s %s", filename, name, distro, section, arch)
+		}
+	}
+	return false, nil
+}
+
+// findConflicts does the checks of checkDuplicate without changing anything. Along with whether an
+// identical package is already there, it returns the packages a forced upload replaces.
+func findConflicts(config conf, db *bolt.DB, distro, section, arch, uploadPath, name, control string, force bool) (bool, []string, error) {
+	key := packageKey(control)
+	uploaded, err := hashFile(uploadPath)
+	if err != nil {
+		return false, nil, fmt.Errorf("error hashing %s: %s", name, err)
+	}
+
+	entries, err := readArchEntries(config, db, distro, section, arch)
+	if err != nil {
+		return false, nil, err
+	}
+	var conflicts []string
+	for filename, entry := range entries {
+		if filename != name && packageKey(entry.Control) != key {
+			continue
+		}
+		if entry.SHA256 == "" {
+			debPath, _, err := resolvePackage(config, filepath.Join(config.ArchPath(distro, section, arch), filename))
+			if err != nil {
+				return false, nil, fmt.Errorf("error resolving %s: %s", filename, err)
+			}
+			existing, err := hashFile(debPath)
+			if err != nil {
+				return false, nil, fmt.Errorf("error hashing %s: %s", filename, err)
+			}
+			entry.SHA256 = existing.SHA256
+		}
+		if entry.SHA256 == uploaded.SHA256 {
+			if *verbose {
+				log.Printf("%s is identical to %s, which is already in %s %s %s", name, filename, distro, section, arch)
+			}
+			return true, nil, nil
+		}
+		conflicts = append(conflicts, filename)
+	}
+
+	if len(conflicts) > 0 && !force {
+		return false, nil, uploadErrorf(http.StatusConflict, "%s conflicts with %s in %s %s %s, upload with force=true to replace it", name, strings.Join(conflicts, ", "), distro, section, arch)
+	}
+	return false, conflicts, nil
+}
@@ -0,0 +1,104 @@
+package main
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/boltdb/bolt"
+)
+
+func TestUploadHandlerDuplicates(t *testing.T) {
+	pwd, err := os.Getwd()
+	if err != nil {
+		t.Errorf("Unable to get current working directory: %s", err)
+	}
+	config := conf{ListenPort: "9666", RootRepoPath: pwd + "/testing", SupportArch: []string{"all"}, DistroNames: []string{"stable"}, Sections: []string{"main"}, EnableDirectoryWatching: false}
+	if err := createDirs(config); err != nil {
+		t.Errorf("createDirs() failed: %s", err)
+	}
+
+	// create temp db
+	db, err := bolt.Open(tempfile(), 0666, nil)
+	if err != nil {
+		t.Fatalf("error creating tempdb: %s", err)
+	}
+	defer db.Close()
+	uploadHandle := uploadHandler(config, db)
+	upload := func(query string, files ...string) int {
+		body, contentType := multipartBody(t, files...)
+		req, _ := http.NewRequest("POST", "/upload?"+query, body)
+		req.Header.Add("Content-Type", contentType)
+		w := httptest.NewRecorder()
+		uploadHandle.ServeHTTP(w, req)
+		return w.Code
+	}
+	archPath := config.ArchPath("stable", "main", "all")
+	listArch := func() []string {
+		var names []string
+		files, _ := ioutil.ReadDir(archPath)
+		for _, file := range files {
+			if filepath.Ext(file.Name()) == ".deb" {
+				names = append(names, file.Name())
+			}
+		}
+		return names
+	}
+
+	// an identical re-upload, under the same or another name, changes nothing
+	for _, file := range []string{"samples/hello-zst_1.0-1_all.deb", "samples/hello-zst_1.0-1_all.deb", "hello.deb=samples/hello-zst_1.0-1_all.deb"} {
+		if code := upload("", file); code != http.StatusOK {
+			t.Errorf("uploadHandler POST of %s returned %v, should be %v", file, code, http.StatusOK)
+		}
+	}
+	if names := listArch(); len(names) != 1 || names[0] != "hello-zst_1.0-1_all.deb" {
+		t.Errorf("arch directory should only hold hello-zst_1.0-1_all.deb, holds %v", names)
+	}
+
+	// a different package with the same name, version and architecture is a conflict
+	rebuilt := filepath.Join(config.RootRepoPath, "hello-zst.deb")
+	writeTestDeb(t, rebuilt, "Package: hello-zst\nVersion: 1.0-1\nArchitecture: all\nDescription: rebuilt\n")
+	if code := upload("", "hello-zst_1.0-1_rebuilt_all.deb="+rebuilt); code != http.StatusConflict {
+		t.Errorf("uploadHandler POST returned %v, should be %v", code, http.StatusConflict)
+	}
+	// and so is different content under an existing file name
+	if code := upload("", "hello-zst_1.0-1_all.deb="+rebuilt); code != http.StatusConflict {
+		t.Errorf("uploadHandler POST returned %v, should be %v", code, http.StatusConflict)
+	}
+	if names := listArch(); len(names) != 1 || names[0] != "hello-zst_1.0-1_all.deb" {
+		t.Errorf("arch directory should only hold hello-zst_1.0-1_all.deb, holds %v", names)
+	}
+
+	// force replaces the existing package
+	if code := upload("force=true", "hello-zst_1.0-1_rebuilt_all.deb="+rebuilt); code != http.StatusOK {
+		t.Errorf("uploadHandler POST returned %v, should be %v", code, http.StatusOK)
+	}
+	if names := listArch(); len(names) != 1 || names[0] != "hello-zst_1.0-1_rebuilt_all.deb" {
+		t.Errorf("arch directory should only hold hello-zst_1.0-1_rebuilt_all.deb, holds %v", names)
+	}
+
+	// not a package at all
+	if code := upload("", "broken.deb=samples/control.tar.gz"); code != http.StatusBadRequest {
+		t.Errorf("uploadHandler POST returned %v, should be %v", code, http.StatusBadRequest)
+	}
+
+	// of two different packages with the same name uploaded at once, only one gets in
+	other := filepath.Join(config.RootRepoPath, "hello-race.deb")
+	writeTestDeb(t, rebuilt, "Package: hello-race\nVersion: 1.0-1\nArchitecture: all\nDescription: one\n")
+	writeTestDeb(t, other, "Package: hello-race\nVersion: 1.0-1\nArchitecture: all\nDescription: other\n")
+	codes := make(chan int, 2)
+	for _, file := range []string{"hello-race_1.0-1_all.deb=" + rebuilt, "hello-race_1.0-1_all.deb=" + other} {
+		go func(file string) { codes <- upload("", file) }(file)
+	}
+	if first, second := <-codes, <-codes; first+second != http.StatusOK+http.StatusConflict {
+		t.Errorf("concurrent uploadHandler POSTs returned %v and %v, should be %v and %v", first, second, http.StatusOK, http.StatusConflict)
+	}
+
+	// cleanup
+	if err := os.RemoveAll(config.RootRepoPath); err != nil {
+		t.Errorf("error cleaning up after uploadHandler(): %s", err)
+	}
+}
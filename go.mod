@@ -5,8 +5,10 @@ go 1.18
 require (
 	github.com/blakesmith/ar v0.0.0-20150311145944-8bd4349a67f2
 	github.com/boltdb/bolt v1.3.1
+	github.com/dsnet/compress v0.0.1
 	github.com/fsnotify/fsnotify v1.4.2
-	github.com/xi2/xz v0.0.0-20171230120015-48954b6210f8
+	github.com/klauspost/compress v1.16.7
+	github.com/ulikunitz/xz v0.5.15
 	golang.org/x/crypto v0.1.0
 )
 
@@ -0,0 +1,149 @@
+package main
+
+import (
+	"crypto/md5"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/hex"
+	"fmt"
+	"hash"
+	"io"
+	"os"
+)
+
+// checksumType is a checksum deb-simple can list for a file, along with the fields it is listed
+// under in the different kinds of index files.
+type checksumType struct {
+	// name is how the checksum is named in the config file
+	name     string
+	new      func() hash.Hash
+	packages string
+	release  string
+	sources  string
+}
+
+// checksumTypes holds every supported checksum, in the order they are listed in index files.
+var checksumTypes = []checksumType{
+	{name: "md5", new: md5.New, packages: "MD5sum", release: "MD5Sum", sources: "Files"},
+	{name: "sha1", new: sha1.New, packages: "SHA1", release: "SHA1", sources: "Checksums-Sha1"},
+	{name: "sha256", new: sha256.New, packages: "SHA256", release: "SHA256", sources: "Checksums-Sha256"},
+	{name: "sha512", new: sha512.New, packages: "SHA512", release: "SHA512", sources: "Checksums-Sha512"},
+}
+
+// Checksums returns the checksums listed in the Packages, Sources and Release files, defaulting to
+// md5, sha1 and sha256. sha256 is always included, as apt refuses repositories without it, and
+// deb-simple relies on it to tell packages apart.
+func (c conf) Checksums() []checksumType {
+	names := c.Hashes
+	if len(names) == 0 {
+		names = []string{"md5", "sha1", "sha256"}
+	}
+	var checksums []checksumType
+	for _, checksum := range checksumTypes {
+		for _, name := range names {
+			if name == checksum.name || checksum.name == "sha256" {
+				checksums = append(checksums, checksum)
+				break
+			}
+		}
+	}
+	return checksums
+}
+
+// validateHashes checks that every configured checksum is supported.
+func (c conf) validateHashes() error {
+	for _, name := range c.Hashes {
+		supported := false
+		for _, checksum := range checksumTypes {
+			supported = supported || checksum.name == name
+		}
+		if !supported {
+			return fmt.Errorf("unsupported hash %s, supported are md5, sha1, sha256 and sha512", name)
+		}
+	}
+	return nil
+}
+
+// fileHashes holds the size and checksums of a file, as listed in Packages, Sources and Release files.
+type fileHashes struct {
+	Size   int64
+	MD5    string
+	SHA1   string
+	SHA256 string
+	SHA512 string
+}
+
+// get returns the checksum of the given type, or an empty string when it hasn't been computed.
+func (h fileHashes) get(name string) string {
+	switch name {
+	case "md5":
+		return h.MD5
+	case "sha1":
+		return h.SHA1
+	case "sha256":
+		return h.SHA256
+	case "sha512":
+		return h.SHA512
+	}
+	return ""
+}
+
+func (h *fileHashes) set(name, sum string) {
+	switch name {
+	case "md5":
+		h.MD5 = sum
+	case "sha1":
+		h.SHA1 = sum
+	case "sha256":
+		h.SHA256 = sum
+	case "sha512":
+		h.SHA512 = sum
+	}
+}
+
+// hashReader computes the given checksums of everything read from r in a single pass, or every
+// supported checksum when none are given.
+func hashReader(r io.Reader, checksums ...checksumType) (fileHashes, error) {
+	var hashes fileHashes
+	if len(checksums) == 0 {
+		checksums = checksumTypes
+	}
+	hashers := make([]hash.Hash, len(checksums))
+	writers := make([]io.Writer, len(checksums))
+	for i, checksum := range checksums {
+		hashers[i] = checksum.new()
+		writers[i] = hashers[i]
+	}
+	size, err := io.Copy(io.MultiWriter(writers...), r)
+	if err != nil {
+		return hashes, err
+	}
+	hashes.Size = size
+	for i, checksum := range checksums {
+		hashes.set(checksum.name, hex.EncodeToString(hashers[i].Sum(nil)))
+	}
+	return hashes, nil
+}
+
+// hashFile computes the given checksums of the file at path in a single pass, or every supported
+// checksum when none are given.
+func hashFile(path string, checksums ...checksumType) (fileHashes, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return fileHashes{}, err
+	}
+	defer f.Close()
+	return hashReader(f, checksums...)
+}
+
+// sourcesChecksum returns the checksum listed by a Files or Checksums-* field of a .dsc, .changes or
+// Sources file.
+func sourcesChecksum(field string) (checksumType, bool) {
+	for _, checksum := range checksumTypes {
+		if checksum.sources == field {
+			return checksum, true
+		}
+	}
+	return checksumType{}, false
+}
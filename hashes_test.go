@@ -0,0 +1,108 @@
+package main
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/boltdb/bolt"
+)
+
+func TestChecksums(t *testing.T) {
+	names := func(checksums []checksumType) string {
+		var names []string
+		for _, checksum := range checksums {
+			names = append(names, checksum.name)
+		}
+		return strings.Join(names, " ")
+	}
+	tests := []struct {
+		hashes []string
+		want   string
+	}{
+		{nil, "md5 sha1 sha256"},
+		{[]string{"sha512", "sha256"}, "sha256 sha512"},
+		// sha256 is always listed
+		{[]string{"sha512"}, "sha256 sha512"},
+	}
+	for _, test := range tests {
+		if got := names(conf{Hashes: test.hashes}.Checksums()); got != test.want {
+			t.Errorf("Checksums() for %v returned %s, should be %s", test.hashes, got, test.want)
+		}
+	}
+	if err := (conf{Hashes: []string{"sha256", "crc32"}}).validateHashes(); err == nil {
+		t.Errorf("validateHashes() should reject an unsupported hash")
+	}
+}
+
+func TestConfiguredChecksums(t *testing.T) {
+	pwd, err := os.Getwd()
+	if err != nil {
+		t.Errorf("Unable to get current working directory: %s", err)
+	}
+	config := conf{ListenPort: "9666", RootRepoPath: pwd + "/testing", SupportArch: []string{"all"}, DistroNames: []string{"stable"}, Sections: []string{"main"},
+		EnableSigning: true, PrivateKey: pwd + "/testing/private.key", Hashes: []string{"sha256", "sha512"}}
+	if err := createDirs(config); err != nil {
+		t.Errorf("createDirs() failed: %s", err)
+	}
+	createKeyHandler(pwd+"/testing", "deb-simple test", "blah@blah.com")
+	db, err := bolt.Open(tempfile(), 0666, nil)
+	if err != nil {
+		t.Fatalf("error creating tempdb: %s", err)
+	}
+	defer db.Close()
+	uploadHandle := uploadHandler(config, db)
+	upload := func(files ...string) {
+		body, contentType := multipartBody(t, files...)
+		req, _ := http.NewRequest("POST", "/upload?distro=stable&section=main", body)
+		req.Header.Add("Content-Type", contentType)
+		w := httptest.NewRecorder()
+		uploadHandle.ServeHTTP(w, req)
+		if w.Code != http.StatusOK {
+			t.Fatalf("uploadHandler POST returned %v: %s", w.Code, w.Body)
+		}
+	}
+	upload("samples/hello-zst_1.0-1_all.deb")
+	upload("samples/hello-src_1.0-1.dsc", "samples/hello-src_1.0.orig.tar.gz", "samples/hello-src_1.0-1.debian.tar.xz")
+
+	debHashes, _ := hashFile("samples/hello-zst_1.0-1_all.deb")
+	tarHashes, _ := hashFile("samples/hello-src_1.0.orig.tar.gz")
+	tests := []struct {
+		path    string
+		want    []string
+		notWant []string
+	}{
+		{filepath.Join(config.ArchPath("stable", "main", "all"), "Packages"),
+			[]string{"SHA256: " + debHashes.SHA256 + "\n", "SHA512: " + debHashes.SHA512 + "\n"}, []string{"MD5sum:", "SHA1:"}},
+		{filepath.Join(config.SourcePath("stable", "main"), "Sources"),
+			[]string{"Checksums-Sha512:\n", " " + tarHashes.SHA512 + " ", "Checksums-Sha256:\n"}, []string{"Files:", "Checksums-Sha1:"}},
+		{filepath.Join(config.RootRepoPath, "dists", "stable", "Release"),
+			[]string{"SHA256:\n", "SHA512:\n"}, []string{"MD5Sum:", "SHA1:"}},
+	}
+	for _, test := range tests {
+		index, err := ioutil.ReadFile(test.path)
+		if err != nil {
+			t.Errorf("error reading %s: %s", test.path, err)
+			continue
+		}
+		for _, want := range test.want {
+			if !strings.Contains(string(index), want) {
+				t.Errorf("%s should contain %q:\n%s", filepath.Base(test.path), want, index)
+			}
+		}
+		for _, notWant := range test.notWant {
+			if strings.Contains(string(index), notWant) {
+				t.Errorf("%s should not contain %q:\n%s", filepath.Base(test.path), notWant, index)
+			}
+		}
+	}
+
+	// cleanup
+	if err := os.RemoveAll(config.RootRepoPath); err != nil {
+		t.Errorf("error cleaning up after configured checksums: %s", err)
+	}
+}
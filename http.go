@@ -6,12 +6,31 @@ import (
 	"fmt"
 	"github.com/boltdb/bolt"
 	"io"
+	"io/ioutil"
 	"log"
+	"mime/multipart"
 	"net/http"
 	"os"
 	"path/filepath"
+	"strconv"
+	"strings"
 )
 
+// uploadError is returned when an upload is rejected because of what was uploaded, rather than
+// because something went wrong on the server. It carries the HTTP status to reply with.
+type uploadError struct {
+	status int
+	msg    string
+}
+
+func (e uploadError) Error() string {
+	return e.msg
+}
+
+func uploadErrorf(status int, format string, a ...interface{}) error {
+	return uploadError{status: status, msg: fmt.Sprintf(format, a...)}
+}
+
 type deleteObj struct {
 	Filename   string
 	DistroName string
@@ -37,10 +56,8 @@ func uploadHandler(config conf, db *bolt.DB) http.Handler {
 				return
 			}
 		}
+		// without an arch, packages are routed by their own Architecture field
 		archType := r.URL.Query().Get("arch")
-		if archType == "" {
-			archType = "all"
-		}
 		distroName := r.URL.Query().Get("distro")
 		if distroName == "" {
 			distroName = "stable"
@@ -49,44 +66,103 @@ func uploadHandler(config conf, db *bolt.DB) http.Handler {
 		if section == "" {
 			section = "main"
 		}
+		// force replaces an existing package with the same name, version and architecture
+		force, _ := strconv.ParseBool(r.URL.Query().Get("force"))
 		reader, err := r.MultipartReader()
 		if err != nil {
 			httpErrorf(w, "error creating multipart reader: %s", err)
 			return
 		}
+		// detached signatures of packages and .dsc files, keyed by the name of the file they sign
+		signatures := make(map[string][]byte)
+		// source packages are made of several files, which are staged until they can be verified together
+		var stagingDir string
+		defer func() {
+			if stagingDir != "" {
+				os.RemoveAll(stagingDir)
+			}
+		}()
 		for {
 			part, err := reader.NextPart()
 			if err == io.EOF {
 				break
 			}
+			if err != nil {
+				httpErrorf(w, "error reading multipart body: %s", err)
+				return
+			}
 			if part.FileName() == "" {
 				continue
 			}
 
-			path := filepath.Join(config.ArchPath(distroName, section, archType), part.FileName())
-			dst, err := os.Create(path)
+			if target, ok := signatureTarget(part.FileName()); ok {
+				signature, err := ioutil.ReadAll(io.LimitReader(part, 1<<20))
+				if err != nil {
+					httpErrorf(w, "error reading signature: %s", err)
+					return
+				}
+				signatures[target] = signature
+				continue
+			}
 
-			if *verbose {
-				log.Printf("Deb package %s has been uploaded to %s %s %s", part.FileName(), distroName, section, archType)
+			if isSourceFile(part.FileName()) {
+				if stagingDir == "" {
+					stagingDir, err = createStagingDir(config)
+					if err != nil {
+						httpErrorf(w, "error creating staging directory: %s", err)
+						return
+					}
+				}
+				dst, err := os.Create(filepath.Join(stagingDir, part.FileName()))
+				if err != nil {
+					httpErrorf(w, "error creating source file: %s", err)
+					return
+				}
+				_, err = io.Copy(dst, part)
+				dst.Close()
+				if err != nil {
+					httpErrorf(w, "error writing source file: %s", err)
+					return
+				}
+				continue
 			}
 
-			if err != nil {
-				httpErrorf(w, "error creating deb file: %s", err)
+			if err := storeUpload(config, db, distroName, section, archType, part, signatures[part.FileName()], force); err != nil {
+				uploadFailed(w, err)
 				return
 			}
-			if _, err := io.Copy(dst, part); err != nil {
-				httpErrorf(w, "error writing deb file: %s", err)
-				return
+		}
+		if stagingDir != "" {
+			if config.RequireSignedUploads {
+				if err := verifySourceSignatures(config, distroName, stagingDir, signatures); err != nil {
+					uploadFailed(w, err)
+					return
+				}
 			}
-
-			dst.Close()
-			if !parsedconfig.EnableDirectoryWatching {
-				rebuildRepoMetadata(path)
-				if *verbose {
-					log.Printf("Repository %s %s %s has been rebuilt", distroName, section, archType)
+			dscs, _ := filepath.Glob(filepath.Join(stagingDir, "*.dsc"))
+			for i := range dscs {
+				dscs[i] = filepath.Base(dscs[i])
+			}
+			mutex.Lock()
+			err := publishSourceUpload(config, distroName, section, stagingDir)
+			if err == nil {
+				removed, retentionErr := applySourceRetention(config, distroName, section)
+				if retentionErr != nil {
+					log.Printf("error applying retention policy: %s", retentionErr)
 				}
+				if !parsedconfig.EnableDirectoryWatching {
+					rebuildRepoMetadata(config, db, filepath.Join(config.SourcePath(distroName, section), "Sources"))
+					if *verbose {
+						log.Printf("Repository %s %s source has been rebuilt", distroName, section)
+					}
+				}
+				err = prunedUpload(removed, dscs, distroName, section)
+			}
+			mutex.Unlock()
+			if err != nil {
+				uploadFailed(w, err)
+				return
 			}
-
 		}
 		w.WriteHeader(http.StatusOK)
 	})
@@ -115,11 +191,28 @@ func deleteHandler(config conf, db *bolt.DB) http.Handler {
 			httpErrorf(w, "failed to decode json: %s", err)
 			return
 		}
-		debPath := filepath.Join(config.ArchPath(toDelete.DistroName, toDelete.Section, toDelete.Arch), toDelete.Filename)
-		if err := os.Remove(debPath); err != nil {
+		mutex.Lock()
+		defer mutex.Unlock()
+		if toDelete.Arch == "source" {
+			if err := removeSourcePackage(config, toDelete.DistroName, toDelete.Section, toDelete.Filename); err != nil {
+				httpErrorf(w, "failed to delete: %s", err)
+				return
+			}
+			if !parsedconfig.EnableDirectoryWatching {
+				rebuildRepoMetadata(config, db, filepath.Join(config.SourcePath(toDelete.DistroName, toDelete.Section), "Sources"))
+			}
+			if *verbose {
+				log.Printf("Source package %s has been deleted", toDelete.Filename)
+			}
+			return
+		}
+		if err := removePackage(config, toDelete.DistroName, toDelete.Section, toDelete.Arch, toDelete.Filename); err != nil {
 			httpErrorf(w, "failed to delete: %s", err)
 			return
 		}
+		if !parsedconfig.EnableDirectoryWatching {
+			rebuildRepoMetadata(config, db, filepath.Join(config.ArchPath(toDelete.DistroName, toDelete.Section, toDelete.Arch), toDelete.Filename))
+		}
 
 		if *verbose {
 			log.Printf("Deb package %s has been deleted", toDelete.Filename)
@@ -127,6 +220,133 @@ func deleteHandler(config conf, db *bolt.DB) http.Handler {
 	})
 }
 
+// storeUpload stages an uploaded package, works out which arch directory it belongs in, checks it against
+// the packages already there, and then moves it into place, either directly into the arch directory or
+// into the pool with a link from the arch directory, and rebuilds the metadata. The arch comes from the
+// Architecture field of the package when it is empty, and has to match that field otherwise.
+// When signed uploads are required, signature has to be a detached signature of the package by a
+// trusted uploader. A package identical to one that is already there is simply dropped.
+// Everything from the duplicate check on runs under the global mutex, so that concurrent uploads of the
+// same package can't both pass the check.
+func storeUpload(config conf, db *bolt.DB, distro, section, arch string, part *multipart.Part, signature []byte, force bool) error {
+	name := part.FileName()
+	if name != filepath.Base(name) || !strings.HasSuffix(name, ".deb") {
+		return uploadErrorf(http.StatusBadRequest, "invalid package file name %s", name)
+	}
+	tmp, err := ioutil.TempFile(config.StagingPath(), "upload-")
+	if err != nil {
+		return fmt.Errorf("error creating deb file: %s", err)
+	}
+	defer os.Remove(tmp.Name())
+	_, err = io.Copy(tmp, part)
+	tmp.Close()
+	if err != nil {
+		return fmt.Errorf("error writing deb file: %s", err)
+	}
+	if config.RequireSignedUploads {
+		if signature == nil {
+			return uploadErrorf(http.StatusUnauthorized, "%s is not signed, its signature has to be uploaded before it", name)
+		}
+		if err := verifyUpload(config, tmp.Name(), signature, distro); err != nil {
+			return err
+		}
+	}
+
+	control, err := inspectPackage(tmp.Name())
+	if err != nil {
+		return uploadErrorf(http.StatusBadRequest, "error inspecting %s: %s", name, err)
+	}
+	if control == "" {
+		return uploadErrorf(http.StatusBadRequest, "%s has no control file", name)
+	}
+	if arch, err = routePackage(config, distro, section, arch, name, control); err != nil {
+		return err
+	}
+	if config.VerifyPackageSignatures {
+		if err := requirePackageSignature(config, tmp.Name(), name); err != nil {
+			return err
+		}
+	}
+
+	mutex.Lock()
+	defer mutex.Unlock()
+	duplicate, err := checkDuplicate(config, db, distro, section, arch, tmp.Name(), name, control, force)
+	if err != nil || duplicate {
+		return err
+	}
+	paths, err := placePackage(config, distro, section, arch, tmp.Name(), name, force)
+	if err != nil {
+		return err
+	}
+	if *verbose {
+		log.Printf("Deb package %s has been uploaded to %s %s %s", name, distro, section, arch)
+	}
+	removed, err := applyRetention(config, db, distro, section, arch)
+	if err != nil {
+		log.Printf("error applying retention policy: %s", err)
+	}
+	if !parsedconfig.EnableDirectoryWatching {
+		rebuildRepoMetadata(config, db, paths...)
+		if *verbose {
+			log.Printf("Repository %s %s %s has been rebuilt", distro, section, arch)
+		}
+	}
+	return prunedUpload(removed, []string{name}, distro, section)
+}
+
+// routePackage returns the arch a package with the given control file is stored for: the
+// Architecture field of the package when arch is empty, or arch itself if it matches that field.
+// The arch has to be supported by the distro and section.
+func routePackage(config conf, distro, section, arch, name, control string) (string, error) {
+	controlArch := parseControl(control)["Architecture"]
+	switch {
+	case arch == "" && controlArch == "":
+		return arch, uploadErrorf(http.StatusBadRequest, "%s has no Architecture field, pass arch to choose where it goes", name)
+	case arch == "":
+		arch = controlArch
+	case controlArch != "" && arch != controlArch:
+		return arch, uploadErrorf(http.StatusBadRequest, "%s is built for %s, but was uploaded as %s", name, controlArch, arch)
+	}
+	if info, err := os.Stat(config.ArchPath(distro, section, arch)); err != nil || !info.IsDir() {
+		return arch, uploadErrorf(http.StatusBadRequest, "%s %s does not support the %s architecture", distro, section, arch)
+	}
+	return arch, nil
+}
+
+// placePackage moves a checked package from tmpPath into the arch directory, or into the pool with a
+// link from the arch directory, and returns the paths in arch directories whose metadata changed: its
+// path in the arch directory, and the links of other distros when force replaced a shared pool file.
+func placePackage(config conf, distro, section, arch, tmpPath, name string, force bool) ([]string, error) {
+	path := filepath.Join(config.ArchPath(distro, section, arch), name)
+	if !config.UsePool {
+		if err := os.Chmod(tmpPath, 0644); err != nil {
+			return nil, fmt.Errorf("error writing deb file: %s", err)
+		}
+		if err := os.Rename(tmpPath, path); err != nil {
+			return nil, fmt.Errorf("error moving deb file into place: %s", err)
+		}
+		return []string{path}, nil
+	}
+	poolFile, replaced, err := addToPool(config, section, tmpPath, name, force)
+	if err != nil {
+		return nil, err
+	}
+	if err := linkFromPool(config, distro, section, arch, poolFile); err != nil {
+		return nil, err
+	}
+	if !replaced {
+		return []string{path}, nil
+	}
+	links, err := poolFileLinks(config, section, poolFile)
+	if err != nil {
+		return nil, fmt.Errorf("error checking references to %s: %s", name, err)
+	}
+	if *verbose {
+		log.Printf("Pool file %s has been replaced for %d distros", poolFile, len(links))
+	}
+	return links, nil
+}
+
 func validateAPIkey(db *bolt.DB, key string) bool {
 	err := db.View(func(tx *bolt.Tx) error {
 		b := tx.Bucket([]byte("APIkeys"))
@@ -139,6 +359,16 @@ func validateAPIkey(db *bolt.DB, key string) bool {
 	return err == nil
 }
 
+// uploadFailed replies with the status carried by an uploadError, or with a 500 for any other error.
+func uploadFailed(w http.ResponseWriter, err error) {
+	if uerr, ok := err.(uploadError); ok {
+		log.Println(err)
+		http.Error(w, uerr.Error(), uerr.status)
+		return
+	}
+	httpErrorf(w, "%s", err)
+}
+
 func httpErrorf(w http.ResponseWriter, format string, a ...interface{}) {
 	err := fmt.Errorf(format, a...)
 	log.Println(err)
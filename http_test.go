@@ -10,6 +10,7 @@ import (
 	"net/http"
 	"net/http/httptest"
 	"os"
+	"path/filepath"
 	"testing"
 
 	"github.com/boltdb/bolt"
@@ -41,8 +42,8 @@ func TestUploadHandlerBasic(t *testing.T) {
 	}
 
 	// POST
-	// create "all" arch as it's the default
-	if err := os.MkdirAll(config.RootRepoPath+"/dists/stable/main/binary-all", 0755); err != nil {
+	// uploads are routed by the Architecture field of the package
+	if err := os.MkdirAll(config.RootRepoPath+"/dists/stable/main/binary-amd64", 0755); err != nil {
 		t.Errorf("error creating directory for POST testing: %s", err)
 	}
 	sampleDeb, err := os.Open("samples/vim-tiny_7.4.052-1ubuntu3_amd64.deb")
@@ -71,7 +72,7 @@ func TestUploadHandlerBasic(t *testing.T) {
 		t.Errorf("uploadHandler POST returned %v, should be %v", w.Code, http.StatusOK)
 	}
 	// verify uploaded file matches sample
-	uploadFile, _ := ioutil.ReadFile(config.RootRepoPath + "/dists/stable/main/binary-all/vim-tiny_7.4.052-1ubuntu3_amd64.deb")
+	uploadFile, _ := ioutil.ReadFile(config.RootRepoPath + "/dists/stable/main/binary-amd64/vim-tiny_7.4.052-1ubuntu3_amd64.deb")
 	uploadmd5hash := md5.New()
 	uploadmd5hash.Write(uploadFile)
 	uploadFilemd5 := hex.EncodeToString(uploadmd5hash.Sum(nil))
@@ -90,6 +91,63 @@ func TestUploadHandlerBasic(t *testing.T) {
 	}
 }
 
+func TestUploadHandlerRouting(t *testing.T) {
+	pwd, err := os.Getwd()
+	if err != nil {
+		t.Errorf("Unable to get current working directory: %s", err)
+	}
+	config := conf{ListenPort: "9666", RootRepoPath: pwd + "/testing", SupportArch: []string{"all", "amd64"}, DistroNames: []string{"stable"}, Sections: []string{"main"}, EnableDirectoryWatching: false}
+	if err := createDirs(config); err != nil {
+		t.Errorf("createDirs() failed: %s", err)
+	}
+	db, err := bolt.Open(tempfile(), 0666, nil)
+	if err != nil {
+		t.Fatalf("error creating tempdb: %s", err)
+	}
+	defer db.Close()
+	uploadHandle := uploadHandler(config, db)
+	upload := func(query string, files ...string) int {
+		body, contentType := multipartBody(t, files...)
+		req, _ := http.NewRequest("POST", "/upload?"+query, body)
+		req.Header.Add("Content-Type", contentType)
+		w := httptest.NewRecorder()
+		uploadHandle.ServeHTTP(w, req)
+		return w.Code
+	}
+
+	// without an arch each package goes where its Architecture field says
+	if code := upload("", "samples/vim-tiny_7.4.052-1ubuntu3_amd64.deb", "samples/hello-zst_1.0-1_all.deb"); code != http.StatusOK {
+		t.Errorf("uploadHandler POST returned %v, should be %v", code, http.StatusOK)
+	}
+	for _, path := range []string{
+		config.ArchPath("stable", "main", "amd64") + "/vim-tiny_7.4.052-1ubuntu3_amd64.deb",
+		config.ArchPath("stable", "main", "all") + "/hello-zst_1.0-1_all.deb",
+	} {
+		if _, err := os.Stat(path); err != nil {
+			t.Errorf("%s should have been uploaded: %s", path, err)
+		}
+	}
+
+	// an arch that doesn't match the package is rejected
+	if code := upload("arch=all", "samples/vim-tiny_7.4.052-1ubuntu3_amd64.deb"); code != http.StatusBadRequest {
+		t.Errorf("uploadHandler POST with a mismatched arch returned %v, should be %v", code, http.StatusBadRequest)
+	}
+	// and so is a package for an arch the repository doesn't support
+	armhf := filepath.Join(config.RootRepoPath, "app_1.0_armhf.deb")
+	writeTestDeb(t, armhf, "Package: app\nVersion: 1.0\nArchitecture: armhf\n")
+	if code := upload("", "app_1.0_armhf.deb="+armhf); code != http.StatusBadRequest {
+		t.Errorf("uploadHandler POST of an unsupported arch returned %v, should be %v", code, http.StatusBadRequest)
+	}
+	if _, err := os.Stat(config.ArchPath("stable", "main", "armhf")); !os.IsNotExist(err) {
+		t.Errorf("no armhf directory should have been created")
+	}
+
+	// cleanup
+	if err := os.RemoveAll(config.RootRepoPath); err != nil {
+		t.Errorf("error cleaning up after uploadHandler(): %s", err)
+	}
+}
+
 func TestUploadHandlerTempFile(t *testing.T) {
 	pwd, err := os.Getwd()
 	if err != nil {
@@ -120,6 +178,7 @@ func TestUploadHandlerTempFile(t *testing.T) {
 	}
 	defer tempFile.Close()
 	config.RootRepoPath = pwd + "/tempFile"
+	config.StagingDir = pwd + "/tempFile"
 	// Can't make directory named after file
 	uploadHandle := uploadHandler(config, db)
 	failBody := &bytes.Buffer{}
@@ -178,8 +237,8 @@ func TestUploadHandlerAPIKey(t *testing.T) {
 	}
 	config.EnableAPIKeys = true
 	uploadHandle := uploadHandler(config, db)
-	// create "all" arch as it's the default
-	if err := os.MkdirAll(config.RootRepoPath+"/dists/stable/main/binary-all", 0755); err != nil {
+	// uploads are routed by the Architecture field of the package
+	if err := os.MkdirAll(config.RootRepoPath+"/dists/stable/main/binary-amd64", 0755); err != nil {
 		t.Errorf("error creating directory for POST testing: %s", err)
 	}
 
@@ -261,8 +320,8 @@ func TestUploadHandlerDisableFilewatcher(t *testing.T) {
 	}
 
 	// POST
-	// create "all" arch as it's the default
-	if err := os.MkdirAll(config.RootRepoPath+"/dists/stable/main/binary-all", 0755); err != nil {
+	// uploads are routed by the Architecture field of the package
+	if err := os.MkdirAll(config.RootRepoPath+"/dists/stable/main/binary-amd64", 0755); err != nil {
 		t.Errorf("error creating directory for POST testing: %s", err)
 	}
 	sampleDeb, err := os.Open("samples/vim-tiny_7.4.052-1ubuntu3_amd64.deb")
@@ -291,7 +350,7 @@ func TestUploadHandlerDisableFilewatcher(t *testing.T) {
 		t.Errorf("uploadHandler POST returned %v, should be %v", w.Code, http.StatusOK)
 	}
 	// verify uploaded file matches sample
-	uploadFile, _ := ioutil.ReadFile(config.RootRepoPath + "/dists/stable/main/binary-all/vim-tiny_7.4.052-1ubuntu3_amd64.deb")
+	uploadFile, _ := ioutil.ReadFile(config.RootRepoPath + "/dists/stable/main/binary-amd64/vim-tiny_7.4.052-1ubuntu3_amd64.deb")
 	uploadmd5hash := md5.New()
 	uploadmd5hash.Write(uploadFile)
 	uploadFilemd5 := hex.EncodeToString(uploadmd5hash.Sum(nil))
@@ -492,7 +551,7 @@ func BenchmarkUploadHandler(b *testing.B) {
 	}
 	defer db.Close()
 	uploadHandle := uploadHandler(*config, db)
-	if err := os.MkdirAll(config.RootRepoPath+"/dists/stable/main/binary-all", 0755); err != nil {
+	if err := os.MkdirAll(config.RootRepoPath+"/dists/stable/main/binary-amd64", 0755); err != nil {
 		b.Errorf("error creating directory for POST testing: %s", err)
 	}
 	sampleDeb, err := os.Open("samples/vim-tiny_7.4.052-1ubuntu3_amd64.deb")
@@ -0,0 +1,112 @@
+package main
+
+import (
+	"compress/gzip"
+	"fmt"
+	"io"
+	"strings"
+
+	"github.com/dsnet/compress/bzip2"
+	"github.com/klauspost/compress/zstd"
+	"github.com/ulikunitz/xz"
+)
+
+// indexCompressions maps the names accepted by the indexCompression setting to the file
+// extension of the variant each one produces.
+var indexCompressions = map[string]string{
+	"none": "",
+	"gz":   ".gz",
+	"xz":   ".xz",
+	"bz2":  ".bz2",
+	"zst":  ".zst",
+}
+
+// indexWriter fans the content of an index file, such as Packages, out to each of its configured
+// compressed variants. Close must be called to flush the compressors and close the files.
+type indexWriter struct {
+	io.Writer
+	closers []io.Closer
+}
+
+// createIndexFiles stages basePath plus an extension for every configured index compression in pub.
+// Variants that are no longer configured are removed, so that they don't linger with stale content.
+func createIndexFiles(pub *publication, config conf, basePath string) (*indexWriter, error) {
+	iw := &indexWriter{}
+	var writers []io.Writer
+	configured := make(map[string]bool)
+
+	for _, name := range config.IndexCompressions() {
+		ext, ok := indexCompressions[name]
+		if !ok {
+			iw.Close()
+			return nil, fmt.Errorf("unknown index compression \"%s\"", name)
+		}
+		if configured[name] {
+			continue
+		}
+		configured[name] = true
+
+		f, err := pub.create(basePath + ext)
+		if err != nil {
+			iw.Close()
+			return nil, fmt.Errorf("failed to create %s: %s", basePath+ext, err)
+		}
+
+		var w io.WriteCloser
+		switch name {
+		case "gz":
+			w = gzip.NewWriter(f)
+		case "xz":
+			w, err = xz.NewWriter(f)
+		case "bz2":
+			w, err = bzip2.NewWriter(f, &bzip2.WriterConfig{Level: bzip2.BestCompression})
+		case "zst":
+			w, err = zstd.NewWriter(f, zstd.WithEncoderConcurrency(1))
+		}
+		if err != nil {
+			f.Close()
+			iw.Close()
+			return nil, fmt.Errorf("failed to create %s compressor: %s", name, err)
+		}
+		if w != nil {
+			iw.closers = append(iw.closers, w)
+			writers = append(writers, w)
+		} else {
+			writers = append(writers, f)
+		}
+		iw.closers = append(iw.closers, f)
+	}
+
+	for name, ext := range indexCompressions {
+		if !configured[name] {
+			pub.remove(basePath + ext)
+		}
+	}
+
+	iw.Writer = io.MultiWriter(writers...)
+	return iw, nil
+}
+
+// Close flushes every compressor and closes every file, returning the first error encountered.
+func (iw *indexWriter) Close() error {
+	var firstErr error
+	for _, c := range iw.closers {
+		if err := c.Close(); err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+	iw.closers = nil
+	return firstErr
+}
+
+// isIndexFile reports whether name is an index file that belongs in the Release file, such as
+// Packages, Sources or Contents-<arch>, in any of its compressed variants.
+func isIndexFile(name string) bool {
+	for _, ext := range indexCompressions {
+		if ext != "" && strings.HasSuffix(name, ext) {
+			name = strings.TrimSuffix(name, ext)
+			break
+		}
+	}
+	return name == "Packages" || name == "Sources" || strings.HasPrefix(name, "Contents-")
+}
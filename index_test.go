@@ -0,0 +1,116 @@
+package main
+
+import (
+	"bytes"
+	"compress/bzip2"
+	"compress/gzip"
+	"io"
+	"io/ioutil"
+	"os"
+	"testing"
+
+	"github.com/klauspost/compress/zstd"
+	"github.com/ulikunitz/xz"
+)
+
+func TestCreateIndexFiles(t *testing.T) {
+	pwd, err := os.Getwd()
+	if err != nil {
+		t.Errorf("Unable to get current working directory: %s", err)
+	}
+	config := conf{RootRepoPath: pwd + "/testing", IndexCompression: []string{"none", "gz", "xz", "bz2", "zst"}}
+	if err := os.MkdirAll(config.RootRepoPath, 0755); err != nil {
+		t.Errorf("error creating directory: %s\n", err)
+	}
+	samplePackages, err := ioutil.ReadFile("samples/Packages")
+	if err != nil {
+		t.Errorf("error opening sample packages: %s", err)
+	}
+
+	pub := newPublication()
+	writer, err := createIndexFiles(pub, config, config.RootRepoPath+"/Packages")
+	if err != nil {
+		t.Fatalf("error creating index files: %s", err)
+	}
+	writer.Write(samplePackages)
+	if err := writer.Close(); err != nil {
+		t.Errorf("error closing index files: %s", err)
+	}
+	// nothing is visible until the publication is committed
+	if _, err := os.Stat(config.RootRepoPath + "/Packages.gz"); !os.IsNotExist(err) {
+		t.Errorf("Packages.gz should not exist before commit")
+	}
+	if err := pub.commit(); err != nil {
+		t.Errorf("error committing index files: %s", err)
+	}
+
+	readers := map[string]func(io.Reader) (io.Reader, error){
+		"":     func(r io.Reader) (io.Reader, error) { return r, nil },
+		".gz":  func(r io.Reader) (io.Reader, error) { return gzip.NewReader(r) },
+		".xz":  func(r io.Reader) (io.Reader, error) { return xz.NewReader(r) },
+		".bz2": func(r io.Reader) (io.Reader, error) { return bzip2.NewReader(r), nil },
+		".zst": func(r io.Reader) (io.Reader, error) { return zstd.NewReader(r) },
+	}
+	for ext, newReader := range readers {
+		f, err := os.Open(config.RootRepoPath + "/Packages" + ext)
+		if err != nil {
+			t.Errorf("error opening Packages%s: %s", ext, err)
+			continue
+		}
+		r, err := newReader(f)
+		if err != nil {
+			t.Errorf("error decompressing Packages%s: %s", ext, err)
+		} else if content, err := ioutil.ReadAll(r); err != nil || !bytes.Equal(content, samplePackages) {
+			t.Errorf("Packages%s does not match the sample packages (%v)", ext, err)
+		}
+		f.Close()
+	}
+
+	// dropping a compression removes its stale variant
+	config.IndexCompression = []string{"xz"}
+	pub = newPublication()
+	writer, err = createIndexFiles(pub, config, config.RootRepoPath+"/Packages")
+	if err != nil {
+		t.Fatalf("error creating index files: %s", err)
+	}
+	writer.Close()
+	if err := pub.commit(); err != nil {
+		t.Errorf("error committing index files: %s", err)
+	}
+	for _, ext := range []string{"", ".gz", ".bz2", ".zst"} {
+		if _, err := os.Stat(config.RootRepoPath + "/Packages" + ext); !os.IsNotExist(err) {
+			t.Errorf("Packages%s should have been removed", ext)
+		}
+	}
+
+	config.IndexCompression = []string{"lz4"}
+	pub = newPublication()
+	if _, err := createIndexFiles(pub, config, config.RootRepoPath+"/Packages"); err == nil {
+		t.Error("createIndexFiles() should have failed, it did not")
+	}
+	pub.discard()
+
+	// cleanup
+	if err := os.RemoveAll(config.RootRepoPath); err != nil {
+		t.Errorf("error cleaning up after createIndexFiles(): %s", err)
+	}
+}
+
+func TestIsIndexFile(t *testing.T) {
+	for name, want := range map[string]bool{
+		"Packages":          true,
+		"Packages.gz":       true,
+		"Packages.xz":       true,
+		"Packages.bz2":      true,
+		"Packages.zst":      true,
+		"Packages.lz4":      false,
+		"Sources.xz":        true,
+		"Release":           false,
+		"test.deb":          false,
+		"Contents-amd64.gz": true,
+	} {
+		if got := isIndexFile(name); got != want {
+			t.Errorf("isIndexFile(%s) is %v, should be %v", name, got, want)
+		}
+	}
+}
@@ -0,0 +1,344 @@
+package main
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha1"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"time"
+
+	"golang.org/x/crypto/openpgp"
+	"golang.org/x/crypto/openpgp/armor"
+	"golang.org/x/crypto/openpgp/packet"
+	"golang.org/x/crypto/openpgp/s2k"
+)
+
+// minKeyBits is the smallest RSA key size keygen generates, as smaller keys are no longer considered safe.
+const minKeyBits = 2048
+
+// keyOptions describes a signing key to generate, and where to write it.
+type keyOptions struct {
+	name, comment, email string
+	bits                 int
+	// expires is when the key expires, or the zero time for a key that doesn't
+	expires    time.Time
+	passphrase passphraseConf
+	// publicKey, privateKey and revocation are written ASCII armored, keyring binary, as apt expects
+	// keys in /usr/share/keyrings and /etc/apt/trusted.gpg.d
+	publicKey, privateKey, keyring, revocation string
+}
+
+// keygenCommand implements the keygen subcommand, which generates a signing key pair along with a
+// revocation certificate and a binary keyring for apt.
+func keygenCommand(args []string) error {
+	flags := flag.NewFlagSet("keygen", flag.ContinueOnError)
+	opts := keyOptions{comment: "Generated by deb-simple"}
+	flags.StringVar(&opts.name, "name", "", "Name for the signing key")
+	flags.StringVar(&opts.email, "email", "", "Email address")
+	flags.IntVar(&opts.bits, "bits", 4096, "RSA key size, at least 2048")
+	expire := flags.String("expire", "", "Date the key expires, such as 2030-01-01, or never when empty")
+	out := flags.String("out", ".", "Directory to write the key files to")
+	flags.StringVar(&opts.publicKey, "public", "", "Path of the armored public key (default <out>/public.key)")
+	flags.StringVar(&opts.privateKey, "private", "", "Path of the armored private key (default <out>/private.key)")
+	flags.StringVar(&opts.keyring, "keyring", "", "Path of the binary keyring for apt (default <out>/keyring.gpg)")
+	flags.StringVar(&opts.revocation, "revocation", "", "Path of the revocation certificate (default <out>/revocation.asc)")
+	flags.StringVar(&opts.passphrase.Env, "passphrase-env", "", "Environment variable holding the passphrase to encrypt the private key with")
+	flags.StringVar(&opts.passphrase.File, "passphrase-file", "", "File holding the passphrase to encrypt the private key with")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	if opts.name == "" || opts.email == "" {
+		return errors.New("keygen needs a -name and an -email")
+	}
+	if *expire != "" {
+		expires, err := parseKeyDate(*expire)
+		if err != nil {
+			return fmt.Errorf("invalid -expire: %s", err)
+		}
+		opts.expires = expires
+	}
+	for path, file := range map[*string]string{&opts.publicKey: "public.key", &opts.privateKey: "private.key", &opts.keyring: "keyring.gpg", &opts.revocation: "revocation.asc"} {
+		if *path == "" {
+			*path = filepath.Join(*out, file)
+		}
+	}
+
+	entity, err := createSigningKey(opts)
+	if err != nil {
+		return err
+	}
+	fmt.Printf("Generated key %s\n", keyFingerprint(entity))
+	return nil
+}
+
+// createSigningKey generates a key pair as described by opts, and writes out its files. Existing files
+// are never overwritten, so a key that is in use can't be lost by generating another one, and either
+// every file is written or none is.
+func createSigningKey(opts keyOptions) (*openpgp.Entity, error) {
+	if opts.bits < minKeyBits {
+		return nil, fmt.Errorf("key size of %d bits is too small, use at least %d", opts.bits, minKeyBits)
+	}
+	now := Now()
+	if !opts.expires.IsZero() && !opts.expires.After(now) {
+		return nil, fmt.Errorf("expiry date %s is in the past", opts.expires.Format(time.RFC3339))
+	}
+	// no point in generating a key that can't be written
+	for _, path := range []string{opts.publicKey, opts.keyring, opts.privateKey, opts.revocation} {
+		if _, err := os.Lstat(path); err == nil {
+			return nil, fmt.Errorf("error creating key file: %s already exists", path)
+		} else if !os.IsNotExist(err) {
+			return nil, fmt.Errorf("error creating key file: %s", err)
+		}
+	}
+	var passphrase []byte
+	if opts.passphrase != (passphraseConf{}) {
+		var err error
+		if passphrase, err = opts.passphrase.read(); err != nil {
+			return nil, err
+		}
+		if len(passphrase) == 0 {
+			return nil, errors.New("passphrase is empty")
+		}
+	}
+
+	config := &packet.Config{RSABits: opts.bits, DefaultHash: crypto.SHA256, Time: func() time.Time { return now }}
+	entity, err := openpgp.NewEntity(opts.name, opts.comment, opts.email, config)
+	if err != nil {
+		return nil, fmt.Errorf("error generating key: %s", err)
+	}
+	if !opts.expires.IsZero() {
+		lifetime := uint32(opts.expires.Sub(entity.PrimaryKey.CreationTime).Seconds())
+		for _, identity := range entity.Identities {
+			identity.SelfSignature.KeyLifetimeSecs = &lifetime
+			if err := identity.SelfSignature.SignUserId(identity.UserId.Id, entity.PrimaryKey, entity.PrivateKey, config); err != nil {
+				return nil, fmt.Errorf("error signing key: %s", err)
+			}
+		}
+		for _, subkey := range entity.Subkeys {
+			subkey.Sig.KeyLifetimeSecs = &lifetime
+			if err := subkey.Sig.SignKey(subkey.PublicKey, entity.PrivateKey, config); err != nil {
+				return nil, fmt.Errorf("error signing subkey: %s", err)
+			}
+		}
+	}
+
+	files := []struct {
+		path  string
+		mode  os.FileMode
+		write func(io.Writer) error
+	}{
+		{opts.publicKey, 0644, func(w io.Writer) error { return writeArmored(w, openpgp.PublicKeyType, entity.Serialize) }},
+		{opts.keyring, 0644, entity.Serialize},
+		{opts.privateKey, 0600, func(w io.Writer) error {
+			return writeArmored(w, openpgp.PrivateKeyType, func(w io.Writer) error {
+				return serializePrivateEntity(w, entity, passphrase)
+			})
+		}},
+		{opts.revocation, 0600, func(w io.Writer) error { return writeRevocationCertificate(w, entity, now) }},
+	}
+	// every file is written next to where it goes first, and only linked into place once all of them
+	// have been written, as a link fails rather than replace a file created in the meantime
+	temps := make([]string, len(files))
+	defer func() {
+		for _, temp := range temps {
+			if temp != "" {
+				os.Remove(temp)
+			}
+		}
+	}()
+	for i, file := range files {
+		f, err := ioutil.TempFile(filepath.Dir(file.path), "."+filepath.Base(file.path)+".")
+		if err != nil {
+			return nil, fmt.Errorf("error creating key file: %s", err)
+		}
+		temps[i] = f.Name()
+		if err = f.Chmod(file.mode); err == nil {
+			err = file.write(f)
+		}
+		if closeErr := f.Close(); err == nil {
+			err = closeErr
+		}
+		if err != nil {
+			return nil, fmt.Errorf("error writing %s: %s", file.path, err)
+		}
+	}
+	for i, file := range files {
+		if err := os.Link(temps[i], file.path); err != nil {
+			for _, placed := range files[:i] {
+				os.Remove(placed.path)
+			}
+			return nil, fmt.Errorf("error creating key file: %s", err)
+		}
+	}
+	return entity, nil
+}
+
+// writeArmored writes what serialize writes ASCII armored as blockType.
+func writeArmored(w io.Writer, blockType string, serialize func(io.Writer) error) error {
+	armored, err := armor.Encode(w, blockType, nil)
+	if err != nil {
+		return err
+	}
+	if err := serialize(armored); err != nil {
+		return err
+	}
+	return armored.Close()
+}
+
+// serializePrivateEntity writes the private keys of entity along with its identities and signatures, like
+// Entity.SerializePrivate does, with every private key encrypted with passphrase unless it is empty.
+func serializePrivateEntity(w io.Writer, entity *openpgp.Entity, passphrase []byte) error {
+	if len(passphrase) == 0 {
+		return entity.SerializePrivate(w, nil)
+	}
+	if err := serializeEncryptedPrivateKey(w, entity.PrivateKey, passphrase); err != nil {
+		return err
+	}
+	for _, identity := range entity.Identities {
+		if err := identity.UserId.Serialize(w); err != nil {
+			return err
+		}
+		if err := identity.SelfSignature.Serialize(w); err != nil {
+			return err
+		}
+	}
+	for _, subkey := range entity.Subkeys {
+		if err := serializeEncryptedPrivateKey(w, subkey.PrivateKey, passphrase); err != nil {
+			return err
+		}
+		if err := subkey.Sig.Serialize(w); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// serializeEncryptedPrivateKey writes a private key packet with the secret key material encrypted as gpg
+// does by default: AES-256 in CFB mode, keyed with the iterated and salted SHA-256 of the passphrase, and
+// protected by a SHA-1 checksum (RFC 4880 section 5.5.3). The openpgp package can decrypt such keys, but
+// only write unencrypted ones, so the packet is built from the unencrypted one.
+func serializeEncryptedPrivateKey(w io.Writer, privateKey *packet.PrivateKey, passphrase []byte) error {
+	var plain, public bytes.Buffer
+	if err := privateKey.Serialize(&plain); err != nil {
+		return err
+	}
+	if err := privateKey.PublicKey.Serialize(&public); err != nil {
+		return err
+	}
+	plainBody, err := packetBody(plain.Bytes())
+	if err != nil {
+		return err
+	}
+	publicBody, err := packetBody(public.Bytes())
+	if err != nil {
+		return err
+	}
+	// the unencrypted body is the public key, a zero S2K usage octet, the secret key and a two octet checksum
+	secret := plainBody[len(publicBody)+1 : len(plainBody)-2]
+
+	var body bytes.Buffer
+	body.Write(publicBody)
+	body.Write([]byte{254, byte(packet.CipherAES256)})
+	key := make([]byte, packet.CipherAES256.KeySize())
+	if err := s2k.Serialize(&body, key, rand.Reader, passphrase, &s2k.Config{Hash: crypto.SHA256, S2KCount: 65011712}); err != nil {
+		return err
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return err
+	}
+	iv := make([]byte, block.BlockSize())
+	if _, err := io.ReadFull(rand.Reader, iv); err != nil {
+		return err
+	}
+	body.Write(iv)
+	checksum := sha1.Sum(secret)
+	encrypted := append(append([]byte{}, secret...), checksum[:]...)
+	cipher.NewCFBEncrypter(block, iv).XORKeyStream(encrypted, encrypted)
+	body.Write(encrypted)
+
+	// the packet keeps the tag of the unencrypted one, telling a primary key and a subkey apart
+	if err := writePacketHeader(w, plain.Bytes()[0], body.Len()); err != nil {
+		return err
+	}
+	_, err = w.Write(body.Bytes())
+	return err
+}
+
+// packetBody returns the body of a serialized packet, which the openpgp package always writes with a
+// new format header.
+func packetBody(data []byte) ([]byte, error) {
+	if len(data) < 2 || data[0]&0xc0 != 0xc0 {
+		return nil, errors.New("unexpected packet header")
+	}
+	switch {
+	case data[1] < 192:
+		return data[2:], nil
+	case data[1] < 224 && len(data) >= 3:
+		return data[3:], nil
+	case data[1] == 255 && len(data) >= 6:
+		return data[6:], nil
+	}
+	return nil, errors.New("unexpected packet length")
+}
+
+// writePacketHeader writes a new format packet header, with tag as the first octet of the header.
+func writePacketHeader(w io.Writer, tag byte, length int) error {
+	header := []byte{tag}
+	switch {
+	case length < 192:
+		header = append(header, byte(length))
+	case length < 8384:
+		length -= 192
+		header = append(header, byte(192+length>>8), byte(length))
+	default:
+		header = append(header, 255, byte(length>>24), byte(length>>16), byte(length>>8), byte(length))
+	}
+	_, err := w.Write(header)
+	return err
+}
+
+// writeRevocationCertificate writes an armored certificate revoking the primary key of entity, to be
+// imported and published if the private key is lost or compromised.
+func writeRevocationCertificate(w io.Writer, entity *openpgp.Entity, now time.Time) error {
+	var public bytes.Buffer
+	if err := entity.PrimaryKey.Serialize(&public); err != nil {
+		return err
+	}
+	publicBody, err := packetBody(public.Bytes())
+	if err != nil {
+		return err
+	}
+	sig := &packet.Signature{
+		SigType:      packet.SigTypeKeyRevocation,
+		PubKeyAlgo:   entity.PrimaryKey.PubKeyAlgo,
+		Hash:         crypto.SHA256,
+		CreationTime: now,
+		IssuerKeyId:  &entity.PrimaryKey.KeyId,
+	}
+	// a key revocation signature covers the primary key only (RFC 4880 section 5.2.4)
+	h := sig.Hash.New()
+	entity.PrimaryKey.SerializeSignaturePrefix(h)
+	h.Write(publicBody)
+	if err := sig.Sign(h, entity.PrivateKey, nil); err != nil {
+		return err
+	}
+
+	armored, err := armor.Encode(w, openpgp.PublicKeyType, map[string]string{"Comment": "Revocation certificate for " + keyFingerprint(entity)})
+	if err != nil {
+		return err
+	}
+	if err := sig.Serialize(armored); err != nil {
+		return err
+	}
+	return armored.Close()
+}
@@ -0,0 +1,127 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+
+	"golang.org/x/crypto/openpgp"
+	"golang.org/x/crypto/openpgp/armor"
+	"golang.org/x/crypto/openpgp/packet"
+)
+
+func TestKeygenCommand(t *testing.T) {
+	defer func(now func() time.Time) { Now = now }(Now)
+	Now = func() time.Time {
+		return time.Date(2018, 9, 20, 14, 17, 21, 000000000, time.UTC)
+	}
+
+	pwd, err := os.Getwd()
+	if err != nil {
+		t.Errorf("Unable to get current working directory: %s", err)
+	}
+	dir := pwd + "/testing"
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		t.Fatalf("error creating directory: %s", err)
+	}
+	if err := ioutil.WriteFile(dir+"/passphrase", []byte("deb-simple\n"), 0600); err != nil {
+		t.Fatalf("error writing passphrase file: %s", err)
+	}
+
+	args := []string{"-name", "deb-simple Test", "-email", "deb-simple@go.go", "-bits", "2048", "-expire", "2020-09-20",
+		"-out", dir, "-keyring", dir + "/deb-simple-archive-keyring.gpg", "-passphrase-file", dir + "/passphrase"}
+	if err := keygenCommand(args); err != nil {
+		t.Fatalf("keygenCommand() failed: %s", err)
+	}
+	// existing keys are never overwritten
+	if err := keygenCommand(args); err == nil {
+		t.Errorf("keygenCommand() should fail when the key files exist")
+	}
+	if err := keygenCommand([]string{"-name", "deb-simple Test", "-out", dir}); err == nil {
+		t.Errorf("keygenCommand() should fail without an email")
+	}
+	// keys smaller than 2048 bits aren't generated
+	smallDir := dir + "/small"
+	if err := keygenCommand([]string{"-name", "deb-simple Test", "-email", "deb-simple@go.go", "-bits", "1024", "-out", smallDir}); err == nil {
+		t.Errorf("keygenCommand() should fail for a 1024 bit key")
+	}
+	if _, err := os.Stat(smallDir); !os.IsNotExist(err) {
+		t.Errorf("keygenCommand() should not write any key file for a 1024 bit key")
+	}
+	// and a single existing file means none are written
+	partialDir := dir + "/partial"
+	if err := os.MkdirAll(partialDir, 0755); err != nil {
+		t.Fatalf("error creating directory: %s", err)
+	}
+	if err := ioutil.WriteFile(partialDir+"/revocation.asc", []byte("revocation"), 0600); err != nil {
+		t.Fatalf("error writing revocation certificate: %s", err)
+	}
+	if err := keygenCommand([]string{"-name", "deb-simple Test", "-email", "deb-simple@go.go", "-bits", "2048", "-out", partialDir}); err == nil {
+		t.Errorf("keygenCommand() should fail when the revocation certificate exists")
+	}
+	if files, _ := ioutil.ReadDir(partialDir); len(files) != 1 {
+		t.Errorf("keygenCommand() should not write any key file next to an existing one, found %d files", len(files))
+	}
+
+	// the binary keyring holds the public key, expiring two years after it was created
+	keyringFile, err := os.Open(dir + "/deb-simple-archive-keyring.gpg")
+	if err != nil {
+		t.Fatalf("keyring was not written: %s", err)
+	}
+	defer keyringFile.Close()
+	keyring, err := openpgp.ReadKeyRing(keyringFile)
+	if err != nil || len(keyring) != 1 {
+		t.Fatalf("ReadKeyRing() returned %d keys, %v", len(keyring), err)
+	}
+	entity := keyring[0]
+	if entity.PrivateKey != nil {
+		t.Errorf("keyring should not contain the private key")
+	}
+	for _, identity := range entity.Identities {
+		if !identity.SelfSignature.KeyExpired(time.Date(2020, 9, 21, 0, 0, 0, 0, time.UTC)) || identity.SelfSignature.KeyExpired(Now()) {
+			t.Errorf("key should expire on 2020-09-20, lifetime is %v", identity.SelfSignature.KeyLifetimeSecs)
+		}
+	}
+	if public, err := loadKeyring(dir + "/public.key"); err != nil || keyFingerprint(public[0]) != keyFingerprint(entity) {
+		t.Errorf("public.key does not hold the generated key: %v", err)
+	}
+
+	// the private key is encrypted
+	if _, err := createEntityFromPrivateKey(dir+"/private.key", passphraseConf{}, ""); err == nil {
+		t.Errorf("private key should be encrypted")
+	}
+	signer, err := createEntityFromPrivateKey(dir+"/private.key", passphraseConf{File: dir + "/passphrase"}, "")
+	if err != nil {
+		t.Fatalf("error decrypting private key: %s", err)
+	}
+	if signer.PrivateKey.KeyId != entity.PrimaryKey.KeyId {
+		t.Errorf("private key %s does not match the public key %s", signer.PrivateKey.KeyIdString(), entity.PrimaryKey.KeyIdString())
+	}
+	if info, _ := os.Stat(dir + "/private.key"); info.Mode().Perm() != 0600 {
+		t.Errorf("private key is readable by others: %s", info.Mode())
+	}
+
+	// the revocation certificate revokes the primary key
+	revocation, err := os.Open(dir + "/revocation.asc")
+	if err != nil {
+		t.Fatalf("revocation certificate was not written: %s", err)
+	}
+	defer revocation.Close()
+	block, err := armor.Decode(revocation)
+	if err != nil {
+		t.Fatalf("error decoding revocation certificate: %s", err)
+	}
+	pkt, err := packet.NewReader(block.Body).Next()
+	sig, ok := pkt.(*packet.Signature)
+	if err != nil || !ok || sig.SigType != packet.SigTypeKeyRevocation {
+		t.Fatalf("revocation certificate does not hold a key revocation: %v", err)
+	}
+	if err := entity.PrimaryKey.VerifyRevocationSignature(sig); err != nil {
+		t.Errorf("revocation certificate does not verify: %s", err)
+	}
+
+	if err := os.RemoveAll(dir); err != nil {
+		t.Errorf("error cleaning up after keygenCommand(): %s", err)
+	}
+}
@@ -0,0 +1,385 @@
+package main
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"crypto/md5"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/blakesmith/ar"
+	"github.com/boltdb/bolt"
+	"golang.org/x/crypto/openpgp"
+)
+
+// debFile is a file installed by a generated package, with its path relative to the root directory.
+type debFile struct {
+	path     string
+	data     []byte
+	conffile bool
+}
+
+// keyringSourcesName returns the name of the apt source the keyring package installs, which is the
+// keyring name without its -archive-keyring suffix.
+func keyringSourcesName(config conf) string {
+	return strings.TrimSuffix(config.ArchiveKeyringName(), "-archive-keyring") + ".sources"
+}
+
+// validateKeyringPackage checks that the keyring package can be published, as the apt source it installs
+// needs the URL clients reach the repository at.
+func (c conf) validateKeyringPackage() error {
+	if c.PublishKeyringPackage && c.PublicURL == "" {
+		return errors.New("publishKeyringPackage requires publicURL to be set")
+	}
+	// the package goes into the first section
+	if c.PublishKeyringPackage && len(c.Sections) == 0 {
+		return errors.New("publishKeyringPackage requires at least one section")
+	}
+	return nil
+}
+
+// keyringRefreshInterval is how often the signing keys are checked for changes that need a new keyring
+// package, as key files can be replaced while deb-simple runs.
+const keyringRefreshInterval = time.Minute
+
+// publishedKeyringRevisions holds the revision of the keyring package last published to each distro,
+// keyed by repo path and distro, so checking for key changes doesn't mean reading the arch directories.
+// It is guarded by the global mutex.
+var publishedKeyringRevisions = make(map[string]string)
+
+// refreshKeyringPackage publishes the keyring package again if the signing keys changed since it was
+// last published. It has to be called with the global mutex held.
+func refreshKeyringPackage(config conf, db *bolt.DB) error {
+	keys, err := repositoryPublicKeys(config)
+	if err != nil {
+		return err
+	}
+	url := strings.TrimSuffix(config.PublicURL, "/") + "/"
+	for _, distro := range config.DistroNames {
+		if publishedKeyringRevisions[config.RootRepoPath+"/"+distro] != keyringPackageRevision(keys, distro, url, config.Sections) {
+			return publishKeyringPackage(config, db)
+		}
+	}
+	return nil
+}
+
+// keyringPackageRevision returns the part of the keyring package version of a distro that identifies
+// its contents: the distro name followed by the short key IDs of keys, so it changes with the key set,
+// and a short hash of the URL and sections the apt source points at, so it changes with those too.
+func keyringPackageRevision(keys openpgp.EntityList, distro, url string, sections []string) string {
+	var ids []string
+	for _, key := range keys {
+		fingerprint := keyFingerprint(key)
+		ids = append(ids, fingerprint[len(fingerprint)-8:])
+	}
+	sort.Strings(ids)
+	// distro names may hold characters that aren't allowed in versions
+	distro = strings.Map(func(r rune) rune {
+		if r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z' || r >= '0' && r <= '9' {
+			return r
+		}
+		return '.'
+	}, distro)
+	source := sha256.Sum256([]byte(url + "\n" + strings.Join(sections, " ")))
+	return distro + "." + strings.Join(ids, ".") + "." + hex.EncodeToString(source[:4])
+}
+
+// keyringKeysDate returns when the current key set took effect: the creation time of the newest key,
+// or the notBefore date of a signing key when that is later.
+func keyringKeysDate(config conf, keys openpgp.EntityList) (time.Time, error) {
+	var date time.Time
+	for _, key := range keys {
+		if key.PrimaryKey.CreationTime.After(date) {
+			date = key.PrimaryKey.CreationTime
+		}
+	}
+	if config.ExternalSigner != nil {
+		return date, nil
+	}
+	for _, key := range config.ReleaseSigningKeys() {
+		if key.NotBefore == "" {
+			continue
+		}
+		notBefore, err := parseKeyDate(key.NotBefore)
+		if err != nil {
+			return time.Time{}, fmt.Errorf("invalid date for %s: %s", key.Path, err)
+		}
+		if notBefore.After(date) {
+			date = notBefore
+		}
+	}
+	return date, nil
+}
+
+// keyringPackageVersion returns the upstream part of a new keyring package version, which is the time the
+// key set took effect. When that isn't newer than the version already published, as when only the URL
+// or sections changed or a key was removed, the published version is counted up instead, so clients
+// still upgrade to the new package.
+func keyringPackageVersion(keysDate time.Time, published string) string {
+	upstream := keysDate.UTC().Format("20060102.150405")
+	if published == "" {
+		return upstream
+	}
+	published = strings.SplitN(published, "+", 2)[0]
+	if compareVersions(upstream, published) > 0 {
+		return upstream
+	}
+	if parts := strings.Split(published, "."); len(parts) == 3 {
+		if n, err := strconv.Atoi(parts[2]); err == nil {
+			return parts[0] + "." + parts[1] + "." + strconv.Itoa(n+1)
+		}
+	}
+	return published + ".1"
+}
+
+// publishKeyringPackage publishes the archive keyring package into every distro, unless a package for
+// the current signing keys, URL and sections is already there. The package version starts with the time
+// the key set took effect, so clients pick up a new key set with their regular upgrades, and older
+// versions are removed.
+func publishKeyringPackage(config conf, db *bolt.DB) error {
+	if err := config.validateKeyringPackage(); err != nil {
+		return err
+	}
+	keys, err := repositoryPublicKeys(config)
+	if err != nil {
+		return err
+	}
+	if len(keys) == 0 {
+		return errors.New("no signing keys are configured")
+	}
+	keysDate, err := keyringKeysDate(config, keys)
+	if err != nil {
+		return err
+	}
+	url := strings.TrimSuffix(config.PublicURL, "/") + "/"
+	name := config.ArchiveKeyringName()
+	section := config.Sections[0]
+	archs := []string{"all"}
+	if !contains(config.SupportArch, "all") {
+		archs = config.SupportArch
+	}
+
+	var changed []string
+	for _, distro := range config.DistroNames {
+		revision := keyringPackageRevision(keys, distro, url, config.Sections)
+		// the current package may already be published to some archs, and older ones to others
+		var version, newest string
+		current := make(map[string]bool)
+		old := make(map[string][]string)
+		for _, arch := range archs {
+			entries, err := readArchEntries(config, db, distro, section, arch)
+			if err != nil {
+				return err
+			}
+			for filename, entry := range entries {
+				fields := parseControl(entry.Control)
+				if fields["Package"] != name {
+					continue
+				}
+				if parts := strings.SplitN(fields["Version"], "+", 2); len(parts) == 2 && parts[1] == revision {
+					current[arch] = true
+					version = fields["Version"]
+					continue
+				}
+				old[arch] = append(old[arch], filename)
+				if newest == "" || compareVersions(fields["Version"], newest) > 0 {
+					newest = fields["Version"]
+				}
+			}
+		}
+		if version == "" {
+			version = keyringPackageVersion(keysDate, newest) + "+" + revision
+		}
+
+		var deb []byte
+		for _, arch := range archs {
+			if !current[arch] {
+				if deb == nil {
+					if deb, err = buildKeyringPackage(config, keys, distro, version, url, keysDate); err != nil {
+						return fmt.Errorf("error building keyring package: %s", err)
+					}
+				}
+				paths, err := placeKeyringPackage(config, distro, section, arch, name+"_"+version+"_all.deb", deb)
+				if err != nil {
+					return err
+				}
+				log.Printf("Published %s %s to %s %s (%s)", name, version, distro, section, arch)
+				changed = append(changed, paths...)
+			}
+			for _, filename := range old[arch] {
+				if err := removePackage(config, distro, section, arch, filename); err != nil {
+					return fmt.Errorf("error removing %s: %s", filename, err)
+				}
+				changed = append(changed, filepath.Join(config.ArchPath(distro, section, arch), filename))
+			}
+		}
+		publishedKeyringRevisions[config.RootRepoPath+"/"+distro] = revision
+	}
+	if len(changed) > 0 && !config.EnableDirectoryWatching {
+		rebuildRepoMetadata(config, db, changed...)
+	}
+	return nil
+}
+
+// placeKeyringPackage writes a keyring package and moves it into place like an uploaded one.
+func placeKeyringPackage(config conf, distro, section, arch, name string, deb []byte) ([]string, error) {
+	tmp, err := ioutil.TempFile(config.StagingPath(), "keyring-")
+	if err != nil {
+		return nil, fmt.Errorf("error creating temp file: %s", err)
+	}
+	defer os.Remove(tmp.Name())
+	// the package may go into the pool, which keeps the mode of the temp file
+	if err = tmp.Chmod(0644); err == nil {
+		_, err = tmp.Write(deb)
+	}
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return nil, fmt.Errorf("error writing %s: %s", name, err)
+	}
+	return placePackage(config, distro, section, arch, tmp.Name(), name, false)
+}
+
+// buildKeyringPackage builds the keyring package of a distro, which installs the repository keyring into
+// /usr/share/keyrings and the apt source of the distro into /etc/apt/sources.list.d.
+func buildKeyringPackage(config conf, keys openpgp.EntityList, distro, version, url string, now time.Time) ([]byte, error) {
+	var keyring bytes.Buffer
+	if err := writePublicKeys(&keyring, keys, false); err != nil {
+		return nil, err
+	}
+	files := []debFile{
+		{path: strings.TrimPrefix(config.KeyringPath(), "/"), data: keyring.Bytes()},
+		{path: "etc/apt/sources.list.d/" + keyringSourcesName(config), data: []byte(aptSourcesEntry(config, url, distro)), conffile: true},
+	}
+	// the package is maintained by whoever the first key belongs to
+	maintainer := "deb-simple"
+	var identities []string
+	for identity := range keys[0].Identities {
+		identities = append(identities, identity)
+	}
+	sort.Strings(identities)
+	if len(identities) > 0 {
+		userID := keys[0].Identities[identities[0]].UserId
+		maintainer = fmt.Sprintf("%s <%s>", userID.Name, userID.Email)
+	}
+	installedSize := 0
+	for _, file := range files {
+		installedSize += (len(file.data) + 1023) / 1024
+	}
+
+	control := formatControlFields([]controlField{
+		{"Package", config.ArchiveKeyringName()},
+		{"Version", version},
+		{"Architecture", "all"},
+		{"Maintainer", maintainer},
+		{"Installed-Size", strconv.Itoa(installedSize)},
+		{"Section", "misc"},
+		{"Priority", "optional"},
+		{"Description", "OpenPGP archive keyring of the " + url + " repository\n" +
+			" This package installs the keyring the Release files of the repository\n" +
+			" are signed with, along with the apt source of the " + distro + " distribution,\n" +
+			" and keeps them up to date when the signing keys change."},
+	})
+	return buildDeb(control, files, now)
+}
+
+// buildDeb builds a binary package holding files, with the control and md5sums files dpkg expects, and
+// a conffiles file listing the files marked as conffiles.
+func buildDeb(control string, files []debFile, now time.Time) ([]byte, error) {
+	var md5sums, conffiles strings.Builder
+	for _, file := range files {
+		sum := md5.Sum(file.data)
+		md5sums.WriteString(hex.EncodeToString(sum[:]) + "  " + file.path + "\n")
+		if file.conffile {
+			conffiles.WriteString("/" + file.path + "\n")
+		}
+	}
+	controlFiles := []debFile{{path: "control", data: []byte(control)}, {path: "md5sums", data: []byte(md5sums.String())}}
+	if conffiles.Len() > 0 {
+		controlFiles = append(controlFiles, debFile{path: "conffiles", data: []byte(conffiles.String())})
+	}
+	controlTar, err := tarGz(controlFiles, now)
+	if err != nil {
+		return nil, err
+	}
+	dataTar, err := tarGz(files, now)
+	if err != nil {
+		return nil, err
+	}
+
+	var deb bytes.Buffer
+	w := ar.NewWriter(&deb)
+	if err := w.WriteGlobalHeader(); err != nil {
+		return nil, err
+	}
+	for _, member := range []struct {
+		name string
+		data []byte
+	}{
+		{"debian-binary", []byte("2.0\n")},
+		{"control.tar.gz", controlTar},
+		{"data.tar.gz", dataTar},
+	} {
+		if err := w.WriteHeader(&ar.Header{Name: member.name, ModTime: now, Mode: 0100644, Size: int64(len(member.data))}); err != nil {
+			return nil, err
+		}
+		if _, err := w.Write(member.data); err != nil {
+			return nil, err
+		}
+	}
+	return deb.Bytes(), nil
+}
+
+// tarGz returns a gzipped tarball of files owned by root, with an entry for every directory leading to
+// them, as dpkg-deb builds them.
+func tarGz(files []debFile, now time.Time) ([]byte, error) {
+	var buf bytes.Buffer
+	gz := gzip.NewWriter(&buf)
+	tw := tar.NewWriter(gz)
+	header := func(name string, typeflag byte, mode int64, size int) error {
+		return tw.WriteHeader(&tar.Header{Name: name, Typeflag: typeflag, Mode: mode, Size: int64(size),
+			ModTime: now, Uname: "root", Gname: "root", Format: tar.FormatGNU})
+	}
+	if err := header("./", tar.TypeDir, 0755, 0); err != nil {
+		return nil, err
+	}
+	dirs := make(map[string]bool)
+	for _, file := range files {
+		var parents []string
+		for dir := path.Dir(file.path); dir != "." && !dirs[dir]; dir = path.Dir(dir) {
+			dirs[dir] = true
+			parents = append([]string{dir}, parents...)
+		}
+		for _, dir := range parents {
+			if err := header("./"+dir+"/", tar.TypeDir, 0755, 0); err != nil {
+				return nil, err
+			}
+		}
+		if err := header("./"+file.path, tar.TypeReg, 0644, len(file.data)); err != nil {
+			return nil, err
+		}
+		if _, err := tw.Write(file.data); err != nil {
+			return nil, err
+		}
+	}
+	if err := tw.Close(); err != nil {
+		return nil, err
+	}
+	if err := gz.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
@@ -0,0 +1,224 @@
+package main
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/blakesmith/ar"
+	"golang.org/x/crypto/openpgp"
+)
+
+// readDebData returns the regular files in the data.tar.gz of a package, keyed by path.
+func readDebData(t *testing.T, path string) map[string][]byte {
+	f, err := os.Open(path)
+	if err != nil {
+		t.Fatalf("error opening %s: %s", path, err)
+	}
+	defer f.Close()
+	r := ar.NewReader(f)
+	for {
+		header, err := r.Next()
+		if err != nil {
+			t.Fatalf("no data.tar.gz in %s: %s", path, err)
+		}
+		if header.Name != "data.tar.gz" {
+			continue
+		}
+		gz, err := gzip.NewReader(r)
+		if err != nil {
+			t.Fatalf("error reading data.tar.gz: %s", err)
+		}
+		files := make(map[string][]byte)
+		tr := tar.NewReader(gz)
+		for {
+			header, err := tr.Next()
+			if err == io.EOF {
+				return files
+			}
+			if err != nil {
+				t.Fatalf("error reading data.tar.gz: %s", err)
+			}
+			if header.Typeflag == tar.TypeReg {
+				files[header.Name], _ = ioutil.ReadAll(tr)
+			}
+		}
+	}
+}
+
+func TestPublishKeyringPackage(t *testing.T) {
+	defer func(now func() time.Time) { Now = now }(Now)
+	Now = func() time.Time {
+		return time.Date(2018, 9, 20, 14, 17, 21, 000000000, time.UTC)
+	}
+
+	pwd, err := os.Getwd()
+	if err != nil {
+		t.Errorf("Unable to get current working directory: %s", err)
+	}
+	config := conf{ListenPort: "9666", RootRepoPath: pwd + "/testing", SupportArch: []string{"all", "amd64"}, DistroNames: []string{"stable", "testing"},
+		Sections: []string{"main", "contrib"}, EnableSigning: true, PrivateKey: "samples/subkeys.key", PublishKeyringPackage: true}
+	if err := createDirs(config); err != nil {
+		t.Fatalf("createDirs() failed: %s", err)
+	}
+
+	// the apt source needs to know where the repository is
+	if err := publishKeyringPackage(config, nil); err == nil {
+		t.Errorf("publishKeyringPackage() should fail without a publicURL")
+	}
+	config.PublicURL = "https://apt.example.com/repo"
+	if err := config.validateKeyringPackage(); err != nil {
+		t.Errorf("validateKeyringPackage() failed: %s", err)
+	}
+
+	if err := publishKeyringPackage(config, nil); err != nil {
+		t.Fatalf("publishKeyringPackage() failed: %s", err)
+	}
+	// the version starts with the time the key was created
+	subkeys, err := repositoryPublicKeys(config)
+	if err != nil {
+		t.Fatalf("repositoryPublicKeys() failed: %s", err)
+	}
+	keyCreated := subkeys[0].PrimaryKey.CreationTime.UTC().Format("20060102.150405")
+	for _, distro := range config.DistroNames {
+		revision := keyringPackageRevision(subkeys, distro, "https://apt.example.com/repo/", config.Sections)
+		if !strings.HasPrefix(revision, distro+".48950176.") {
+			t.Errorf("keyring package revision %s should start with the distro and key ID", revision)
+		}
+		debPath := filepath.Join(config.ArchPath(distro, "main", "all"), "deb-simple-archive-keyring_"+keyCreated+"+"+revision+"_all.deb")
+		control, err := inspectPackage(debPath)
+		if err != nil {
+			t.Fatalf("keyring package was not published to %s: %s", distro, err)
+		}
+		fields := parseControl(control)
+		if fields["Package"] != "deb-simple-archive-keyring" || fields["Architecture"] != "all" || fields["Maintainer"] != "deb-simple Subkeys <subkeys@go.go>" {
+			t.Errorf("unexpected keyring package control:\n%s", control)
+		}
+
+		files := readDebData(t, debPath)
+		keys, err := openpgp.ReadKeyRing(bytes.NewReader(files["./usr/share/keyrings/deb-simple-archive-keyring.gpg"]))
+		if err != nil || len(keys) != 1 || keyFingerprint(keys[0]) != "C75E922E23F9CEB9653D3325B431A69C48950176" || keys[0].PrivateKey != nil {
+			t.Errorf("keyring package does not install the public key: %v", err)
+		}
+		sources := "Types: deb\nURIs: https://apt.example.com/repo/\nSuites: " + distro + "\nComponents: main contrib\nSigned-By: /usr/share/keyrings/deb-simple-archive-keyring.gpg\n"
+		if got := string(files["./etc/apt/sources.list.d/deb-simple.sources"]); got != sources {
+			t.Errorf("keyring package installs the apt source:\n%s\nshould be:\n%s", got, sources)
+		}
+		if debs, _ := filepath.Glob(config.ArchPath(distro, "main", "amd64") + "/*.deb"); len(debs) > 0 {
+			t.Errorf("keyring package should only be published to binary-all")
+		}
+	}
+	packages, _ := ioutil.ReadFile(config.RootRepoPath + "/dists/stable/main/binary-all/Packages")
+	if !strings.Contains(string(packages), "Package: deb-simple-archive-keyring\n") {
+		t.Errorf("keyring package is not listed in Packages:\n%s", packages)
+	}
+	published := func() string {
+		debs, _ := filepath.Glob(config.ArchPath("stable", "main", "all") + "/*.deb")
+		if len(debs) != 1 {
+			t.Fatalf("exactly one keyring package should be published, found %v", debs)
+		}
+		control, err := inspectPackage(debs[0])
+		if err != nil {
+			t.Fatalf("error reading keyring package: %s", err)
+		}
+		return parseControl(control)["Version"]
+	}
+	firstVersion := published()
+
+	// nothing changes as long as the keys, URL and sections stay the same
+	Now = func() time.Time {
+		return time.Date(2018, 10, 1, 0, 0, 0, 0, time.UTC)
+	}
+	if err := publishKeyringPackage(config, nil); err != nil {
+		t.Fatalf("publishKeyringPackage() failed: %s", err)
+	}
+	if version := published(); version != firstVersion {
+		t.Errorf("keyring package was published again as %s without a change", version)
+	}
+
+	// adding a key replaces the package by a newer version, starting when the new key may be used
+	opts := keyOptions{name: "deb-simple New", email: "new@go.go", bits: 2048, publicKey: config.RootRepoPath + "/new.pub",
+		privateKey: config.RootRepoPath + "/new.key", keyring: config.RootRepoPath + "/new.gpg", revocation: config.RootRepoPath + "/new.rev"}
+	entity, err := createSigningKey(opts)
+	if err != nil {
+		t.Fatalf("createSigningKey() failed: %s", err)
+	}
+	config.SigningKeys = []signingKeyConf{{Path: "samples/subkeys.key"}, {Path: opts.privateKey, NotBefore: "2026-11-01"}}
+	config.PrivateKey = ""
+	if err := publishKeyringPackage(config, nil); err != nil {
+		t.Fatalf("publishKeyringPackage() failed: %s", err)
+	}
+	ids := []string{"48950176", keyFingerprint(entity)[32:]}
+	sort.Strings(ids)
+	secondVersion := published()
+	if !strings.HasPrefix(secondVersion, "20261101.000000+stable."+strings.Join(ids, ".")+".") {
+		t.Errorf("keyring package was not replaced after a key change, version is %s", secondVersion)
+	}
+	debs, _ := filepath.Glob(config.ArchPath("stable", "main", "all") + "/*.deb")
+	keys, err := openpgp.ReadKeyRing(bytes.NewReader(readDebData(t, debs[0])["./usr/share/keyrings/deb-simple-archive-keyring.gpg"]))
+	if err != nil || len(keys) != 2 {
+		t.Errorf("keyring package should install both keys: %v", err)
+	}
+	if compareVersions(secondVersion, firstVersion) <= 0 {
+		t.Errorf("new keyring package version %s does not upgrade %s", secondVersion, firstVersion)
+	}
+
+	// so does moving the repository, although the keys stay the same
+	config.PublicURL = "https://apt.example.org/"
+	if err := publishKeyringPackage(config, nil); err != nil {
+		t.Fatalf("publishKeyringPackage() failed: %s", err)
+	}
+	thirdVersion := published()
+	if !strings.HasPrefix(thirdVersion, "20261101.000000.1+") || compareVersions(thirdVersion, secondVersion) <= 0 {
+		t.Errorf("keyring package version %s does not upgrade %s after the URL changed", thirdVersion, secondVersion)
+	}
+	debs, _ = filepath.Glob(config.ArchPath("stable", "main", "all") + "/*.deb")
+	if sources := string(readDebData(t, debs[0])["./etc/apt/sources.list.d/deb-simple.sources"]); !strings.Contains(sources, "URIs: https://apt.example.org/\n") {
+		t.Errorf("keyring package should install the new apt source:\n%s", sources)
+	}
+	// and changing the sections
+	config.Sections = []string{"main"}
+	if err := publishKeyringPackage(config, nil); err != nil {
+		t.Fatalf("publishKeyringPackage() failed: %s", err)
+	}
+	fourthVersion := published()
+	if !strings.HasPrefix(fourthVersion, "20261101.000000.2+") {
+		t.Errorf("keyring package version %s does not upgrade %s after the sections changed", fourthVersion, thirdVersion)
+	}
+
+	// a key file replaced while deb-simple runs is picked up by the periodic refresh
+	if err := refreshKeyringPackage(config, nil); err != nil {
+		t.Fatalf("refreshKeyringPackage() failed: %s", err)
+	}
+	if version := published(); version != fourthVersion {
+		t.Errorf("keyring package was published again as %s without a change", version)
+	}
+	subkeysKey, _ := ioutil.ReadFile("samples/subkeys.key")
+	if err := ioutil.WriteFile(opts.privateKey, subkeysKey, 0600); err != nil {
+		t.Fatalf("error replacing %s: %s", opts.privateKey, err)
+	}
+	if err := refreshKeyringPackage(config, nil); err != nil {
+		t.Fatalf("refreshKeyringPackage() failed: %s", err)
+	}
+	if version := published(); !strings.HasPrefix(version, "20261101.000000.3+stable.48950176.") {
+		t.Errorf("keyring package version %s does not upgrade %s after a key file was replaced", version, fourthVersion)
+	}
+
+	// the package goes into the first section, so there has to be one
+	config.Sections = nil
+	if err := publishKeyringPackage(config, nil); err == nil {
+		t.Errorf("publishKeyringPackage() should fail without sections")
+	}
+
+	if err := os.RemoveAll(config.RootRepoPath); err != nil {
+		t.Errorf("error cleaning up after publishKeyringPackage(): %s", err)
+	}
+}
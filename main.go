@@ -33,12 +33,114 @@ type conf struct {
 	EnableSigning           bool     `json:"enableSigning"`
 	PrivateKey              string   `json:"privateKey"`
 	EnableDirectoryWatching bool     `json:"enableDirectoryWatching"`
+	EnablePackageCache      bool     `json:"enablePackageCache"`
+	IndexCompression        []string `json:"indexCompression"`
+	EnableContents          bool     `json:"enableContents"`
+	UsePool                 bool     `json:"usePool"`
+	MergeArchAll            bool     `json:"mergeArchAll"`
+	NoSupportForArchAll     bool     `json:"noSupportForArchAll"`
+	ByHashRetention         int      `json:"byHashRetention"`
+	// Releases holds the Release file metadata of each distro, keyed by distro name
+	Releases  map[string]releaseConf `json:"releases"`
+	Retention []retentionPolicy      `json:"retention"`
+	// RetentionInterval is how often the retention policy is applied to the whole repo, such as "1h"
+	RetentionInterval string `json:"retentionInterval"`
+	// RequireSignedUploads rejects uploads that aren't signed by a key in UploaderKeyring
+	RequireSignedUploads bool   `json:"requireSignedUploads"`
+	UploaderKeyring      string `json:"uploaderKeyring"`
+	// Uploaders limits the distros a key may upload to, keyed by key fingerprint. Keys that aren't
+	// listed may upload to any distro.
+	Uploaders map[string][]string `json:"uploaders"`
+	// VerifyPackageSignatures rejects packages without a dpkg-sig or debsigs signature by a key in PackageKeyring
+	VerifyPackageSignatures bool   `json:"verifyPackageSignatures"`
+	PackageKeyring          string `json:"packageKeyring"`
+	// BasePackages lists Packages files of the distro the repo builds on, such as a local mirror of
+	// Debian's, which dependencies can be satisfied from too
+	BasePackages []string `json:"basePackages"`
+	// Hashes lists the checksums given for each file in index files, out of md5, sha1, sha256 and sha512
+	Hashes []string `json:"hashes"`
+	// SigningKeys lists the keys Release files are signed with, instead of PrivateKey, each optionally
+	// limited to a period of time so keys can be rotated
+	SigningKeys []signingKeyConf `json:"signingKeys"`
+	// PrivateKeyPassphrase is where the passphrase of PrivateKey is read from, if it is encrypted
+	PrivateKeyPassphrase passphraseConf `json:"privateKeyPassphrase"`
+	// PrivateKeyFingerprint selects the key in PrivateKey to sign with, a primary key or a signing subkey
+	PrivateKeyFingerprint string `json:"privateKeyFingerprint"`
+	// ExternalSigner signs Release files by running commands, instead of with PrivateKey or SigningKeys
+	ExternalSigner *externalSignerConf `json:"externalSigner"`
+	// KeyringName is the name clients install the repository keyring under in /usr/share/keyrings
+	KeyringName string `json:"keyringName"`
+	// PublicURL is the URL clients reach the repository at, used in the apt sources that are served
+	PublicURL string `json:"publicURL"`
+	// StagingDir is where uploads are staged until they have been checked, next to rootRepoPath by default
+	StagingDir string `json:"stagingDir"`
+	// IncomingMaxAge is how long files PUT without the .changes listing them are kept, such as "24h"
+	IncomingMaxAge string `json:"incomingMaxAge"`
+	// PublishKeyringPackage publishes a package installing the repository keyring and apt source
+	PublishKeyringPackage bool `json:"publishKeyringPackage"`
 }
 
 func (c conf) ArchPath(distro, section, arch string) string {
 	return filepath.Join(c.RootRepoPath, "dists", distro, section, "binary-"+arch)
 }
 
+// SourcePath returns the directory holding the source packages of a distro and section.
+func (c conf) SourcePath(distro, section string) string {
+	return filepath.Join(c.RootRepoPath, "dists", distro, section, "source")
+}
+
+// IncomingPath returns the directory files uploaded one at a time with PUT are kept in until the
+// .changes listing them arrives. It is part of the staging area, as they haven't been checked yet.
+func (c conf) IncomingPath() string {
+	return filepath.Join(c.StagingPath(), "incoming")
+}
+
+// IncomingExpiry returns how long files are kept in the incoming directory without their .changes,
+// a day unless incomingMaxAge is configured.
+func (c conf) IncomingExpiry() (time.Duration, error) {
+	if c.IncomingMaxAge == "" {
+		return 24 * time.Hour, nil
+	}
+	maxAge, err := time.ParseDuration(c.IncomingMaxAge)
+	if err != nil {
+		return 0, fmt.Errorf("invalid incomingMaxAge: %s", err)
+	}
+	return maxAge, nil
+}
+
+// StagingPath returns the directory uploads are staged in until they have been checked. It is outside of
+// RootRepoPath so unchecked files are never served, but should be on the same file system, as files are
+// moved into the repository from there.
+func (c conf) StagingPath() string {
+	if c.StagingDir != "" {
+		return c.StagingDir
+	}
+	return filepath.Clean(c.RootRepoPath) + ".staging"
+}
+
+// PoolPath returns the directory packages are stored in when the pool layout is enabled.
+func (c conf) PoolPath() string {
+	return filepath.Join(c.RootRepoPath, "pool")
+}
+
+// IndexCompressions returns the compressions index files are written with, defaulting to
+// the uncompressed file plus gzip.
+func (c conf) IndexCompressions() []string {
+	if len(c.IndexCompression) == 0 {
+		return []string{"none", "gz"}
+	}
+	return c.IndexCompression
+}
+
+// ByHashGenerations returns how many superseded generations of by-hash index files are kept,
+// defaulting to 3.
+func (c conf) ByHashGenerations() int {
+	if c.ByHashRetention <= 0 {
+		return 3
+	}
+	return c.ByHashRetention
+}
+
 var (
 	mutex              sync.Mutex
 	configFile         = flag.String("c", "conf.json", "config file location")
@@ -47,6 +149,9 @@ var (
 	keyName            = flag.String("kn", "", "Name for the siging key")
 	keyEmail           = flag.String("ke", "", "Email address")
 	verbose            = flag.Bool("v", false, "Print verbose logs")
+	rebuildMetadata    = flag.Bool("r", false, "Discard the package cache and rebuild all repository metadata on startup")
+	checkDeps          = flag.Bool("d", false, "Report unsatisfiable dependencies and exit")
+	basePackages       = flag.String("base", "", "Packages file to also resolve dependencies against, in addition to basePackages")
 	parsedconfig       = conf{}
 	mywatcher          *fsnotify.Watcher
 
@@ -57,6 +162,14 @@ var (
 )
 
 func main() {
+	// generate a signing key and exit, without needing a config file
+	if len(os.Args) > 1 && os.Args[1] == "keygen" {
+		if err := keygenCommand(os.Args[2:]); err != nil {
+			log.Fatal("unable to generate signing key: ", err)
+		}
+		os.Exit(0)
+	}
+
 	flag.Parse()
 	file, err := ioutil.ReadFile(*configFile)
 	if err != nil {
@@ -65,11 +178,20 @@ func main() {
 	if err := json.Unmarshal(file, &parsedconfig); err != nil {
 		log.Fatal("unable to marshal config file, exiting...")
 	}
+	if err := parsedconfig.validateHashes(); err != nil {
+		log.Fatal("invalid hashes in config file: ", err)
+	}
+	if err := parsedconfig.validateSigningKeys(); err != nil {
+		log.Fatal("invalid signing keys in config file: ", err)
+	}
+	if err := parsedconfig.validateKeyringPackage(); err != nil {
+		log.Fatal("invalid keyring package settings in config file: ", err)
+	}
 
 	var db *bolt.DB
 	defer db.Close()
 
-	if parsedconfig.EnableAPIKeys || *generateKey {
+	if parsedconfig.EnableAPIKeys || parsedconfig.EnablePackageCache || *generateKey {
 		db = openDB()
 		// create DB bucket if needed
 		err = db.Update(func(tx *bolt.Tx) error {
@@ -109,6 +231,30 @@ func main() {
 		os.Exit(0)
 	}
 
+	if parsedconfig.EnableSigning && parsedconfig.ExternalSigner == nil {
+		if err := loadSigningKeys(parsedconfig); err != nil {
+			log.Fatal("unable to load signing keys: ", err)
+		}
+	}
+
+	// report unsatisfiable dependencies and exit
+	if *checkDeps {
+		if *basePackages != "" {
+			parsedconfig.BasePackages = append(parsedconfig.BasePackages, *basePackages)
+		}
+		report, err := checkDependencies(parsedconfig, db, nil, nil)
+		if err != nil {
+			log.Fatal("unable to check dependencies: ", err)
+		}
+		for _, unsatisfied := range report {
+			fmt.Println(unsatisfied)
+		}
+		if len(report) > 0 {
+			os.Exit(1)
+		}
+		os.Exit(0)
+	}
+
 	if parsedconfig.EnableDirectoryWatching {
 
 		// fire up filesystem watcher
@@ -121,13 +267,15 @@ func main() {
 			for {
 				select {
 				case event := <-mywatcher.Events:
-					if (event.Op&fsnotify.Write == fsnotify.Write) || (event.Op&fsnotify.Remove == fsnotify.Remove) {
+					// uploads are moved into place once they are complete, so creation counts too
+					isDsc := filepath.Ext(event.Name) == ".dsc"
+					if (event.Op&fsnotify.Write == fsnotify.Write) || (event.Op&fsnotify.Remove == fsnotify.Remove) || (event.Op&fsnotify.Create == fsnotify.Create) {
 						mutex.Lock()
-						if filepath.Ext(event.Name) == ".deb" {
+						if filepath.Ext(event.Name) == ".deb" || isDsc {
 							if *verbose {
 								log.Println("Event: ", event)
 							}
-							rebuildRepoMetadata(event.Name)
+							rebuildRepoMetadata(parsedconfig, db, event.Name)
 						}
 						mutex.Unlock()
 					}
@@ -143,9 +291,87 @@ func main() {
 		log.Fatalf("error creating directory structure, exiting")
 	}
 
+	if *rebuildMetadata {
+		log.Println("Rebuilding all repository metadata")
+		if db != nil {
+			if err := clearPackageCache(db); err != nil {
+				log.Fatal("unable to clear package cache: ", err)
+			}
+		}
+		mutex.Lock()
+		rebuildAllMetadata(parsedconfig, db)
+		mutex.Unlock()
+	}
+
+	if parsedconfig.EnableSigning && parsedconfig.PublishKeyringPackage {
+		mutex.Lock()
+		if err := publishKeyringPackage(parsedconfig, db); err != nil {
+			log.Println("error publishing keyring package: ", err)
+		}
+		mutex.Unlock()
+		// a replaced key file takes effect without a restart, and so does its keyring package
+		go func() {
+			for range time.Tick(keyringRefreshInterval) {
+				mutex.Lock()
+				if err := refreshKeyringPackage(parsedconfig, db); err != nil {
+					log.Println("error publishing keyring package: ", err)
+				}
+				mutex.Unlock()
+			}
+		}()
+	}
+
+	if parsedconfig.RetentionInterval != "" {
+		interval, err := time.ParseDuration(parsedconfig.RetentionInterval)
+		if err != nil {
+			log.Fatal("invalid retentionInterval: ", err)
+		}
+		go func() {
+			for range time.Tick(interval) {
+				mutex.Lock()
+				sweepRetention(parsedconfig, db)
+				mutex.Unlock()
+			}
+		}()
+	}
+
+	// files PUT without a .changes would stay in the incoming directory forever
+	incomingMaxAge, err := parsedconfig.IncomingExpiry()
+	if err != nil {
+		log.Fatal(err)
+	}
+	sweepInterval := time.Hour
+	if incomingMaxAge < sweepInterval {
+		sweepInterval = incomingMaxAge
+	}
+	go func() {
+		for range time.Tick(sweepInterval) {
+			mutex.Lock()
+			expireIncoming(parsedconfig, incomingMaxAge)
+			mutex.Unlock()
+		}
+	}()
+
+	// Release files with a Valid-Until are signed again before they expire, uploads or not
+	if interval := releaseRefreshInterval(parsedconfig); parsedconfig.EnableSigning && interval > 0 {
+		go func() {
+			for {
+				mutex.Lock()
+				refreshReleases(parsedconfig)
+				mutex.Unlock()
+				time.Sleep(interval)
+			}
+		}()
+	}
+
 	http.Handle("/", http.StripPrefix("/", http.FileServer(http.Dir(parsedconfig.RootRepoPath))))
 	http.Handle("/upload", uploadHandler(parsedconfig, db))
 	http.Handle("/delete", deleteHandler(parsedconfig, db))
+	http.Handle("/changes", changesHandler(parsedconfig, db))
+	http.Handle("/changes/", changesHandler(parsedconfig, db))
+	http.Handle("/dependencies", dependenciesHandler(parsedconfig, db))
+	http.Handle("/keys/", publicKeyHandler(parsedconfig))
+	http.Handle("/apt/", aptSourceHandler(parsedconfig))
 
 	if parsedconfig.EnableSigning {
 		log.Println("Release signing is enabled")
@@ -160,35 +386,130 @@ func main() {
 	}
 }
 
-func rebuildRepoMetadata(filePath string) {
-	distroArch := destructPath(filePath)
-	if err := createPackagesGz(parsedconfig, distroArch[0], distroArch[1], distroArch[2]); err != nil {
-		log.Printf("error creating Packages file: %s", err)
+// rebuildRepoMetadata regenerates the metadata affected by changes to filePaths, and publishes it all at
+// once. If anything fails nothing is published, and clients keep seeing the previous metadata.
+func rebuildRepoMetadata(config conf, db *bolt.DB, filePaths ...string) {
+	err := publish(func(pub *publication) error {
+		var distros []string
+		seenDistros := make(map[string]bool)
+		rebuilt := make(map[string]bool)
+		for _, filePath := range filePaths {
+			distroArch := destructPath(filePath)
+			if rebuilt[strings.Join(distroArch, "/")] {
+				continue
+			}
+			rebuilt[strings.Join(distroArch, "/")] = true
+			if !seenDistros[distroArch[0]] {
+				seenDistros[distroArch[0]] = true
+				distros = append(distros, distroArch[0])
+			}
+			if distroArch[2] == "source" {
+				if err := stageSources(pub, config, distroArch[0], distroArch[1]); err != nil {
+					return fmt.Errorf("error creating Sources file: %s", err)
+				}
+			} else if err := stagePackages(pub, config, db, distroArch[0], distroArch[1], distroArch[2]); err != nil {
+				return fmt.Errorf("error creating Packages file: %s", err)
+			}
+			// packages in binary-all are also listed in every other arch when they are merged
+			if distroArch[2] == "all" && config.MergeArchAll {
+				for _, arch := range config.SupportArch {
+					if arch == "all" {
+						continue
+					}
+					if err := stagePackages(pub, config, db, distroArch[0], distroArch[1], arch); err != nil {
+						return fmt.Errorf("error creating Packages file: %s", err)
+					}
+				}
+			}
+		}
+		for _, distro := range distros {
+			if err := stageDistroMetadata(pub, config, distro); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		log.Printf("%s, nothing has been published", err)
 	}
-	if parsedconfig.EnableSigning {
-		if err := createRelease(parsedconfig, distroArch[0]); err != nil {
-			log.Printf("Error creating Release file: %s", err)
+}
+
+// stageDistroMetadata stages the files that cover a whole distro, the top-level Contents files
+// and the Release file, once its Packages and Sources files have been staged.
+func stageDistroMetadata(pub *publication, config conf, distro string) error {
+	if config.EnableContents {
+		if err := stageContents(pub, config, distro); err != nil {
+			return fmt.Errorf("error creating Contents file: %s", err)
+		}
+	}
+	if config.EnableSigning {
+		if err := stageRelease(pub, config, distro); err != nil {
+			return fmt.Errorf("Error creating Release file: %s", err)
+		}
+	}
+	return nil
+}
+
+// rebuildAllMetadata regenerates the Packages (and Contents) files of every configured distro, section
+// and arch, and the Sources file of every section, followed by the Release file of each distro.
+// Each distro is published as a whole once all of its files have been generated.
+func rebuildAllMetadata(config conf, db *bolt.DB) {
+	for _, distro := range config.DistroNames {
+		err := publish(func(pub *publication) error {
+			for _, section := range config.Sections {
+				for _, arch := range config.SupportArch {
+					if err := stagePackages(pub, config, db, distro, section, arch); err != nil {
+						return fmt.Errorf("error creating Packages file: %s", err)
+					}
+				}
+				if err := stageSources(pub, config, distro, section); err != nil {
+					return fmt.Errorf("error creating Sources file: %s", err)
+				}
+			}
+			return stageDistroMetadata(pub, config, distro)
+		})
+		if err != nil {
+			log.Printf("%s, nothing has been published for %s", err, distro)
 		}
 	}
 }
 
+// destructPath splits the path of a file in the repo into its distro, section and arch.
+// Files in a source directory get "source" as their arch.
 func destructPath(filePath string) []string {
 	splitPath := strings.Split(filePath, "/")
 	archFull := splitPath[len(splitPath)-2]
-	archSplit := strings.Split(archFull, "-")
 	distro := splitPath[len(splitPath)-4]
 	section := splitPath[len(splitPath)-3]
+	if archFull == "source" {
+		return []string{distro, section, "source"}
+	}
+	archSplit := strings.SplitN(archFull, "-", 2)
 	return []string{distro, section, archSplit[1]}
 }
 
 func createDirs(config conf) error {
+	if err := os.MkdirAll(config.IncomingPath(), 0700); err != nil {
+		return fmt.Errorf("error creating incoming directory: %s", err)
+	}
+	if config.UsePool {
+		if err := os.MkdirAll(config.PoolPath(), 0755); err != nil {
+			return fmt.Errorf("error creating pool directory: %s", err)
+		}
+	}
+	// source packages get a directory of their own next to the binary ones
+	dirArchs := append(append([]string{}, config.SupportArch...), "source")
 	for _, distro := range config.DistroNames {
-		for _, arch := range config.SupportArch {
+		for _, arch := range dirArchs {
 			for _, section := range config.Sections {
-				if _, err := os.Stat(config.ArchPath(distro, section, arch)); err != nil {
+				dir := config.ArchPath(distro, section, arch)
+				if arch == "source" {
+					dir = config.SourcePath(distro, section)
+				}
+				if _, err := os.Stat(dir); err != nil {
 					if os.IsNotExist(err) {
 						log.Printf("Directory for %s (%s) does not exist, creating", distro, arch)
-						if err := os.MkdirAll(config.ArchPath(distro, section, arch), 0755); err != nil {
+						if err := os.MkdirAll(dir, 0755); err != nil {
 							return fmt.Errorf("error creating directory for %s (%s): %s", distro, arch, err)
 						}
 					} else {
@@ -196,8 +517,8 @@ func createDirs(config conf) error {
 					}
 				}
 				if parsedconfig.EnableDirectoryWatching {
-					log.Println("starting watcher for ", config.ArchPath(distro, section, arch))
-					err := mywatcher.Add(config.ArchPath(distro, section, arch))
+					log.Println("starting watcher for ", dir)
+					err := mywatcher.Add(dir)
 					if err != nil {
 						return fmt.Errorf("error creating watcher for %s (%s): %s", distro, arch, err)
 					}
@@ -208,8 +529,27 @@ func createDirs(config conf) error {
 	return nil
 }
 
+// contains reports whether list holds s.
+func contains(list []string, s string) bool {
+	for _, item := range list {
+		if item == s {
+			return true
+		}
+	}
+	return false
+}
+
+// createStagingDir creates a directory only deb-simple can read in the staging area, for an upload to be
+// checked in before it is moved into the repository.
+func createStagingDir(config conf) (string, error) {
+	if err := os.MkdirAll(config.StagingPath(), 0700); err != nil {
+		return "", err
+	}
+	return ioutil.TempDir(config.StagingPath(), "upload-")
+}
+
 func openDB() *bolt.DB {
-	// open/create database for API keys
+	// open/create database for API keys and the package cache
 	db, err := bolt.Open("debsimple.db", 0600, &bolt.Options{Timeout: 1 * time.Second})
 	if err != nil {
 		log.Fatal("unable to open database: ", err)
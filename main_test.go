@@ -8,6 +8,14 @@ import (
 	"github.com/boltdb/bolt"
 )
 
+func TestMain(m *testing.M) {
+	code := m.Run()
+	// uploads are staged next to the repositories the tests create
+	os.RemoveAll("testing.staging")
+	os.RemoveAll("tempFile.staging")
+	os.Exit(code)
+}
+
 func TestCreateDirs(t *testing.T) {
 	pwd, err := os.Getwd()
 	if err != nil {
@@ -4,10 +4,6 @@ import (
 	"archive/tar"
 	"bytes"
 	"compress/gzip"
-	"crypto/md5"
-	"crypto/sha1"
-	"crypto/sha256"
-	"encoding/hex"
 	"fmt"
 	"io"
 	"io/ioutil"
@@ -15,10 +11,12 @@ import (
 	"os"
 	"path/filepath"
 	"strings"
-	"errors"
 
 	"github.com/blakesmith/ar"
-	lzma "github.com/xi2/xz"
+	"github.com/boltdb/bolt"
+	"github.com/klauspost/compress/zstd"
+	"github.com/ulikunitz/xz"
+	"golang.org/x/crypto/openpgp"
 )
 
 type Compression int
@@ -26,8 +24,62 @@ type Compression int
 const (
 	LZMA Compression = iota
 	GZIP
+	ZSTD
+	NONE
 )
 
+// compressionFromName works out the compression of a tar member of a deb, such as control.tar.zst
+// or data.tar.xz, from its file extension.
+func compressionFromName(name string) (Compression, error) {
+	switch filepath.Ext(strings.TrimRight(name, "/")) {
+	case ".gz":
+		return GZIP, nil
+	case ".xz":
+		return LZMA, nil
+	case ".zst":
+		return ZSTD, nil
+	case ".tar":
+		return NONE, nil
+	}
+	return NONE, fmt.Errorf("unsupported compression for %s", name)
+}
+
+// decompressReader wraps r in a reader that undoes the given compression.
+// The caller must close the returned reader once done with it.
+func decompressReader(compression Compression, r io.Reader) (io.ReadCloser, error) {
+	switch compression {
+	case GZIP:
+		return gzip.NewReader(r)
+	case LZMA:
+		compFile, err := xz.NewReader(r)
+		if err != nil {
+			return nil, err
+		}
+		return ioutil.NopCloser(compFile), nil
+	case ZSTD:
+		compFile, err := zstd.NewReader(r, zstd.WithDecoderConcurrency(1))
+		if err != nil {
+			return nil, err
+		}
+		return compFile.IOReadCloser(), nil
+	case NONE:
+		return ioutil.NopCloser(r), nil
+	}
+	return nil, fmt.Errorf("unknown compression %d", compression)
+}
+
+func (c Compression) String() string {
+	switch c {
+	case GZIP:
+		return "GZIP"
+	case LZMA:
+		return "LZMA"
+	case ZSTD:
+		return "ZSTD"
+	}
+	return "uncompressed"
+}
+
 func inspectPackage(filename string) (string, error) {
 	f, err := os.Open(filename)
 	if err != nil {
@@ -53,16 +105,11 @@ func inspectPackage(filename string) (string, error) {
 			return "", fmt.Errorf("error in inspectPackage loop: %s", err)
 		}
 
-		if strings.Contains(header.Name, "control.tar") {
-			var compression Compression
-			if strings.TrimRight(header.Name, "/") == "control.tar.gz" {
-				compression = GZIP
-			} else if strings.TrimRight(header.Name, "/") == "control.tar.xz" {
-				compression = LZMA
-			} else {
+		if strings.HasPrefix(header.Name, "control.tar") {
+			compression, err := compressionFromName(header.Name)
+			if err != nil {
 				log.Println("\t No control file found")
-				err := errors.New("No control file found")
-				return "", err
+				return "", fmt.Errorf("No control file found: %s", err)
 			}
 
 			io.Copy(&controlBuf, arReader)
@@ -77,30 +124,14 @@ func inspectPackage(filename string) (string, error) {
 }
 
 func inspectPackageControl(compression Compression, filename bytes.Buffer) (string, error) {
-	var tarReader *tar.Reader
-	var err error
-
-	switch compression {
-	case GZIP:
-		var compFile *gzip.Reader
-		compFile, err = gzip.NewReader(bytes.NewReader(filename.Bytes()))
-		tarReader = tar.NewReader(compFile)
-		if *verbose {
-			log.Println("\t GZIP Control file found")
-		}
-		break
-	case LZMA:
-		var compFile *lzma.Reader
-		compFile, err = lzma.NewReader(bytes.NewReader(filename.Bytes()), lzma.DefaultDictMax)
-		tarReader = tar.NewReader(compFile)
-		if *verbose {
-			log.Println("\t LZMA Control file found")
-		}
-		break
-	}
-
+	compFile, err := decompressReader(compression, bytes.NewReader(filename.Bytes()))
 	if err != nil {
-		return "", fmt.Errorf("error creating gzip/lzma reader: %s", err)
+		return "", fmt.Errorf("error creating %s reader: %s", compression, err)
+	}
+	defer compFile.Close()
+	tarReader := tar.NewReader(compFile)
+	if *verbose {
+		log.Printf("\t %s Control file found", compression)
 	}
 
 	var controlBuf bytes.Buffer
@@ -136,71 +167,153 @@ func inspectPackageControl(compression Compression, filename bytes.Buffer) (stri
 	return "", nil
 }
 
-func createPackagesGz(config conf, distro, section, arch string) error {
+// inspectPackageEntry inspects and hashes the package at debPath, producing a fresh cache entry for it.
+// The list of files in the package is only gathered when Contents indexes are enabled, as it means
+// decompressing the whole data archive. Its signature is only checked when a keyring is given.
+func inspectPackageEntry(config conf, debPath string, info os.FileInfo, keyring openpgp.EntityList) (packageCacheEntry, error) {
+	entry := newPackageCacheEntry(info)
 
-	if *verbose {
-		log.Printf("Rebuilding Packages.gz file for %s %s %s", distro, section, arch)
+	control, err := inspectPackage(debPath)
+	if err != nil {
+		return entry, err
 	}
+	entry.Control = control
 
-	packageFile, err := os.Create(filepath.Join(config.ArchPath(distro, section, arch), "Packages"))
-	if err != nil {
-		return fmt.Errorf("failed to create Packages: %s", err)
+	if config.EnableContents {
+		if entry.Contents, err = inspectPackageContents(debPath); err != nil {
+			return entry, err
+		}
 	}
-	packageGzFile, err := os.Create(filepath.Join(config.ArchPath(distro, section, arch), "Packages.gz"))
+
+	hashes, err := hashFile(debPath, config.Checksums()...)
 	if err != nil {
-		return fmt.Errorf("failed to create packages.gz: %s", err)
+		return entry, fmt.Errorf("Error hashing file for Packages file: %s", err)
 	}
-	defer packageFile.Close()
-	defer packageGzFile.Close()
-	gzOut := gzip.NewWriter(packageGzFile)
-	defer gzOut.Close()
+	entry.MD5 = hashes.MD5
+	entry.SHA1 = hashes.SHA1
+	entry.SHA256 = hashes.SHA256
+	entry.SHA512 = hashes.SHA512
 
-	writer := io.MultiWriter(packageFile, gzOut)
+	if keyring != nil {
+		// a package without a valid signature is still listed, just without a signer
+		entry.Signer, _ = verifyPackageSignature(keyring, debPath)
+		entry.SignatureChecked = true
+	}
+
+	return entry, nil
+}
 
-	// loop through each directory
-	// run inspectPackage
-	dirList, err := ioutil.ReadDir(config.ArchPath(distro, section, arch))
+// createPackagesGz rebuilds and publishes the Packages file of a single arch directory.
+func createPackagesGz(config conf, db *bolt.DB, distro, section, arch string) error {
+	return publish(func(pub *publication) error {
+		return stagePackages(pub, config, db, distro, section, arch)
+	})
+}
+
+// stagePackages rebuilds the Packages file, in every configured compression, for a single arch directory.
+// When the package cache is enabled only new or changed .deb files are inspected, everything
+// else is served from the cache, and entries for packages that have gone away are dropped.
+// With mergeArchAll set, the packages in binary-all are listed in the Packages file of every other arch too.
+func stagePackages(pub *publication, config conf, db *bolt.DB, distro, section, arch string) error {
+
+	if *verbose {
+		log.Printf("Rebuilding Packages.gz file for %s %s %s", distro, section, arch)
+	}
+
+	writer, err := createIndexFiles(pub, config, filepath.Join(config.ArchPath(distro, section, arch), "Packages"))
 	if err != nil {
-		return fmt.Errorf("scanning: %s: %s", config.ArchPath(distro, section, arch), err)
+		return err
 	}
-	for i, debFile := range dirList {
-		if strings.HasSuffix(debFile.Name(), "deb") {
-			var packBuf bytes.Buffer
-			debPath := filepath.Join(config.ArchPath(distro, section, arch), debFile.Name())
-			tempCtlData, err := inspectPackage(debPath)
-			if err != nil {
+	defer writer.Close()
+
+	dirArchs := []string{arch}
+	if config.MergeArchAll && arch != "all" {
+		if _, err := os.Stat(config.ArchPath(distro, section, "all")); err == nil {
+			dirArchs = append(dirArchs, "all")
+		}
+	}
+
+	var keyring openpgp.EntityList
+	if config.VerifyPackageSignatures {
+		if keyring, err = loadKeyring(config.PackageKeyring); err != nil {
+			return err
+		}
+	}
+
+	useCache := config.EnablePackageCache && db != nil
+	entries := make(map[string]packageCacheEntry)
+	for _, dirArch := range dirArchs {
+		archPath := config.ArchPath(distro, section, dirArch)
+		cachePrefix := packageCacheKey(config, archPath) + "/"
+		cached := map[string]packageCacheEntry{}
+		if useCache {
+			if cached, err = readPackageCache(db, cachePrefix); err != nil {
 				return err
 			}
-			packBuf.WriteString(tempCtlData)
-			dir := filepath.ToSlash(filepath.Join("dists", distro, section, "binary-"+arch, debFile.Name()))
-			fmt.Fprintf(&packBuf, "Filename: %s\n", dir)
-			fmt.Fprintf(&packBuf, "Size: %d\n", debFile.Size())
-			f, err := os.Open(debPath)
+		}
+		dirEntries := make(map[string]packageCacheEntry)
+
+		// loop through each directory
+		// run inspectPackage, unless the cached copy is still current
+		dirList, err := ioutil.ReadDir(archPath)
+		if err != nil {
+			return fmt.Errorf("scanning: %s: %s", archPath, err)
+		}
+		for _, dirEntry := range dirList {
+			if !strings.HasSuffix(dirEntry.Name(), "deb") {
+				continue
+			}
+			// with the pool layout the entry is a link, and the package itself lives in the pool
+			debPath, filename, err := resolvePackage(config, filepath.Join(archPath, dirEntry.Name()))
 			if err != nil {
-				log.Println("error opening deb file: ", err)
+				return fmt.Errorf("error resolving %s: %s", dirEntry.Name(), err)
 			}
-			defer f.Close()
-
-			var (
-				md5hash    = md5.New()
-				sha1hash   = sha1.New()
-				sha256hash = sha256.New()
-			)
-			_, err = io.Copy(io.MultiWriter(md5hash, sha1hash, sha256hash), f)
+			debFile, err := os.Stat(debPath)
 			if err != nil {
-				return fmt.Errorf("Error hashing file for Packages file: %s", err)
+				return fmt.Errorf("error reading %s: %s", dirEntry.Name(), err)
+			}
+			key := cachePrefix + dirEntry.Name()
+			entry, ok := cached[key]
+			if !ok || !entry.matches(debFile) || !entry.hasChecksums(config.Checksums()) || (config.EnableContents && entry.Contents == nil) || (keyring != nil && !entry.SignatureChecked) {
+				if entry, err = inspectPackageEntry(config, debPath, debFile, keyring); err != nil {
+					return err
+				}
+			} else if *verbose {
+				log.Printf("Using cached metadata for \"%s\"", debPath)
+			}
+			dirEntries[key] = entry
+			entries[key] = entry
+
+			var packBuf bytes.Buffer
+			if len(entries) > 1 {
+				packBuf.WriteString("\n")
+			}
+			packBuf.WriteString(entry.Control)
+			fmt.Fprintf(&packBuf, "Filename: %s\n", filename)
+			fmt.Fprintf(&packBuf, "Size: %d\n", debFile.Size())
+			for _, checksum := range config.Checksums() {
+				fmt.Fprintf(&packBuf, "%s: %s\n", checksum.packages, entry.hashes().get(checksum.name))
 			}
-			fmt.Fprintf(&packBuf, "MD5sum: %s\n",
-				hex.EncodeToString(md5hash.Sum(nil)))
-			fmt.Fprintf(&packBuf, "SHA1: %s\n",
-				hex.EncodeToString(sha1hash.Sum(nil)))
-			fmt.Fprintf(&packBuf, "SHA256: %s\n",
-				hex.EncodeToString(sha256hash.Sum(nil)))
-			if i != (len(dirList) - 1) {
-				packBuf.WriteString("\n\n")
+			if keyring != nil && entry.Signer != "" {
+				fmt.Fprintf(&packBuf, "Package-Signer: %s\n", entry.Signer)
 			}
 			writer.Write(packBuf.Bytes())
-			f = nil
+		}
+
+		if useCache {
+			if err := writePackageCache(db, cachePrefix, dirEntries); err != nil {
+				return err
+			}
+		}
+	}
+
+	if err := writer.Close(); err != nil {
+		return fmt.Errorf("failed to write Packages: %s", err)
+	}
+
+	if config.EnableContents {
+		if err := createSectionContents(pub, config, distro, section, arch, entries); err != nil {
+			return err
 		}
 	}
 
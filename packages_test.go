@@ -6,6 +6,8 @@ import (
 	"io"
 	"io/ioutil"
 	"os"
+	"path/filepath"
+	"strings"
 	"testing"
 )
 
@@ -66,6 +68,15 @@ Description: Network Interface Management tool similar to ifupdown
  are available under /usr/share/doc/ifupdown2/examples.
 `
 
+var goodOutputZstd = `Package: hello-zst
+Version: 1.0-1
+Architecture: all
+Maintainer: deb-simple <deb-simple@go.go>
+Section: utils
+Priority: optional
+Description: zstd compressed sample package
+ A tiny package used by the deb-simple test suite.
+`
 
 var goodPkgGzOutput = `Package: vim-tiny
 Source: vim
@@ -189,6 +200,71 @@ func TestInspectPackageControlLzma(t *testing.T) {
 	}
 }
 
+func TestInspectPackageControlZstd(t *testing.T) {
+	sampleDeb, err := ioutil.ReadFile("samples/control.tar.zst")
+	if err != nil {
+		t.Errorf("error opening sample deb file: %s", err)
+	}
+	var controlBuf bytes.Buffer
+	cfReader := bytes.NewReader(sampleDeb)
+	io.Copy(&controlBuf, cfReader)
+	parsedControl, err := inspectPackageControl(ZSTD, controlBuf)
+	if err != nil {
+		t.Errorf("error inspecting ZSTD control file: %s", err)
+	}
+	if parsedControl != goodOutputGz {
+		t.Errorf("control file does not match")
+	}
+}
+
+func TestInspectPackageControlUncompressed(t *testing.T) {
+	sampleDeb, err := ioutil.ReadFile("samples/control.tar")
+	if err != nil {
+		t.Errorf("error opening sample deb file: %s", err)
+	}
+	var controlBuf bytes.Buffer
+	cfReader := bytes.NewReader(sampleDeb)
+	io.Copy(&controlBuf, cfReader)
+	parsedControl, err := inspectPackageControl(NONE, controlBuf)
+	if err != nil {
+		t.Errorf("error inspecting uncompressed control file: %s", err)
+	}
+	if parsedControl != goodOutputGz {
+		t.Errorf("control file does not match")
+	}
+}
+
+func TestInspectPackageZstd(t *testing.T) {
+	parsedControl, err := inspectPackage("samples/hello-zst_1.0-1_all.deb")
+	if err != nil {
+		t.Errorf("inspectPackage() error: %s", err)
+	}
+	if parsedControl != goodOutputZstd {
+		t.Errorf("control file does not match, returned value is:\n %s", parsedControl)
+	}
+}
+
+func TestCompressionFromName(t *testing.T) {
+	for name, want := range map[string]Compression{
+		"control.tar.gz":  GZIP,
+		"control.tar.xz":  LZMA,
+		"control.tar.zst": ZSTD,
+		"control.tar":     NONE,
+		"data.tar.zst/":   ZSTD,
+	} {
+		got, err := compressionFromName(name)
+		if err != nil {
+			t.Errorf("compressionFromName(%s) error: %s", name, err)
+		}
+		if got != want {
+			t.Errorf("compressionFromName(%s) is %s, should be %s", name, got, want)
+		}
+	}
+	if _, err := compressionFromName("control.tar.lz4"); err == nil {
+		t.Error("compressionFromName() should have failed, it did not")
+	}
+}
+
 func TestCreatePackagesGz(t *testing.T) {
 	pwd, err := os.Getwd()
 	if err != nil {
@@ -222,7 +298,7 @@ func TestCreatePackagesGz(t *testing.T) {
 			t.Errorf("error saving copy of deb: %s", err)
 		}
 	}
-	if err := createPackagesGz(config, "stable", "main", "cats"); err != nil {
+	if err := createPackagesGz(config, nil, "stable", "main", "cats"); err != nil {
 		t.Errorf("error creating packages gzip for cats")
 	}
 	pkgGzip, err := ioutil.ReadFile(config.RootRepoPath + "/dists/stable/main/binary-cats/Packages.gz")
@@ -260,7 +336,7 @@ func TestCreatePackagesGz(t *testing.T) {
 	defer tempFile.Close()
 	config.RootRepoPath = pwd + "/tempFile"
 	// Can't make directory named after file
-	if err := createPackagesGz(config, "stable", "main", "cats"); err == nil {
+	if err := createPackagesGz(config, nil, "stable", "main", "cats"); err == nil {
 		t.Errorf("createPackagesGz() should have failed, it did not")
 	}
 	// cleanup
@@ -302,7 +378,7 @@ func TestCreatePackagesGzNonDefault(t *testing.T) {
 			t.Errorf("error saving copy of deb: %s", err)
 		}
 	}
-	if err := createPackagesGz(config, "blah", "main", "cats"); err != nil {
+	if err := createPackagesGz(config, nil, "blah", "main", "cats"); err != nil {
 		t.Errorf("error creating packages gzip for cats")
 	}
 	pkgGzip, err := ioutil.ReadFile(config.RootRepoPath + "/dists/blah/main/binary-cats/Packages.gz")
@@ -325,3 +401,51 @@ func TestCreatePackagesGzNonDefault(t *testing.T) {
 	}
 
 }
+
+func TestCreatePackagesGzMergeArchAll(t *testing.T) {
+	pwd, err := os.Getwd()
+	if err != nil {
+		t.Errorf("Unable to get current working directory: %s", err)
+	}
+	config := conf{ListenPort: "9666", RootRepoPath: pwd + "/testing", SupportArch: []string{"all", "amd64"}, DistroNames: []string{"stable"}, Sections: []string{"main"}, MergeArchAll: true}
+	for arch, sample := range map[string]string{"all": "samples/hello-zst_1.0-1_all.deb", "amd64": "samples/vim-tiny_7.4.052-1ubuntu3_amd64.deb"} {
+		// do not use the built-in createDirs() in case it is broken
+		if err := os.MkdirAll(config.ArchPath("stable", "main", arch), 0755); err != nil {
+			t.Errorf("error creating directory for %s: %s\n", arch, err)
+		}
+		data, err := ioutil.ReadFile(sample)
+		if err != nil {
+			t.Errorf("error reading sample deb: %s", err)
+		}
+		if err := ioutil.WriteFile(filepath.Join(config.ArchPath("stable", "main", arch), filepath.Base(sample)), data, 0644); err != nil {
+			t.Errorf("error writing copy of deb: %s", err)
+		}
+	}
+
+	for _, arch := range config.SupportArch {
+		if err := createPackagesGz(config, nil, "stable", "main", arch); err != nil {
+			t.Errorf("error creating Packages for %s: %s", arch, err)
+		}
+	}
+	packages, err := ioutil.ReadFile(filepath.Join(config.ArchPath("stable", "main", "amd64"), "Packages"))
+	if err != nil {
+		t.Errorf("error reading Packages: %s", err)
+	}
+	for _, want := range []string{"Package: vim-tiny\n", "Package: hello-zst\n", "Filename: dists/stable/main/binary-all/hello-zst_1.0-1_all.deb\n"} {
+		if !strings.Contains(string(packages), want) {
+			t.Errorf("amd64 Packages should contain %q, returned value is:\n%s", want, packages)
+		}
+	}
+	packages, err = ioutil.ReadFile(filepath.Join(config.ArchPath("stable", "main", "all"), "Packages"))
+	if err != nil {
+		t.Errorf("error reading Packages: %s", err)
+	}
+	if strings.Contains(string(packages), "Package: vim-tiny\n") {
+		t.Errorf("all Packages should only list Architecture: all packages, returned value is:\n%s", packages)
+	}
+
+	// cleanup
+	if err := os.RemoveAll(config.RootRepoPath); err != nil {
+		t.Errorf("error cleaning up after createPackagesGz(): %s", err)
+	}
+}
@@ -0,0 +1,182 @@
+package main
+
+import (
+	"bytes"
+	"crypto/md5"
+	"crypto/sha1"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/blakesmith/ar"
+	"golang.org/x/crypto/openpgp"
+	"golang.org/x/crypto/openpgp/clearsign"
+)
+
+// errPackageNotSigned is returned by verifyPackageSignature for a package without any signature member.
+var errPackageNotSigned = errors.New("package is not signed")
+
+// packageMember is an ar member of a package, with the size and checksums dpkg-sig lists for it.
+type packageMember struct {
+	name string
+	size int64
+	md5  string
+	sha1 string
+}
+
+// readPackageMembers reads the ar members of the package at debPath. It returns the regular members, and
+// the content of the signature members, the _gpgbuilder and other role members added by dpkg-sig and
+// the _gpgorigin member added by debsigs, keyed by name.
+func readPackageMembers(debPath string) ([]packageMember, map[string][]byte, error) {
+	f, err := os.Open(debPath)
+	if err != nil {
+		return nil, nil, fmt.Errorf("error opening package file %s: %s", debPath, err)
+	}
+	defer f.Close()
+
+	var members []packageMember
+	signatures := make(map[string][]byte)
+	arReader := ar.NewReader(f)
+	for {
+		header, err := arReader.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, nil, fmt.Errorf("error reading %s: %s", debPath, err)
+		}
+		name := strings.TrimSuffix(header.Name, "/")
+		if strings.HasPrefix(name, "_gpg") {
+			if signatures[name], err = ioutil.ReadAll(arReader); err != nil {
+				return nil, nil, fmt.Errorf("error reading %s: %s", name, err)
+			}
+			continue
+		}
+		md5hash, sha1hash := md5.New(), sha1.New()
+		size, err := io.Copy(io.MultiWriter(md5hash, sha1hash), arReader)
+		if err != nil {
+			return nil, nil, fmt.Errorf("error reading %s: %s", name, err)
+		}
+		members = append(members, packageMember{name: name, size: size, md5: hex.EncodeToString(md5hash.Sum(nil)), sha1: hex.EncodeToString(sha1hash.Sum(nil))})
+	}
+	return members, signatures, nil
+}
+
+// verifyPackageSignature checks the signatures embedded in the package at debPath against keyring, and
+// returns the fingerprint of the key that made the first one that verifies. A dpkg-sig signature is a
+// clearsigned list of the checksums of every other member, a debsigs signature is a detached signature
+// of the regular members concatenated.
+func verifyPackageSignature(keyring openpgp.EntityList, debPath string) (string, error) {
+	members, signatures, err := readPackageMembers(debPath)
+	if err != nil {
+		return "", err
+	}
+	if len(signatures) == 0 {
+		return "", errPackageNotSigned
+	}
+
+	var lastErr error
+	for name, signature := range signatures {
+		var signer *openpgp.Entity
+		if name == "_gpgorigin" {
+			signer, err = checkOriginSignature(keyring, debPath, signature)
+		} else {
+			signer, err = checkBuilderSignature(keyring, members, signature)
+		}
+		if err == nil {
+			return keyFingerprint(signer), nil
+		}
+		lastErr = fmt.Errorf("%s: %s", name, err)
+	}
+	return "", lastErr
+}
+
+// checkBuilderSignature checks a dpkg-sig signature, which lists the md5, sha1, size and name of every
+// member before it in its Files field.
+func checkBuilderSignature(keyring openpgp.EntityList, members []packageMember, signature []byte) (*openpgp.Entity, error) {
+	block, _ := clearsign.Decode(signature)
+	if block == nil {
+		return nil, errors.New("signature is not clearsigned")
+	}
+	signer, err := openpgp.CheckDetachedSignature(keyring, bytes.NewReader(block.Bytes), block.ArmoredSignature.Body)
+	if err != nil {
+		return nil, err
+	}
+
+	listed := make(map[string]packageMember)
+	for _, line := range strings.Split(parseControl(string(block.Plaintext))["Files"], "\n") {
+		parts := strings.Fields(line)
+		if len(parts) != 4 {
+			continue
+		}
+		size, err := strconv.ParseInt(parts[2], 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("invalid size for %s: %s", parts[3], err)
+		}
+		listed[parts[3]] = packageMember{name: parts[3], size: size, md5: parts[0], sha1: parts[1]}
+	}
+	for _, member := range members {
+		if listed[member.name] != member {
+			return nil, fmt.Errorf("%s does not match the signed checksums", member.name)
+		}
+	}
+	return signer, nil
+}
+
+// checkOriginSignature checks a debsigs signature, a detached signature of the regular members of the
+// package concatenated in order.
+func checkOriginSignature(keyring openpgp.EntityList, debPath string, signature []byte) (*openpgp.Entity, error) {
+	f, err := os.Open(debPath)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	signed, w := io.Pipe()
+	go func() {
+		arReader := ar.NewReader(f)
+		for {
+			header, err := arReader.Next()
+			if err == io.EOF {
+				break
+			}
+			if err != nil {
+				w.CloseWithError(err)
+				return
+			}
+			if strings.HasPrefix(header.Name, "_gpg") {
+				continue
+			}
+			if _, err := io.Copy(w, arReader); err != nil {
+				w.CloseWithError(err)
+				return
+			}
+		}
+		w.Close()
+	}()
+	defer signed.Close()
+	return checkSignature(keyring, signed, signature)
+}
+
+// requirePackageSignature rejects an uploaded package whose embedded signature is missing, or doesn't
+// verify against the package keyring.
+func requirePackageSignature(config conf, debPath, name string) error {
+	keyring, err := loadKeyring(config.PackageKeyring)
+	if err != nil {
+		return err
+	}
+	_, err = verifyPackageSignature(keyring, debPath)
+	if err == errPackageNotSigned {
+		return uploadErrorf(http.StatusBadRequest, "%s is not signed", name)
+	}
+	if err != nil {
+		return uploadErrorf(http.StatusForbidden, "%s has no valid signature by a trusted key: %s", name, err)
+	}
+	return nil
+}
@@ -0,0 +1,175 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/blakesmith/ar"
+	"github.com/boltdb/bolt"
+	"golang.org/x/crypto/openpgp"
+	"golang.org/x/crypto/openpgp/clearsign"
+)
+
+// appendDebMember adds an ar member to the end of the package at path.
+func appendDebMember(t testing.TB, path, name string, data []byte) {
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		t.Fatalf("error opening %s: %s", path, err)
+	}
+	defer f.Close()
+	w := ar.NewWriter(f)
+	w.WriteHeader(&ar.Header{Name: name, ModTime: time.Unix(0, 0), Mode: 0644, Size: int64(len(data))})
+	if _, err := w.Write(data); err != nil {
+		t.Fatalf("error writing %s: %s", path, err)
+	}
+}
+
+// signDebBuilder signs the package at path the way dpkg-sig does, listing files as its members.
+func signDebBuilder(t testing.TB, signer *openpgp.Entity, path string, members []packageMember) {
+	var buf bytes.Buffer
+	w, err := clearsign.Encode(&buf, signer.PrivateKey, nil)
+	if err != nil {
+		t.Fatalf("error signing %s: %s", path, err)
+	}
+	fmt.Fprintf(w, "Version: 4\nSigner: \nDate: Thu Jan  1 00:00:00 1970\nRole: builder\nFiles: \n")
+	for _, member := range members {
+		fmt.Fprintf(w, "\t%s %s %d %s\n", member.md5, member.sha1, member.size, member.name)
+	}
+	w.Close()
+	appendDebMember(t, path, "_gpgbuilder", buf.Bytes())
+}
+
+func TestVerifyPackageSignature(t *testing.T) {
+	pwd, err := os.Getwd()
+	if err != nil {
+		t.Errorf("Unable to get current working directory: %s", err)
+	}
+	if err := os.MkdirAll(pwd+"/testing", 0755); err != nil {
+		t.Fatalf("error creating directory: %s", err)
+	}
+	vendor, _, _ := createKeyPair("deb-simple Vendor", "", "vendor@go.go")
+	stranger, _, _ := createKeyPair("deb-simple Stranger", "", "stranger@go.go")
+	keyring := openpgp.EntityList{vendor}
+
+	newDeb := func(name string) (string, []packageMember) {
+		path := filepath.Join(pwd, "testing", name)
+		writeTestDeb(t, path, "Package: app\nVersion: 1.0\nArchitecture: all\n")
+		members, _, err := readPackageMembers(path)
+		if err != nil {
+			t.Fatalf("readPackageMembers() failed: %s", err)
+		}
+		return path, members
+	}
+
+	unsigned, _ := newDeb("unsigned.deb")
+	if _, err := verifyPackageSignature(keyring, unsigned); err != errPackageNotSigned {
+		t.Errorf("verifyPackageSignature() of an unsigned package returned %v, should be %v", err, errPackageNotSigned)
+	}
+
+	signed, members := newDeb("builder.deb")
+	signDebBuilder(t, vendor, signed, members)
+	if signer, err := verifyPackageSignature(keyring, signed); err != nil || signer != keyFingerprint(vendor) {
+		t.Errorf("verifyPackageSignature() returned %s, %v, should be %s", signer, err, keyFingerprint(vendor))
+	}
+
+	untrusted, members := newDeb("untrusted.deb")
+	signDebBuilder(t, stranger, untrusted, members)
+	if _, err := verifyPackageSignature(keyring, untrusted); err == nil {
+		t.Errorf("verifyPackageSignature() should fail for a package signed by an untrusted key")
+	}
+
+	tampered, members := newDeb("tampered.deb")
+	members[1].md5 = strings.Repeat("0", 32)
+	signDebBuilder(t, vendor, tampered, members)
+	if _, err := verifyPackageSignature(keyring, tampered); err == nil {
+		t.Errorf("verifyPackageSignature() should fail for a package whose members don't match the signature")
+	}
+
+	// debsigs signs the members concatenated
+	origin, _ := newDeb("origin.deb")
+	f, _ := os.Open(origin)
+	var concatenated bytes.Buffer
+	arReader := ar.NewReader(f)
+	for {
+		if _, err := arReader.Next(); err != nil {
+			break
+		}
+		io.Copy(&concatenated, arReader)
+	}
+	f.Close()
+	var signature bytes.Buffer
+	if err := openpgp.DetachSign(&signature, vendor, &concatenated, nil); err != nil {
+		t.Fatalf("error signing %s: %s", origin, err)
+	}
+	appendDebMember(t, origin, "_gpgorigin", signature.Bytes())
+	if signer, err := verifyPackageSignature(keyring, origin); err != nil || signer != keyFingerprint(vendor) {
+		t.Errorf("verifyPackageSignature() of a debsigs package returned %s, %v, should be %s", signer, err, keyFingerprint(vendor))
+	}
+
+	if err := os.RemoveAll(pwd + "/testing"); err != nil {
+		t.Errorf("error cleaning up after verifyPackageSignature(): %s", err)
+	}
+}
+
+func TestUploadHandlerPackageSignatures(t *testing.T) {
+	pwd, err := os.Getwd()
+	if err != nil {
+		t.Errorf("Unable to get current working directory: %s", err)
+	}
+	config := conf{ListenPort: "9666", RootRepoPath: pwd + "/testing", SupportArch: []string{"all"}, DistroNames: []string{"stable"}, Sections: []string{"main"},
+		VerifyPackageSignatures: true, PackageKeyring: pwd + "/testing/vendors.asc"}
+	if err := createDirs(config); err != nil {
+		t.Errorf("createDirs() failed: %s", err)
+	}
+	vendor, vendorKey, _ := createKeyPair("deb-simple Vendor", "", "vendor@go.go")
+	if err := ioutil.WriteFile(config.PackageKeyring, []byte(vendorKey), 0644); err != nil {
+		t.Fatalf("error writing package keyring: %s", err)
+	}
+	db, err := bolt.Open(tempfile(), 0666, nil)
+	if err != nil {
+		t.Fatalf("error creating tempdb: %s", err)
+	}
+	defer db.Close()
+	uploadHandle := uploadHandler(config, db)
+	upload := func(file string) int {
+		body, contentType := multipartBody(t, file)
+		req, _ := http.NewRequest("POST", "/upload", body)
+		req.Header.Add("Content-Type", contentType)
+		w := httptest.NewRecorder()
+		uploadHandle.ServeHTTP(w, req)
+		return w.Code
+	}
+
+	if code := upload("samples/hello-zst_1.0-1_all.deb"); code != http.StatusBadRequest {
+		t.Errorf("uploadHandler POST of an unsigned package returned %v, should be %v", code, http.StatusBadRequest)
+	}
+
+	signed := filepath.Join(config.RootRepoPath, "app_1.0_all.deb")
+	writeTestDeb(t, signed, "Package: app\nVersion: 1.0\nArchitecture: all\n")
+	members, _, err := readPackageMembers(signed)
+	if err != nil {
+		t.Fatalf("readPackageMembers() failed: %s", err)
+	}
+	signDebBuilder(t, vendor, signed, members)
+	if code := upload(signed); code != http.StatusOK {
+		t.Errorf("uploadHandler POST of a signed package returned %v, should be %v", code, http.StatusOK)
+	}
+	packages, _ := ioutil.ReadFile(filepath.Join(config.ArchPath("stable", "main", "all"), "Packages"))
+	if !strings.Contains(string(packages), "Package-Signer: "+keyFingerprint(vendor)+"\n") {
+		t.Errorf("Packages should list the signer of app:\n%s", packages)
+	}
+
+	// cleanup
+	if err := os.RemoveAll(config.RootRepoPath); err != nil {
+		t.Errorf("error cleaning up after uploadHandler(): %s", err)
+	}
+}
@@ -0,0 +1,289 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// poolPrefix returns the directory a source package is grouped under in the pool, which is its
+// first letter, or the first four letters for lib* packages, as in the Debian archive.
+func poolPrefix(source string) string {
+	if strings.HasPrefix(source, "lib") && len(source) > 4 {
+		return source[:4]
+	}
+	return source[:1]
+}
+
+// poolSource returns the source package name of a binary package's control stanza, falling back to
+// the binary package name when there is no Source field. Any version in the Source field is dropped.
+func poolSource(control string) string {
+	fields := parseControl(control)
+	if source := strings.Fields(fields["Source"]); len(source) > 0 {
+		return source[0]
+	}
+	return fields["Package"]
+}
+
+// poolFilePath returns where a package with the given control file is kept in the pool of section.
+func poolFilePath(config conf, section, name, control string) (string, error) {
+	if name != filepath.Base(name) || !strings.HasSuffix(name, ".deb") {
+		return "", uploadErrorf(http.StatusBadRequest, "invalid package file name %s", name)
+	}
+	source := poolSource(control)
+	if source == "" || source != filepath.Base(source) || strings.HasPrefix(source, ".") {
+		return "", uploadErrorf(http.StatusBadRequest, "%s has no valid package name", name)
+	}
+	return filepath.Join(config.PoolPath(), section, poolPrefix(source), source, name), nil
+}
+
+// addToPool moves the uploaded package at tmpPath into pool/<section>/<prefix>/<source>/<name> and
+// returns its pool path. Uploading a package that is already in the pool is not an error as long as
+// the content is identical, the staged copy is then simply dropped. A package with different content
+// is a conflict, unless force is set: the pool file is then replaced, for every distro linking to it,
+// which is reported so their metadata can be rebuilt.
+func addToPool(config conf, section, tmpPath, name string, force bool) (string, bool, error) {
+	control, err := inspectPackage(tmpPath)
+	if err != nil {
+		return "", false, uploadErrorf(http.StatusBadRequest, "error inspecting %s: %s", name, err)
+	}
+	poolFile, err := poolFilePath(config, section, name, control)
+	if err != nil {
+		return "", false, err
+	}
+
+	existing, err := hashFile(poolFile)
+	replaced := false
+	switch {
+	case err == nil:
+		uploaded, err := hashFile(tmpPath)
+		if err != nil {
+			return "", false, fmt.Errorf("error hashing %s: %s", name, err)
+		}
+		if existing.SHA256 == uploaded.SHA256 {
+			return poolFile, false, os.Remove(tmpPath)
+		}
+		if !force {
+			return "", false, uploadErrorf(http.StatusConflict, "%s is already in the pool with different content, upload with force=true to replace it in every distro", name)
+		}
+		replaced = true
+	case !os.IsNotExist(err):
+		return "", false, fmt.Errorf("error hashing pooled %s: %s", name, err)
+	}
+
+	if err := os.MkdirAll(filepath.Dir(poolFile), 0755); err != nil {
+		return "", false, fmt.Errorf("error creating pool directory for %s: %s", name, err)
+	}
+	if err := os.Rename(tmpPath, poolFile); err != nil {
+		return "", false, fmt.Errorf("error moving %s into the pool: %s", name, err)
+	}
+	return poolFile, replaced, nil
+}
+
+// linkFromPool makes a pool file part of a distro by linking to it from the arch directory.
+// The link is relative so the repository can be moved around, and is renamed into place so
+// an existing entry of the same name is replaced in one step.
+func linkFromPool(config conf, distro, section, arch, poolFile string) error {
+	archPath := config.ArchPath(distro, section, arch)
+	target, err := filepath.Rel(archPath, poolFile)
+	if err != nil {
+		return fmt.Errorf("error linking %s: %s", filepath.Base(poolFile), err)
+	}
+	linkPath := filepath.Join(archPath, filepath.Base(poolFile))
+	tmpLink := filepath.Join(archPath, "."+filepath.Base(poolFile)+".link")
+	os.Remove(tmpLink)
+	if err := os.Symlink(target, tmpLink); err != nil {
+		return fmt.Errorf("error linking %s: %s", filepath.Base(poolFile), err)
+	}
+	if err := os.Rename(tmpLink, linkPath); err != nil {
+		os.Remove(tmpLink)
+		return fmt.Errorf("error linking %s: %s", filepath.Base(poolFile), err)
+	}
+	return nil
+}
+
+// resolvePackage returns the file a package entry in an arch directory stands for, which is the
+// pool file for a link and the entry itself otherwise, along with its path relative to the repo root
+// as used for the Filename field.
+func resolvePackage(config conf, debPath string) (string, string, error) {
+	info, err := os.Lstat(debPath)
+	if err != nil {
+		return "", "", err
+	}
+	target := debPath
+	if info.Mode()&os.ModeSymlink != 0 {
+		link, err := os.Readlink(debPath)
+		if err != nil {
+			return "", "", err
+		}
+		if !filepath.IsAbs(link) {
+			link = filepath.Join(filepath.Dir(debPath), link)
+		}
+		target = filepath.Clean(link)
+	}
+	relPath, err := filepath.Rel(config.RootRepoPath, target)
+	if err != nil {
+		return "", "", err
+	}
+	return target, filepath.ToSlash(relPath), nil
+}
+
+// poolFileLinks returns the arch directory entries of every distro that link to poolFile. Links are
+// named after the pool file and only made from the section the pool file is in, so that is all there
+// is to look at.
+func poolFileLinks(config conf, section, poolFile string) ([]string, error) {
+	distros, err := ioutil.ReadDir(filepath.Join(config.RootRepoPath, "dists"))
+	if err != nil {
+		return nil, err
+	}
+	var links []string
+	for _, distro := range distros {
+		sectionPath := filepath.Join(config.RootRepoPath, "dists", distro.Name(), section)
+		archs, err := ioutil.ReadDir(sectionPath)
+		if os.IsNotExist(err) {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		for _, arch := range archs {
+			if !arch.IsDir() || !strings.HasPrefix(arch.Name(), "binary-") {
+				continue
+			}
+			path := filepath.Join(sectionPath, arch.Name(), filepath.Base(poolFile))
+			info, err := os.Lstat(path)
+			if os.IsNotExist(err) {
+				continue
+			}
+			if err != nil {
+				return nil, err
+			}
+			if info.Mode()&os.ModeSymlink == 0 {
+				continue
+			}
+			target, _, err := resolvePackage(config, path)
+			if err != nil {
+				return nil, err
+			}
+			if target == filepath.Clean(poolFile) {
+				links = append(links, path)
+			}
+		}
+	}
+	return links, nil
+}
+
+// movePackageAside moves a package out of an arch directory into dir, where removePackage would delete
+// it, and returns a function that moves it back. Its pool file is moved along when no other distro
+// references it.
+func movePackageAside(config conf, distro, section, arch, filename, dir string) (func() error, error) {
+	debPath := filepath.Join(config.ArchPath(distro, section, arch), filepath.Base(filename))
+	target, _, err := resolvePackage(config, debPath)
+	if err != nil {
+		return nil, err
+	}
+	aside, err := ioutil.TempDir(dir, "aside-")
+	if err != nil {
+		return nil, err
+	}
+	asidePath := filepath.Join(aside, filepath.Base(debPath))
+	if err := os.Rename(debPath, asidePath); err != nil {
+		return nil, err
+	}
+	restore := func() error {
+		return os.Rename(asidePath, debPath)
+	}
+	if target == debPath {
+		return restore, nil
+	}
+
+	links, err := poolFileLinks(config, section, target)
+	if err != nil {
+		restore()
+		return nil, fmt.Errorf("error checking references to %s: %s", filepath.Base(target), err)
+	}
+	if len(links) > 0 {
+		return restore, nil
+	}
+	asidePool := filepath.Join(aside, "pool")
+	if err := os.Rename(target, asidePool); err != nil && !os.IsNotExist(err) {
+		restore()
+		return nil, err
+	}
+	return func() error {
+		if err := os.MkdirAll(filepath.Dir(target), 0755); err != nil {
+			return err
+		}
+		if err := os.Rename(asidePool, target); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		return restore()
+	}, nil
+}
+
+// keepPoolFile links the pool file of a package into dir, if it is in the pool, and returns a function
+// that moves it back into the pool, replacing whatever is there by then.
+func keepPoolFile(config conf, section, name, control, dir string) (func() error, error) {
+	poolFile, err := poolFilePath(config, section, name, control)
+	if err != nil {
+		return nil, err
+	}
+	kept, err := ioutil.TempDir(dir, "pool-")
+	if err != nil {
+		return nil, err
+	}
+	keptPath := filepath.Join(kept, name)
+	if err := os.Link(poolFile, keptPath); os.IsNotExist(err) {
+		return func() error { return nil }, nil
+	} else if err != nil {
+		return nil, fmt.Errorf("error keeping pool file %s: %s", name, err)
+	}
+	return func() error {
+		if err := os.MkdirAll(filepath.Dir(poolFile), 0755); err != nil {
+			return err
+		}
+		return os.Rename(keptPath, poolFile)
+	}, nil
+}
+
+// removePackage removes a package from an arch directory. When the entry links into the pool the
+// pool file is removed as well, unless another distro still references it.
+func removePackage(config conf, distro, section, arch, filename string) error {
+	debPath := filepath.Join(config.ArchPath(distro, section, arch), filepath.Base(filename))
+	target, _, err := resolvePackage(config, debPath)
+	if err != nil {
+		return err
+	}
+	if err := os.Remove(debPath); err != nil {
+		return err
+	}
+	if target == debPath {
+		return nil
+	}
+
+	links, err := poolFileLinks(config, section, target)
+	if err != nil {
+		return fmt.Errorf("error checking references to %s: %s", filepath.Base(target), err)
+	}
+	if len(links) > 0 {
+		return nil
+	}
+	if err := os.Remove(target); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	if *verbose {
+		log.Printf("Pool file %s is no longer referenced and has been removed", target)
+	}
+	// tidy up the source and prefix directories once they are empty
+	for dir := filepath.Dir(target); dir != config.PoolPath() && strings.HasPrefix(dir, config.PoolPath()); dir = filepath.Dir(dir) {
+		if files, err := ioutil.ReadDir(dir); err != nil || len(files) > 0 {
+			break
+		}
+		os.Remove(dir)
+	}
+	return nil
+}
@@ -0,0 +1,170 @@
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/boltdb/bolt"
+)
+
+func TestPoolPrefix(t *testing.T) {
+	for source, want := range map[string]string{"vim": "v", "libc6": "libc", "lib": "l", "0ad": "0"} {
+		if got := poolPrefix(source); got != want {
+			t.Errorf("poolPrefix(%s) returned %s, should be %s", source, got, want)
+		}
+	}
+	if got := poolSource("Package: vim-tiny\nSource: vim (2:7.4.052-1ubuntu3)\n"); got != "vim" {
+		t.Errorf("poolSource returned %s, should be vim", got)
+	}
+	if got := poolSource("Package: hello-zst\n"); got != "hello-zst" {
+		t.Errorf("poolSource returned %s, should be hello-zst", got)
+	}
+}
+
+func TestUploadHandlerPool(t *testing.T) {
+	pwd, err := os.Getwd()
+	if err != nil {
+		t.Errorf("Unable to get current working directory: %s", err)
+	}
+	config := conf{ListenPort: "9666", RootRepoPath: pwd + "/testing", SupportArch: []string{"amd64"}, DistroNames: []string{"stable", "testing"}, Sections: []string{"main"}, EnableDirectoryWatching: false, UsePool: true}
+	if err := createDirs(config); err != nil {
+		t.Errorf("createDirs() failed: %s", err)
+	}
+
+	// create temp db
+	db, err := bolt.Open(tempfile(), 0666, nil)
+	if err != nil {
+		t.Fatalf("error creating tempdb: %s", err)
+	}
+	defer db.Close()
+
+	uploadHandle := uploadHandler(config, db)
+	for _, distro := range config.DistroNames {
+		body, contentType := multipartBody(t, "samples/vim-tiny_7.4.052-1ubuntu3_amd64.deb")
+		req, _ := http.NewRequest("POST", "/upload?arch=amd64&distro="+distro+"&section=main", body)
+		req.Header.Add("Content-Type", contentType)
+		w := httptest.NewRecorder()
+		uploadHandle.ServeHTTP(w, req)
+		if w.Code != http.StatusOK {
+			t.Errorf("uploadHandler POST returned %v, should be %v", w.Code, http.StatusOK)
+		}
+	}
+
+	poolFile := filepath.Join(config.PoolPath(), "main", "v", "vim", "vim-tiny_7.4.052-1ubuntu3_amd64.deb")
+	if _, err := os.Stat(poolFile); err != nil {
+		t.Errorf("package was not added to the pool: %s", err)
+	}
+	if files, _ := ioutil.ReadDir(config.PoolPath()); len(files) != 1 {
+		t.Errorf("pool should only hold the main section, found %d entries", len(files))
+	}
+	for _, distro := range config.DistroNames {
+		packages, err := ioutil.ReadFile(filepath.Join(config.ArchPath(distro, "main", "amd64"), "Packages"))
+		if err != nil {
+			t.Errorf("error reading Packages: %s", err)
+		}
+		if !strings.Contains(string(packages), "Filename: pool/main/v/vim/vim-tiny_7.4.052-1ubuntu3_amd64.deb\n") {
+			t.Errorf("Packages for %s does not point into the pool:\n%s", distro, packages)
+		}
+		if !strings.Contains(string(packages), "Size: 391240\n") {
+			t.Errorf("Packages for %s does not list the size of the pool file:\n%s", distro, packages)
+		}
+	}
+
+	deleteHandle := deleteHandler(config, db)
+	deletePackage := func(distro string) {
+		req, _ := http.NewRequest("DELETE", "", bytes.NewBufferString("{\"filename\":\"vim-tiny_7.4.052-1ubuntu3_amd64.deb\",\"arch\":\"amd64\", \"distroName\":\""+distro+"\", \"section\":\"main\"}"))
+		w := httptest.NewRecorder()
+		deleteHandle.ServeHTTP(w, req)
+		if w.Code != http.StatusOK {
+			t.Errorf("deleteHandler DELETE returned %v, should be %v", w.Code, http.StatusOK)
+		}
+	}
+
+	// testing still references the pool file
+	deletePackage("stable")
+	if _, err := os.Stat(poolFile); err != nil {
+		t.Errorf("pool file should be kept while testing references it: %s", err)
+	}
+	deletePackage("testing")
+	if _, err := os.Stat(poolFile); !os.IsNotExist(err) {
+		t.Errorf("pool file should be removed once no distro references it")
+	}
+	if _, err := os.Stat(filepath.Join(config.PoolPath(), "main", "v")); !os.IsNotExist(err) {
+		t.Errorf("empty pool directories should be removed")
+	}
+
+	// cleanup
+	if err := os.RemoveAll(config.RootRepoPath); err != nil {
+		t.Errorf("error cleaning up after uploadHandler(): %s", err)
+	}
+}
+
+func TestForcedPoolUpload(t *testing.T) {
+	pwd, err := os.Getwd()
+	if err != nil {
+		t.Errorf("Unable to get current working directory: %s", err)
+	}
+	config := conf{ListenPort: "9666", RootRepoPath: pwd + "/testing", SupportArch: []string{"amd64"}, DistroNames: []string{"stable", "testing"}, Sections: []string{"main"}, EnableDirectoryWatching: false, UsePool: true}
+	if err := createDirs(config); err != nil {
+		t.Errorf("createDirs() failed: %s", err)
+	}
+	db, err := bolt.Open(tempfile(), 0666, nil)
+	if err != nil {
+		t.Fatalf("error creating tempdb: %s", err)
+	}
+	defer db.Close()
+
+	original := filepath.Join(config.RootRepoPath, "original", "app_1.0_amd64.deb")
+	rebuilt := filepath.Join(config.RootRepoPath, "rebuilt", "app_1.0_amd64.deb")
+	for _, dir := range []string{filepath.Dir(original), filepath.Dir(rebuilt)} {
+		if err := os.MkdirAll(dir, 0755); err != nil {
+			t.Fatalf("error creating %s: %s", dir, err)
+		}
+	}
+	writeTestDeb(t, original, "Package: app\nVersion: 1.0\nArchitecture: amd64\nDescription: original\n")
+	writeTestDeb(t, rebuilt, "Package: app\nVersion: 1.0\nArchitecture: amd64\nDescription: rebuilt\n")
+
+	uploadHandle := uploadHandler(config, db)
+	upload := func(path, distro, force string) int {
+		body, contentType := multipartBody(t, path)
+		req, _ := http.NewRequest("POST", "/upload?distro="+distro+"&force="+force, body)
+		req.Header.Add("Content-Type", contentType)
+		w := httptest.NewRecorder()
+		uploadHandle.ServeHTTP(w, req)
+		return w.Code
+	}
+	for _, distro := range config.DistroNames {
+		if code := upload(original, distro, "false"); code != http.StatusOK {
+			t.Errorf("uploadHandler POST to %s returned %v, should be %v", distro, code, http.StatusOK)
+		}
+	}
+
+	// the pool file is shared, so replacing it in stable replaces it in testing too
+	if code := upload(rebuilt, "stable", "false"); code != http.StatusConflict {
+		t.Errorf("uploadHandler POST of a conflicting package returned %v, should be %v", code, http.StatusConflict)
+	}
+	if code := upload(rebuilt, "stable", "true"); code != http.StatusOK {
+		t.Errorf("uploadHandler POST with force=true returned %v, should be %v", code, http.StatusOK)
+	}
+	for _, distro := range config.DistroNames {
+		packages, _ := ioutil.ReadFile(filepath.Join(config.ArchPath(distro, "main", "amd64"), "Packages"))
+		if !strings.Contains(string(packages), "Description: rebuilt\n") {
+			t.Errorf("Packages for %s should list the rebuilt package:\n%s", distro, packages)
+		}
+	}
+	links, err := poolFileLinks(config, "main", filepath.Join(config.PoolPath(), "main", "a", "app", "app_1.0_amd64.deb"))
+	if err != nil || len(links) != 2 {
+		t.Errorf("poolFileLinks() returned %v, %v, should return both distros", links, err)
+	}
+
+	// cleanup
+	if err := os.RemoveAll(config.RootRepoPath); err != nil {
+		t.Errorf("error cleaning up after uploadHandler(): %s", err)
+	}
+}
@@ -0,0 +1,200 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// publication collects the index and Release files generated during a rebuild under temporary names,
+// so that nothing a client can see changes until everything has been generated. commit then moves
+// the index files into place, followed by the Release files, so a client never downloads a Release
+// file that lists index files which aren't there yet. As every index file is also published under
+// by-hash, which apt fetches it from, a client always gets the index files matching the InRelease it
+// downloaded, whether that is the old or the new one.
+type publication struct {
+	// files holds the final paths in the order they were staged
+	files   []string
+	staged  map[string]string
+	removed map[string]bool
+}
+
+func newPublication() *publication {
+	return &publication{staged: make(map[string]string), removed: make(map[string]bool)}
+}
+
+// publishMutex serializes publications, so that the files of two rebuilds are never moved into place
+// interleaved, and a rebuild always stages against what the previous one published.
+var publishMutex sync.Mutex
+
+// publish runs stage against a new publication and commits it, or discards it when stage fails,
+// leaving the previously published files untouched.
+func publish(stage func(pub *publication) error) error {
+	publishMutex.Lock()
+	defer publishMutex.Unlock()
+	pub := newPublication()
+	if err := stage(pub); err != nil {
+		pub.discard()
+		return err
+	}
+	return pub.commit()
+}
+
+// create creates a temporary file that will replace path once the publication is committed.
+// Creating the same path twice replaces the earlier staged content.
+func (p *publication) create(path string) (*os.File, error) {
+	f, err := ioutil.TempFile(filepath.Dir(path), "."+filepath.Base(path)+".")
+	if err != nil {
+		return nil, err
+	}
+	if err := f.Chmod(0644); err != nil {
+		f.Close()
+		os.Remove(f.Name())
+		return nil, err
+	}
+	if tmp, ok := p.staged[path]; ok {
+		os.Remove(tmp)
+	} else {
+		p.files = append(p.files, path)
+	}
+	p.staged[path] = f.Name()
+	delete(p.removed, path)
+	return f, nil
+}
+
+// remove marks path for removal once the publication is committed.
+func (p *publication) remove(path string) {
+	if tmp, ok := p.staged[path]; ok {
+		os.Remove(tmp)
+		delete(p.staged, path)
+	}
+	p.removed[path] = true
+}
+
+// open opens path as it will be once the publication is committed: the staged copy if there is one,
+// or the published file otherwise.
+func (p *publication) open(path string) (*os.File, error) {
+	if p.removed[path] {
+		return nil, &os.PathError{Op: "open", Path: path, Err: os.ErrNotExist}
+	}
+	if tmp, ok := p.staged[path]; ok {
+		return os.Open(tmp)
+	}
+	return os.Open(path)
+}
+
+// indexFiles lists the index files below dir as they will be once the publication is committed,
+// sorted in the same order filepath.Walk visits them.
+func (p *publication) indexFiles(dir string) ([]string, error) {
+	found := make(map[string]bool)
+	err := filepath.Walk(dir, func(path string, file os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if !file.IsDir() && isIndexFile(file.Name()) && !p.removed[path] {
+			found[path] = true
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	for path := range p.staged {
+		if isIndexFile(filepath.Base(path)) && strings.HasPrefix(path, dir+string(filepath.Separator)) {
+			found[path] = true
+		}
+	}
+
+	paths := make([]string, 0, len(found))
+	for path := range found {
+		paths = append(paths, path)
+	}
+	sort.Slice(paths, func(i, j int) bool {
+		return strings.Replace(paths[i], string(filepath.Separator), "\x00", -1) < strings.Replace(paths[j], string(filepath.Separator), "\x00", -1)
+	})
+	return paths, nil
+}
+
+// releaseOrder ranks the Release files after every index file, with InRelease last, as that is
+// what apt fetches first.
+func releaseOrder(path string) int {
+	switch filepath.Base(path) {
+	case "Release":
+		return 1
+	case "Release.gpg":
+		return 2
+	case "InRelease":
+		return 3
+	}
+	return 0
+}
+
+// commit moves every staged file into place, Release files last, and then removes the files marked
+// for removal, which the new Release files no longer list. When a file can't be moved into place, the
+// files moved before it are put back the way they were, so the previous publication stays intact.
+func (p *publication) commit() error {
+	files := make([]string, 0, len(p.staged))
+	for _, path := range p.files {
+		if _, ok := p.staged[path]; ok {
+			files = append(files, path)
+		}
+	}
+	sort.SliceStable(files, func(i, j int) bool {
+		return releaseOrder(files[i]) < releaseOrder(files[j])
+	})
+
+	// the files that are replaced stay linked under a temporary name until everything is in place
+	backups := make(map[string]string)
+	var placed []string
+	rollback := func() {
+		for i := len(placed) - 1; i >= 0; i-- {
+			if backup, ok := backups[placed[i]]; ok {
+				os.Rename(backup, placed[i])
+			} else {
+				os.Remove(placed[i])
+			}
+		}
+		for _, backup := range backups {
+			os.Remove(backup)
+		}
+		p.discard()
+	}
+	for _, path := range files {
+		backup := p.staged[path] + ".old"
+		if err := os.Link(path, backup); err == nil {
+			backups[path] = backup
+		} else if !os.IsNotExist(err) {
+			rollback()
+			return fmt.Errorf("failed to publish %s: %s", filepath.Base(path), err)
+		}
+		if err := os.Rename(p.staged[path], path); err != nil {
+			rollback()
+			return fmt.Errorf("failed to publish %s: %s", filepath.Base(path), err)
+		}
+		placed = append(placed, path)
+		delete(p.staged, path)
+	}
+	for _, backup := range backups {
+		os.Remove(backup)
+	}
+	for path := range p.removed {
+		if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+			return fmt.Errorf("failed to remove %s: %s", filepath.Base(path), err)
+		}
+	}
+	p.removed = make(map[string]bool)
+	return nil
+}
+
+// discard throws away every staged file, leaving the published files as they were.
+func (p *publication) discard() {
+	for path, tmp := range p.staged {
+		os.Remove(tmp)
+		delete(p.staged, path)
+	}
+	p.removed = make(map[string]bool)
+}
@@ -0,0 +1,157 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestPublication(t *testing.T) {
+	pwd, err := os.Getwd()
+	if err != nil {
+		t.Errorf("Unable to get current working directory: %s", err)
+	}
+	dir := pwd + "/testing/dists/stable"
+	if err := os.MkdirAll(dir+"/main/binary-cats", 0755); err != nil {
+		t.Errorf("error creating directory: %s\n", err)
+	}
+	if err := ioutil.WriteFile(dir+"/main/binary-cats/Packages.bz2", []byte("old"), 0644); err != nil {
+		t.Errorf("error writing old index: %s", err)
+	}
+
+	pub := newPublication()
+	for _, name := range []string{"InRelease", "main/binary-cats/Packages", "Release"} {
+		f, err := pub.create(filepath.Join(dir, name))
+		if err != nil {
+			t.Fatalf("error staging %s: %s", name, err)
+		}
+		f.WriteString("new " + name)
+		f.Close()
+	}
+	pub.remove(dir + "/main/binary-cats/Packages.bz2")
+
+	// the staged files are visible through the publication only
+	if _, err := os.Stat(dir + "/Release"); !os.IsNotExist(err) {
+		t.Errorf("Release should not exist before commit")
+	}
+	if f, err := pub.open(dir + "/main/binary-cats/Packages.bz2"); !os.IsNotExist(err) {
+		f.Close()
+		t.Errorf("removed Packages.bz2 should not be opened, got %v", err)
+	}
+	indexFiles, err := pub.indexFiles(dir)
+	if err != nil {
+		t.Errorf("error listing index files: %s", err)
+	}
+	if len(indexFiles) != 1 || indexFiles[0] != dir+"/main/binary-cats/Packages" {
+		t.Errorf("indexFiles returned %v, should only list the staged Packages", indexFiles)
+	}
+
+	if err := pub.commit(); err != nil {
+		t.Errorf("error committing: %s", err)
+	}
+	for _, name := range []string{"InRelease", "main/binary-cats/Packages", "Release"} {
+		content, err := ioutil.ReadFile(filepath.Join(dir, name))
+		if err != nil || string(content) != "new "+name {
+			t.Errorf("%s was not published: %s", name, err)
+		}
+	}
+	if _, err := os.Stat(dir + "/main/binary-cats/Packages.bz2"); !os.IsNotExist(err) {
+		t.Errorf("Packages.bz2 should have been removed")
+	}
+
+	// files are renamed into place, there are no leftovers
+	files, _ := ioutil.ReadDir(dir)
+	for _, file := range files {
+		if strings.HasPrefix(file.Name(), ".") {
+			t.Errorf("staged file %s was left behind", file.Name())
+		}
+	}
+
+	// a discarded publication leaves everything as it was
+	pub = newPublication()
+	f, err := pub.create(dir + "/Release")
+	if err != nil {
+		t.Fatalf("error staging Release: %s", err)
+	}
+	f.WriteString("discarded")
+	f.Close()
+	pub.discard()
+	if content, _ := ioutil.ReadFile(dir + "/Release"); string(content) != "new Release" {
+		t.Errorf("Release should not have changed, contains %q", content)
+	}
+	if files, _ := ioutil.ReadDir(dir); len(files) != 3 {
+		t.Errorf("discarded files were left behind, found %d entries", len(files))
+	}
+
+	// a publication that fails partway puts back what it already moved into place
+	if err := os.MkdirAll(dir+"/main/binary-dogs/Packages/blocked", 0755); err != nil {
+		t.Errorf("error creating directory: %s\n", err)
+	}
+	pub = newPublication()
+	for _, name := range []string{"main/binary-cats/Packages", "main/binary-cats/Packages.gz", "main/binary-dogs/Packages", "Release"} {
+		f, err := pub.create(filepath.Join(dir, name))
+		if err != nil {
+			t.Fatalf("error staging %s: %s", name, err)
+		}
+		f.WriteString("failed " + name)
+		f.Close()
+	}
+	if err := pub.commit(); err == nil {
+		t.Errorf("commit should fail when a file can't be moved into place")
+	}
+	for _, name := range []string{"main/binary-cats/Packages", "Release"} {
+		if content, _ := ioutil.ReadFile(filepath.Join(dir, name)); string(content) != "new "+name {
+			t.Errorf("%s should have been put back, contains %q", name, content)
+		}
+	}
+	if _, err := os.Stat(dir + "/main/binary-cats/Packages.gz"); !os.IsNotExist(err) {
+		t.Errorf("Packages.gz should have been removed again")
+	}
+	if files, _ := ioutil.ReadDir(dir + "/main/binary-cats"); len(files) != 1 {
+		t.Errorf("failed publication left files behind, found %d entries", len(files))
+	}
+
+	if err := os.RemoveAll(pwd + "/testing"); err != nil {
+		t.Errorf("error cleaning up after publication: %s", err)
+	}
+}
+
+func TestRebuildRepoMetadataFailure(t *testing.T) {
+	pwd, err := os.Getwd()
+	if err != nil {
+		t.Errorf("Unable to get current working directory: %s", err)
+	}
+	config := conf{RootRepoPath: pwd + "/testing", SupportArch: []string{"cats"}, DistroNames: []string{"stable"}, Sections: []string{"main"}}
+	if err := createDirs(config); err != nil {
+		t.Errorf("createDirs() failed: %s", err)
+	}
+	archPath := config.ArchPath("stable", "main", "cats")
+	data, err := ioutil.ReadFile("samples/vim-tiny_7.4.052-1ubuntu3_amd64.deb")
+	if err != nil {
+		t.Errorf("error reading sample deb: %s", err)
+	}
+	if err := ioutil.WriteFile(archPath+"/vim.deb", data, 0644); err != nil {
+		t.Errorf("error writing deb: %s", err)
+	}
+	rebuildRepoMetadata(config, nil, archPath+"/vim.deb")
+	published, err := ioutil.ReadFile(archPath + "/Packages")
+	if err != nil {
+		t.Errorf("error reading Packages: %s", err)
+	}
+
+	// a broken package fails the rebuild, and the previous Packages stays in place
+	if err := ioutil.WriteFile(archPath+"/broken.deb", []byte("not a deb"), 0644); err != nil {
+		t.Errorf("error writing deb: %s", err)
+	}
+	rebuildRepoMetadata(config, nil, archPath+"/broken.deb")
+	current, err := ioutil.ReadFile(archPath + "/Packages")
+	if err != nil || string(current) != string(published) {
+		t.Errorf("Packages should not have changed after a failed rebuild (%v)", err)
+	}
+
+	if err := os.RemoveAll(config.RootRepoPath); err != nil {
+		t.Errorf("error cleaning up after rebuildRepoMetadata(): %s", err)
+	}
+}
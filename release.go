@@ -0,0 +1,145 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// releaseConf is the per-distro metadata written to the Release file. Suite and Codename default to the
+// distro name, every other field is left out of the Release file unless it is set.
+type releaseConf struct {
+	Origin      string `json:"origin"`
+	Label       string `json:"label"`
+	Suite       string `json:"suite"`
+	Codename    string `json:"codename"`
+	Version     string `json:"version"`
+	Description string `json:"description"`
+	// ValidFor is how long the Release file stays valid after it is generated, as a duration such as "168h"
+	ValidFor             string `json:"validFor"`
+	NotAutomatic         bool   `json:"notAutomatic"`
+	ButAutomaticUpgrades bool   `json:"butAutomaticUpgrades"`
+}
+
+// releaseFields returns the header fields of the Release file of a distro, in the order they are written.
+func releaseFields(config conf, distro string, date time.Time) ([]controlField, error) {
+	release := config.Releases[distro]
+	suite, codename := release.Suite, release.Codename
+	if suite == "" {
+		suite = distro
+	}
+	if codename == "" {
+		codename = distro
+	}
+
+	fields := []controlField{
+		{"Origin", release.Origin},
+		{"Label", release.Label},
+		{"Suite", suite},
+		{"Version", release.Version},
+		{"Codename", codename},
+		{"Components", strings.Join(config.Sections, " ")},
+		{"Architectures", strings.Join(config.SupportArch, " ")},
+		{"Description", release.Description},
+	}
+	if config.MergeArchAll && config.NoSupportForArchAll {
+		// tells apt that Architecture: all packages are already part of every arch's Packages file
+		fields = append(fields, controlField{"No-Support-for-Architecture-all", "Packages"})
+	}
+	fields = append(fields, controlField{"Date", date.Format("Mon, 02 Jan 2006 15:04:05 UTC")})
+	if release.ValidFor != "" {
+		validFor, err := time.ParseDuration(release.ValidFor)
+		if err != nil {
+			return nil, fmt.Errorf("invalid validFor for %s: %s", distro, err)
+		}
+		fields = append(fields, controlField{"Valid-Until", date.Add(validFor).Format("Mon, 02 Jan 2006 15:04:05 UTC")})
+	}
+	if release.NotAutomatic {
+		fields = append(fields, controlField{"NotAutomatic", "yes"})
+	}
+	if release.ButAutomaticUpgrades {
+		fields = append(fields, controlField{"ButAutomaticUpgrades", "yes"})
+	}
+	// index files are always published by hash too, see stageByHash
+	fields = append(fields, controlField{"Acquire-By-Hash", "yes"})
+
+	set := fields[:0]
+	for _, field := range fields {
+		if field.Value != "" {
+			set = append(set, field)
+		}
+	}
+	return set, nil
+}
+
+// releaseRefreshInterval returns how often Release files are checked for a Valid-Until that is getting
+// close: every hour, or a quarter of the shortest validFor if that is shorter. It is 0 when no distro
+// sets validFor.
+func releaseRefreshInterval(config conf) time.Duration {
+	var interval time.Duration
+	for _, distro := range config.DistroNames {
+		validFor, err := time.ParseDuration(config.Releases[distro].ValidFor)
+		if err != nil || validFor <= 0 {
+			continue
+		}
+		if check := validFor / 4; interval == 0 || check < interval {
+			interval = check
+		}
+	}
+	if interval > time.Hour {
+		return time.Hour
+	}
+	return interval
+}
+
+// releaseRefreshDue reports whether the Release file of a distro has to be signed again, because less than
+// half of its validity is left.
+func releaseRefreshDue(config conf, distro string, now time.Time) (bool, error) {
+	validFor, err := time.ParseDuration(config.Releases[distro].ValidFor)
+	if err != nil {
+		return false, fmt.Errorf("invalid validFor for %s: %s", distro, err)
+	}
+	release, err := ioutil.ReadFile(filepath.Join(config.RootRepoPath, "dists", distro, "Release"))
+	if os.IsNotExist(err) {
+		return true, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	validUntil, err := time.Parse("Mon, 02 Jan 2006 15:04:05 UTC", parseControl(string(release))["Valid-Until"])
+	if err != nil {
+		return true, nil
+	}
+	return validUntil.Sub(now) < validFor/2, nil
+}
+
+// refreshReleases signs the Release file of every distro with a validFor again once half of its validity
+// has passed, so a distro that sees no uploads for a while never publishes an expired Release file,
+// which apt refuses.
+func refreshReleases(config conf) {
+	if !config.EnableSigning {
+		return
+	}
+	for _, distro := range config.DistroNames {
+		if config.Releases[distro].ValidFor == "" {
+			continue
+		}
+		due, err := releaseRefreshDue(config, distro, Now().UTC())
+		if err != nil {
+			log.Printf("error checking the Release file of %s: %s", distro, err)
+			continue
+		}
+		if !due {
+			continue
+		}
+		if err := createRelease(config, distro); err != nil {
+			log.Printf("error signing the Release file of %s again: %s, nothing has been published", distro, err)
+		} else if *verbose {
+			log.Printf("Release file of %s has been signed again", distro)
+		}
+	}
+}
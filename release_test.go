@@ -0,0 +1,115 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+)
+
+var goodReleaseFields = `Origin: deb-simple
+Label: deb-simple experimental
+Suite: experimental
+Version: 2.0
+Codename: rc-buggy
+Components: main
+Architectures: amd64
+Description: Packages that are not ready yet
+Date: Thu, 20 Sep 2018 14:17:21 UTC
+Valid-Until: Thu, 27 Sep 2018 14:17:21 UTC
+NotAutomatic: yes
+ButAutomaticUpgrades: yes
+Acquire-By-Hash: yes
+`
+
+func TestReleaseFields(t *testing.T) {
+	date := time.Date(2018, 9, 20, 14, 17, 21, 0, time.UTC)
+	config := conf{SupportArch: []string{"amd64"}, DistroNames: []string{"stable", "experimental"}, Sections: []string{"main"}, Releases: map[string]releaseConf{
+		"experimental": {
+			Origin:               "deb-simple",
+			Label:                "deb-simple experimental",
+			Codename:             "rc-buggy",
+			Version:              "2.0",
+			Description:          "Packages that are not ready yet",
+			ValidFor:             "168h",
+			NotAutomatic:         true,
+			ButAutomaticUpgrades: true,
+		},
+	}}
+
+	fields, err := releaseFields(config, "experimental", date)
+	if err != nil {
+		t.Errorf("releaseFields() failed: %s", err)
+	}
+	if got := formatControlFields(fields); got != goodReleaseFields {
+		t.Errorf("Release fields do not match, returned value is:\n %s \n\n should be:\n %s", got, goodReleaseFields)
+	}
+
+	// distros without a release block keep the old defaults
+	fields, err = releaseFields(config, "stable", date)
+	if err != nil {
+		t.Errorf("releaseFields() failed: %s", err)
+	}
+	want := "Suite: stable\nCodename: stable\nComponents: main\nArchitectures: amd64\nDate: Thu, 20 Sep 2018 14:17:21 UTC\nAcquire-By-Hash: yes\n"
+	if got := formatControlFields(fields); got != want {
+		t.Errorf("Release fields do not match, returned value is:\n %s \n\n should be:\n %s", got, want)
+	}
+
+	config.Releases["stable"] = releaseConf{ValidFor: "a week"}
+	if _, err := releaseFields(config, "stable", date); err == nil {
+		t.Error("releaseFields() should have failed on an invalid validFor, it did not")
+	}
+}
+
+func TestRefreshReleases(t *testing.T) {
+	defer func(now func() time.Time) { Now = now }(Now)
+	date := time.Date(2018, 9, 20, 14, 17, 21, 0, time.UTC)
+	Now = func() time.Time { return date }
+
+	pwd, err := os.Getwd()
+	if err != nil {
+		t.Errorf("Unable to get current working directory: %s", err)
+	}
+	config := conf{RootRepoPath: pwd + "/testing", SupportArch: []string{"amd64"}, DistroNames: []string{"stable", "testing"}, Sections: []string{"main"},
+		EnableSigning: true, PrivateKey: "samples/subkeys.key", Releases: map[string]releaseConf{"stable": {ValidFor: "24h"}}}
+	if err := createDirs(config); err != nil {
+		t.Fatalf("createDirs() failed: %s", err)
+	}
+	if interval := releaseRefreshInterval(config); interval != time.Hour {
+		t.Errorf("releaseRefreshInterval() returned %s, should be 1h", interval)
+	}
+	config.Releases["testing"] = releaseConf{ValidFor: "2h"}
+	if interval := releaseRefreshInterval(config); interval != 30*time.Minute {
+		t.Errorf("releaseRefreshInterval() returned %s, should be 30m", interval)
+	}
+	delete(config.Releases, "testing")
+
+	releaseDate := func(distro string) string {
+		release, _ := ioutil.ReadFile(config.RootRepoPath + "/dists/" + distro + "/Release")
+		return parseControl(string(release))["Date"]
+	}
+	// a missing Release file is created
+	refreshReleases(config)
+	if got := releaseDate("stable"); got != "Thu, 20 Sep 2018 14:17:21 UTC" {
+		t.Fatalf("Release file of stable was not created, Date is %q", got)
+	}
+	if got := releaseDate("testing"); got != "" {
+		t.Errorf("Release file of testing has no validFor and should be left alone, Date is %q", got)
+	}
+
+	// it is signed again once half of its validity has passed
+	date = date.Add(11 * time.Hour)
+	refreshReleases(config)
+	if got := releaseDate("stable"); got != "Thu, 20 Sep 2018 14:17:21 UTC" {
+		t.Errorf("Release file of stable was signed again too early, Date is %q", got)
+	}
+	date = date.Add(2 * time.Hour)
+	refreshReleases(config)
+	if got := releaseDate("stable"); got != "Fri, 21 Sep 2018 03:17:21 UTC" {
+		t.Errorf("Release file of stable was not signed again, Date is %q", got)
+	}
+
+	if err := os.RemoveAll(config.RootRepoPath); err != nil {
+		t.Errorf("error cleaning up after refreshReleases(): %s", err)
+	}
+}
@@ -0,0 +1,210 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/boltdb/bolt"
+)
+
+// retentionPolicy limits how many builds of each package are kept in the arch and source directories of a
+// distro and section. An empty Distro or Section matches every distro or section.
+type retentionPolicy struct {
+	Distro  string `json:"distro"`
+	Section string `json:"section"`
+	// KeepVersions is how many of the newest versions of each package are kept, 0 keeps them all
+	KeepVersions int `json:"keepVersions"`
+	// MaxAge is how long a package is kept after it was uploaded, as a duration such as "720h".
+	// The newest version of a package is never removed because of its age.
+	MaxAge string `json:"maxAge"`
+}
+
+// RetentionPolicy returns the first configured retention policy matching a distro and section.
+func (c conf) RetentionPolicy(distro, section string) (retentionPolicy, bool) {
+	for _, policy := range c.Retention {
+		if (policy.Distro == "" || policy.Distro == distro) && (policy.Section == "" || policy.Section == section) {
+			return policy, true
+		}
+	}
+	return retentionPolicy{}, false
+}
+
+// retainedPackage is a package in an arch directory, as considered by the retention policy.
+type retainedPackage struct {
+	filename string
+	name     string
+	version  string
+	modTime  time.Time
+}
+
+// retentionLimits returns the policy of a distro and section along with its maxAge, and whether there is
+// anything to enforce.
+func retentionLimits(config conf, distro, section string) (retentionPolicy, time.Duration, bool, error) {
+	policy, ok := config.RetentionPolicy(distro, section)
+	if !ok || (policy.KeepVersions <= 0 && policy.MaxAge == "") {
+		return policy, 0, false, nil
+	}
+	var maxAge time.Duration
+	if policy.MaxAge != "" {
+		var err error
+		if maxAge, err = time.ParseDuration(policy.MaxAge); err != nil {
+			return policy, 0, false, fmt.Errorf("invalid maxAge for %s %s: %s", distro, section, err)
+		}
+	}
+	return policy, maxAge, true, nil
+}
+
+// outsideRetention returns the packages that fall outside policy, out of every version of each package
+// keyed by package name.
+func outsideRetention(policy retentionPolicy, maxAge time.Duration, byName map[string][]retainedPackage) []retainedPackage {
+	var expired []retainedPackage
+	now := Now()
+	for _, packages := range byName {
+		// newest version first
+		sort.SliceStable(packages, func(i, j int) bool {
+			return compareVersions(packages[i].version, packages[j].version) > 0
+		})
+		for i, pkg := range packages {
+			tooMany := policy.KeepVersions > 0 && i >= policy.KeepVersions
+			tooOld := maxAge > 0 && i > 0 && now.Sub(pkg.modTime) > maxAge
+			if tooMany || tooOld {
+				expired = append(expired, pkg)
+			}
+		}
+	}
+	sort.Slice(expired, func(i, j int) bool { return expired[i].filename < expired[j].filename })
+	return expired
+}
+
+// prunedUpload returns the error an upload gets when applying the retention policy removed one of names,
+// the files it published, right away, as happens to a version older than every version that is kept.
+func prunedUpload(removed, names []string, distro, section string) error {
+	for _, name := range names {
+		if contains(removed, name) {
+			return uploadErrorf(http.StatusConflict, "%s is older than the versions the retention policy of %s %s keeps, and has been removed again", name, distro, section)
+		}
+	}
+	return nil
+}
+
+// applyRetention removes the packages of an arch directory that fall outside the retention policy of its
+// distro and section, returning the names of the removed files.
+func applyRetention(config conf, db *bolt.DB, distro, section, arch string) ([]string, error) {
+	policy, maxAge, ok, err := retentionLimits(config, distro, section)
+	if !ok || err != nil {
+		return nil, err
+	}
+
+	entries, err := readArchEntries(config, db, distro, section, arch)
+	if err != nil {
+		return nil, err
+	}
+	byName := make(map[string][]retainedPackage)
+	for filename, entry := range entries {
+		fields := parseControl(entry.Control)
+		if fields["Package"] == "" {
+			continue
+		}
+		byName[fields["Package"]] = append(byName[fields["Package"]], retainedPackage{
+			filename: filename,
+			name:     fields["Package"],
+			version:  fields["Version"],
+			modTime:  time.Unix(0, entry.ModTime),
+		})
+	}
+
+	var removed []string
+	for _, pkg := range outsideRetention(policy, maxAge, byName) {
+		if err := removePackage(config, distro, section, arch, pkg.filename); err != nil {
+			return removed, fmt.Errorf("error removing %s: %s", pkg.filename, err)
+		}
+		if *verbose {
+			log.Printf("Retention policy removed %s %s from %s %s %s", pkg.name, pkg.version, distro, section, arch)
+		}
+		removed = append(removed, pkg.filename)
+	}
+	return removed, nil
+}
+
+// applySourceRetention removes the source packages of a distro and section that fall outside its
+// retention policy, along with the files only they reference, returning the names of the removed .dsc
+// files. The age of a source package is that of its .dsc.
+func applySourceRetention(config conf, distro, section string) ([]string, error) {
+	policy, maxAge, ok, err := retentionLimits(config, distro, section)
+	if !ok || err != nil {
+		return nil, err
+	}
+
+	sourcePath := config.SourcePath(distro, section)
+	dirList, err := ioutil.ReadDir(sourcePath)
+	if err != nil {
+		return nil, fmt.Errorf("scanning: %s: %s", sourcePath, err)
+	}
+	byName := make(map[string][]retainedPackage)
+	for _, file := range dirList {
+		if !strings.HasSuffix(file.Name(), ".dsc") {
+			continue
+		}
+		fields, _, err := readDsc(filepath.Join(sourcePath, file.Name()))
+		if err != nil {
+			log.Printf("error reading %s: %s", file.Name(), err)
+			continue
+		}
+		source := make(map[string]string)
+		for _, field := range fields {
+			source[field.Name] = field.Value
+		}
+		if source["Source"] == "" {
+			continue
+		}
+		byName[source["Source"]] = append(byName[source["Source"]], retainedPackage{
+			filename: file.Name(),
+			name:     source["Source"],
+			version:  source["Version"],
+			modTime:  file.ModTime(),
+		})
+	}
+
+	var removed []string
+	for _, pkg := range outsideRetention(policy, maxAge, byName) {
+		if err := removeSourcePackage(config, distro, section, pkg.filename); err != nil {
+			return removed, fmt.Errorf("error removing %s: %s", pkg.filename, err)
+		}
+		if *verbose {
+			log.Printf("Retention policy removed source %s %s from %s %s", pkg.name, pkg.version, distro, section)
+		}
+		removed = append(removed, pkg.filename)
+	}
+	return removed, nil
+}
+
+// sweepRetention applies the retention policy to every arch and source directory, rebuilding the metadata of the
+// ones that changed unless the directory watcher takes care of that.
+func sweepRetention(config conf, db *bolt.DB) {
+	for _, distro := range config.DistroNames {
+		for _, section := range config.Sections {
+			for _, arch := range config.SupportArch {
+				removed, err := applyRetention(config, db, distro, section, arch)
+				if err != nil {
+					log.Printf("error applying retention policy: %s", err)
+				}
+				if len(removed) > 0 && !config.EnableDirectoryWatching {
+					rebuildRepoMetadata(config, db, filepath.Join(config.ArchPath(distro, section, arch), removed[0]))
+				}
+			}
+			removed, err := applySourceRetention(config, distro, section)
+			if err != nil {
+				log.Printf("error applying retention policy: %s", err)
+			}
+			if len(removed) > 0 && !config.EnableDirectoryWatching {
+				rebuildRepoMetadata(config, db, filepath.Join(config.SourcePath(distro, section), "Sources"))
+			}
+		}
+	}
+}
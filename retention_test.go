@@ -0,0 +1,207 @@
+package main
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/blakesmith/ar"
+)
+
+// writeTestDeb builds a minimal package at path, with the given control file and no data files.
+func writeTestDeb(t testing.TB, path, control string) {
+	tarGz := func(name, content string) []byte {
+		var buf bytes.Buffer
+		gz := gzip.NewWriter(&buf)
+		tw := tar.NewWriter(gz)
+		if name != "" {
+			tw.WriteHeader(&tar.Header{Name: name, Mode: 0644, Size: int64(len(content)), Typeflag: tar.TypeReg})
+			tw.Write([]byte(content))
+		}
+		tw.Close()
+		gz.Close()
+		return buf.Bytes()
+	}
+
+	f, err := os.Create(path)
+	if err != nil {
+		t.Fatalf("error creating %s: %s", path, err)
+	}
+	defer f.Close()
+	w := ar.NewWriter(f)
+	w.WriteGlobalHeader()
+	for _, member := range []struct {
+		name string
+		data []byte
+	}{
+		{"debian-binary", []byte("2.0\n")},
+		{"control.tar.gz", tarGz("./control", control)},
+		{"data.tar.gz", tarGz("", "")},
+	} {
+		w.WriteHeader(&ar.Header{Name: member.name, ModTime: time.Unix(0, 0), Mode: 0644, Size: int64(len(member.data))})
+		if _, err := w.Write(member.data); err != nil {
+			t.Fatalf("error writing %s: %s", path, err)
+		}
+	}
+}
+
+func TestApplyRetention(t *testing.T) {
+	pwd, err := os.Getwd()
+	if err != nil {
+		t.Errorf("Unable to get current working directory: %s", err)
+	}
+	config := conf{RootRepoPath: pwd + "/testing", SupportArch: []string{"all"}, DistroNames: []string{"stable", "testing"}, Sections: []string{"main"},
+		Retention: []retentionPolicy{{Distro: "stable", KeepVersions: 2}, {MaxAge: "24h"}}}
+	if err := createDirs(config); err != nil {
+		t.Errorf("createDirs() failed: %s", err)
+	}
+
+	archPath := config.ArchPath("stable", "main", "all")
+	for _, version := range []string{"1.0-1", "1.0-10", "1.0-2", "1.0~rc1-1"} {
+		writeTestDeb(t, filepath.Join(archPath, "app_"+version+"_all.deb"), "Package: app\nVersion: "+version+"\nArchitecture: all\n")
+	}
+	writeTestDeb(t, filepath.Join(archPath, "other_0.1_all.deb"), "Package: other\nVersion: 0.1\nArchitecture: all\n")
+
+	removed, err := applyRetention(config, nil, "stable", "main", "all")
+	if err != nil {
+		t.Errorf("applyRetention() failed: %s", err)
+	}
+	want := []string{"app_1.0-1_all.deb", "app_1.0~rc1-1_all.deb"}
+	if strings.Join(removed, " ") != strings.Join(want, " ") {
+		t.Errorf("applyRetention() removed %v, should be %v", removed, want)
+	}
+	var left []string
+	files, _ := ioutil.ReadDir(archPath)
+	for _, file := range files {
+		left = append(left, file.Name())
+	}
+	sort.Strings(left)
+	want = []string{"app_1.0-10_all.deb", "app_1.0-2_all.deb", "other_0.1_all.deb"}
+	if strings.Join(left, " ") != strings.Join(want, " ") {
+		t.Errorf("after applyRetention() %v are left, should be %v", left, want)
+	}
+
+	// prune by age, but always keep the newest version
+	archPath = config.ArchPath("testing", "main", "all")
+	old := time.Now().Add(-48 * time.Hour)
+	for _, version := range []string{"1.0-1", "1.0-2"} {
+		path := filepath.Join(archPath, "app_"+version+"_all.deb")
+		writeTestDeb(t, path, "Package: app\nVersion: "+version+"\nArchitecture: all\n")
+		os.Chtimes(path, old, old)
+	}
+	writeTestDeb(t, filepath.Join(archPath, "app_0.9-1_all.deb"), "Package: app\nVersion: 0.9-1\nArchitecture: all\n")
+	removed, err = applyRetention(config, nil, "testing", "main", "all")
+	if err != nil {
+		t.Errorf("applyRetention() failed: %s", err)
+	}
+	if strings.Join(removed, " ") != "app_1.0-1_all.deb" {
+		t.Errorf("applyRetention() removed %v, should only remove app_1.0-1_all.deb", removed)
+	}
+
+	if err := os.RemoveAll(config.RootRepoPath); err != nil {
+		t.Errorf("error cleaning up after applyRetention(): %s", err)
+	}
+}
+
+func TestApplySourceRetention(t *testing.T) {
+	pwd, err := os.Getwd()
+	if err != nil {
+		t.Errorf("Unable to get current working directory: %s", err)
+	}
+	config := conf{RootRepoPath: pwd + "/testing", SupportArch: []string{"all"}, DistroNames: []string{"stable"}, Sections: []string{"main"},
+		Retention: []retentionPolicy{{KeepVersions: 2}}}
+	if err := createDirs(config); err != nil {
+		t.Errorf("createDirs() failed: %s", err)
+	}
+
+	// every revision shares the .orig tarball, which is only removed along with the last one
+	sourcePath := config.SourcePath("stable", "main")
+	files := map[string]string{"hello_1.0.orig.tar.gz": "orig", "hello_2.0.orig.tar.gz": "orig"}
+	for _, version := range []string{"1.0-1", "1.0-2", "2.0-1"} {
+		orig := "hello_" + strings.SplitN(version, "-", 2)[0] + ".orig.tar.gz"
+		debian := "hello_" + version + ".debian.tar.xz"
+		files[debian] = "debian"
+		files["hello_"+version+".dsc"] = "Format: 3.0 (quilt)\nSource: hello\nVersion: " + version + "\nFiles:\n" +
+			" 00000000000000000000000000000000 4 " + orig + "\n 00000000000000000000000000000000 6 " + debian + "\n"
+	}
+	for name, content := range files {
+		if err := ioutil.WriteFile(filepath.Join(sourcePath, name), []byte(content), 0644); err != nil {
+			t.Fatalf("error writing %s: %s", name, err)
+		}
+	}
+
+	removed, err := applySourceRetention(config, "stable", "main")
+	if err != nil {
+		t.Errorf("applySourceRetention() failed: %s", err)
+	}
+	if strings.Join(removed, " ") != "hello_1.0-1.dsc" {
+		t.Errorf("applySourceRetention() removed %v, should only remove hello_1.0-1.dsc", removed)
+	}
+	var left []string
+	dirList, _ := ioutil.ReadDir(sourcePath)
+	for _, file := range dirList {
+		left = append(left, file.Name())
+	}
+	want := []string{"hello_1.0-2.debian.tar.xz", "hello_1.0-2.dsc", "hello_1.0.orig.tar.gz", "hello_2.0-1.debian.tar.xz", "hello_2.0-1.dsc", "hello_2.0.orig.tar.gz"}
+	if strings.Join(left, " ") != strings.Join(want, " ") {
+		t.Errorf("after applySourceRetention() %v are left, should be %v", left, want)
+	}
+
+	if err := os.RemoveAll(config.RootRepoPath); err != nil {
+		t.Errorf("error cleaning up after applySourceRetention(): %s", err)
+	}
+}
+
+func TestUploadHandlerRetention(t *testing.T) {
+	pwd, err := os.Getwd()
+	if err != nil {
+		t.Errorf("Unable to get current working directory: %s", err)
+	}
+	config := conf{RootRepoPath: pwd + "/testing", SupportArch: []string{"all"}, DistroNames: []string{"stable"}, Sections: []string{"main"},
+		Retention: []retentionPolicy{{KeepVersions: 2}}}
+	if err := createDirs(config); err != nil {
+		t.Errorf("createDirs() failed: %s", err)
+	}
+	uploadHandle := uploadHandler(config, nil)
+	archPath := config.ArchPath("stable", "main", "all")
+	upload := func(version string) int {
+		path := filepath.Join(config.RootRepoPath, "app.deb")
+		writeTestDeb(t, path, "Package: app\nVersion: "+version+"\nArchitecture: all\n")
+		body, contentType := multipartBody(t, "app_"+version+"_all.deb="+path)
+		req, _ := http.NewRequest("POST", "/upload?distro=stable", body)
+		req.Header.Add("Content-Type", contentType)
+		w := httptest.NewRecorder()
+		uploadHandle.ServeHTTP(w, req)
+		return w.Code
+	}
+
+	for _, version := range []string{"1.0-2", "1.0-3"} {
+		if code := upload(version); code != http.StatusOK {
+			t.Errorf("uploadHandler POST of %s returned %v, should be %v", version, code, http.StatusOK)
+		}
+	}
+	// an older version than the ones that are kept would be removed right away, so it is refused
+	if code := upload("1.0-1"); code != http.StatusConflict {
+		t.Errorf("uploadHandler POST of an old version returned %v, should be %v", code, http.StatusConflict)
+	}
+	if _, err := os.Stat(filepath.Join(archPath, "app_1.0-1_all.deb")); !os.IsNotExist(err) {
+		t.Errorf("app_1.0-1_all.deb should not be published")
+	}
+	packages, _ := ioutil.ReadFile(filepath.Join(archPath, "Packages"))
+	if strings.Contains(string(packages), "Version: 1.0-1\n") || !strings.Contains(string(packages), "Version: 1.0-3\n") {
+		t.Errorf("Packages should list the kept versions only:\n%s", packages)
+	}
+
+	if err := os.RemoveAll(config.RootRepoPath); err != nil {
+		t.Errorf("error cleaning up after uploadHandler(): %s", err)
+	}
+}
@@ -0,0 +1,179 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os/exec"
+	"strings"
+
+	"golang.org/x/crypto/openpgp"
+	"golang.org/x/crypto/openpgp/armor"
+	"golang.org/x/crypto/openpgp/clearsign"
+	"golang.org/x/crypto/openpgp/packet"
+)
+
+// releaseSigner signs Release files. Whatever does the signing, detached signatures are written ASCII
+// armored, so Release.gpg and InRelease look the same to apt.
+type releaseSigner interface {
+	// detachSign writes an armored detached signature of message to w
+	detachSign(w io.Writer, message io.Reader) error
+	// clearSign writes message to w inline signed
+	clearSign(w io.Writer, message io.Reader) error
+}
+
+// externalSignerConf configures a program to sign Release files with instead of a private key, such
+// as gpg talking to an agent forwarded from another host. Each command is run with the Release file on
+// its standard input, and writes the signature to its standard output.
+type externalSignerConf struct {
+	// DetachSign makes a detached signature, armored or binary, such as ["gpg", "--detach-sign"]
+	DetachSign []string `json:"detachSign"`
+	// ClearSign makes an inline signature, such as ["gpg", "--clearsign"]
+	ClearSign []string `json:"clearSign"`
+	// PublicKey is the public key of the signer, served to clients and used to check every signature
+	// the commands make before it is published
+	PublicKey string `json:"publicKey"`
+}
+
+// newReleaseSigner returns the signer configured for Release files: the external signer when one is
+// configured, or the signing keys that are currently valid.
+func newReleaseSigner(config conf) (releaseSigner, error) {
+	if config.ExternalSigner != nil {
+		if len(config.ExternalSigner.DetachSign) == 0 || len(config.ExternalSigner.ClearSign) == 0 {
+			return nil, errors.New("externalSigner needs both a detachSign and a clearSign command")
+		}
+		return commandSigner(*config.ExternalSigner), nil
+	}
+	entities, err := activeSigningEntities(config, Now())
+	if err != nil {
+		return nil, err
+	}
+	return openpgpSigner(entities), nil
+}
+
+// openpgpSigner signs with private keys loaded in process, with every key at once.
+type openpgpSigner []*openpgp.Entity
+
+func (s openpgpSigner) detachSign(w io.Writer, message io.Reader) error {
+	// buffered as the message is signed once per key
+	data, err := ioutil.ReadAll(message)
+	if err != nil {
+		return err
+	}
+	// the signatures of every key go in a single armored block, which apt accepts if any of them verifies
+	signatures, err := armor.Encode(w, openpgp.SignatureType, nil)
+	if err != nil {
+		return err
+	}
+	for _, entity := range s {
+		if err := openpgp.DetachSign(signatures, entity, bytes.NewReader(data), nil); err != nil {
+			return err
+		}
+	}
+	return signatures.Close()
+}
+
+func (s openpgpSigner) clearSign(w io.Writer, message io.Reader) error {
+	var privateKeys []*packet.PrivateKey
+	for _, entity := range s {
+		privateKeys = append(privateKeys, entity.PrivateKey)
+	}
+	writer, err := clearsign.EncodeMulti(w, privateKeys, nil)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(writer, message); err != nil {
+		return err
+	}
+	return writer.Close()
+}
+
+// commandSigner signs by running external commands. Their output is checked before it is published,
+// so a misbehaving command can't publish something apt would reject: it has to be a signature of the
+// message, which verifies against PublicKey if that is configured.
+type commandSigner externalSignerConf
+
+func (s commandSigner) detachSign(w io.Writer, message io.Reader) error {
+	data, err := ioutil.ReadAll(message)
+	if err != nil {
+		return err
+	}
+	signature, err := runSigner(s.DetachSign, bytes.NewReader(data))
+	if err != nil {
+		return err
+	}
+	if block, err := armor.Decode(bytes.NewReader(signature)); err == nil {
+		if block.Type != openpgp.SignatureType {
+			return fmt.Errorf("%s wrote a %s instead of a signature", s.DetachSign[0], block.Type)
+		}
+		if signature, err = ioutil.ReadAll(block.Body); err != nil {
+			return fmt.Errorf("error reading signature from %s: %s", s.DetachSign[0], err)
+		}
+	}
+	// a binary signature is armored, and an armored one re-armored, so the output doesn't depend on the command
+	if _, err := packet.NewReader(bytes.NewReader(signature)).Next(); err != nil {
+		return fmt.Errorf("%s did not write a signature: %s", s.DetachSign[0], err)
+	}
+	if err := s.verify(bytes.NewReader(data), bytes.NewReader(signature)); err != nil {
+		return fmt.Errorf("signature written by %s does not verify: %s", s.DetachSign[0], err)
+	}
+	armored, err := armor.Encode(w, openpgp.SignatureType, nil)
+	if err != nil {
+		return err
+	}
+	if _, err := armored.Write(signature); err != nil {
+		return err
+	}
+	return armored.Close()
+}
+
+func (s commandSigner) clearSign(w io.Writer, message io.Reader) error {
+	data, err := ioutil.ReadAll(message)
+	if err != nil {
+		return err
+	}
+	signed, err := runSigner(s.ClearSign, bytes.NewReader(data))
+	if err != nil {
+		return err
+	}
+	block, _ := clearsign.Decode(signed)
+	if block == nil {
+		return fmt.Errorf("%s did not write a clearsigned message", s.ClearSign[0])
+	}
+	if !bytes.Equal(block.Plaintext, data) {
+		return fmt.Errorf("%s signed something else than the message it was given", s.ClearSign[0])
+	}
+	if err := s.verify(bytes.NewReader(block.Bytes), block.ArmoredSignature.Body); err != nil {
+		return fmt.Errorf("clearsigned message written by %s does not verify: %s", s.ClearSign[0], err)
+	}
+	_, err = w.Write(signed)
+	return err
+}
+
+// verify checks a binary detached signature of signed against PublicKey, when one is configured.
+func (s commandSigner) verify(signed, signature io.Reader) error {
+	if s.PublicKey == "" {
+		return nil
+	}
+	keyring, err := loadKeyring(s.PublicKey)
+	if err != nil {
+		return err
+	}
+	_, err = openpgp.CheckDetachedSignature(keyring, signed, signature)
+	return err
+}
+
+// runSigner runs a signing command with message on its standard input, and returns its output.
+func runSigner(command []string, message io.Reader) ([]byte, error) {
+	var stdout, stderr bytes.Buffer
+	cmd := exec.Command(command[0], command[1:]...)
+	cmd.Stdin = message
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+	if err := cmd.Run(); err != nil {
+		return nil, fmt.Errorf("error running %s: %s: %s", command[0], err, strings.TrimSpace(stderr.String()))
+	}
+	return stdout.Bytes(), nil
+}
@@ -0,0 +1,122 @@
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"strings"
+	"testing"
+
+	"golang.org/x/crypto/openpgp"
+	"golang.org/x/crypto/openpgp/clearsign"
+)
+
+// TestHelperSigner is run as the external signer by TestExternalSigner. It signs its standard input with
+// the key in DEB_SIMPLE_SIGNER_KEY the way its last argument says.
+func TestHelperSigner(t *testing.T) {
+	keyPath := os.Getenv("DEB_SIMPLE_SIGNER_KEY")
+	if keyPath == "" {
+		return
+	}
+	entity, err := createEntityFromPrivateKey(keyPath, passphraseConf{}, "")
+	if err != nil {
+		os.Stderr.WriteString(err.Error())
+		os.Exit(1)
+	}
+	switch os.Args[len(os.Args)-1] {
+	case "detach":
+		err = openpgp.DetachSign(os.Stdout, entity, os.Stdin, nil)
+	case "armored-detach":
+		err = openpgp.ArmoredDetachSign(os.Stdout, entity, os.Stdin, nil)
+	case "clearsign":
+		w, _ := clearsign.Encode(os.Stdout, entity.PrivateKey, nil)
+		message, _ := ioutil.ReadAll(os.Stdin)
+		w.Write(message)
+		err = w.Close()
+	case "clearsign-other":
+		w, _ := clearsign.Encode(os.Stdout, entity.PrivateKey, nil)
+		w.Write([]byte("Suite: other\n"))
+		err = w.Close()
+	case "fail":
+		os.Stderr.WriteString("no agent")
+		os.Exit(2)
+	default:
+		os.Stdout.WriteString("not a signature")
+	}
+	if err != nil {
+		os.Stderr.WriteString(err.Error())
+		os.Exit(1)
+	}
+	os.Exit(0)
+}
+
+func TestExternalSigner(t *testing.T) {
+	pwd, err := os.Getwd()
+	if err != nil {
+		t.Errorf("Unable to get current working directory: %s", err)
+	}
+	if err := os.MkdirAll(pwd+"/testing/dists/stable/main/binary-cats", 0755); err != nil {
+		t.Errorf("error creating directory: %s\n", err)
+	}
+	entity, publicKey, privateKey := createKeyPair("deb-simple Agent", "", "agent@go.go")
+	if err := ioutil.WriteFile(pwd+"/testing/agent.key", []byte(privateKey), 0600); err != nil {
+		t.Fatalf("error writing key: %s", err)
+	}
+	if err := ioutil.WriteFile(pwd+"/testing/agent.pub", []byte(publicKey), 0644); err != nil {
+		t.Fatalf("error writing key: %s", err)
+	}
+	_, otherKey, _ := createKeyPair("deb-simple Other", "", "other@go.go")
+	if err := ioutil.WriteFile(pwd+"/testing/other.pub", []byte(otherKey), 0644); err != nil {
+		t.Fatalf("error writing key: %s", err)
+	}
+	os.Setenv("DEB_SIMPLE_SIGNER_KEY", pwd+"/testing/agent.key")
+	defer os.Unsetenv("DEB_SIMPLE_SIGNER_KEY")
+	helper := func(mode string) []string {
+		return []string{os.Args[0], "-test.run=TestHelperSigner", "--", mode}
+	}
+	keyring := openpgp.EntityList{entity}
+
+	config := conf{ListenPort: "9666", RootRepoPath: pwd + "/testing", SupportArch: []string{"cats"}, DistroNames: []string{"stable"}, Sections: []string{"main"}, EnableSigning: true}
+	for _, detach := range []string{"detach", "armored-detach"} {
+		config.ExternalSigner = &externalSignerConf{DetachSign: helper(detach), ClearSign: helper("clearsign"), PublicKey: pwd + "/testing/agent.pub"}
+		if err := createRelease(config, "stable"); err != nil {
+			t.Fatalf("error creating Releases file with %s: %s", detach, err)
+		}
+		release, _ := ioutil.ReadFile(config.RootRepoPath + "/dists/stable/Release")
+		releaseGpg, _ := ioutil.ReadFile(config.RootRepoPath + "/dists/stable/Release.gpg")
+		if !strings.HasPrefix(string(releaseGpg), "-----BEGIN PGP SIGNATURE-----\n\n") {
+			t.Errorf("Release.gpg signed with %s is not armored like the built in signer's:\n%s", detach, releaseGpg)
+		}
+		if _, err := checkSignature(keyring, bytes.NewReader(release), releaseGpg); err != nil {
+			t.Errorf("Release.gpg signed with %s does not verify: %s", detach, err)
+		}
+		inRelease, _ := ioutil.ReadFile(config.RootRepoPath + "/dists/stable/InRelease")
+		block, _ := clearsign.Decode(inRelease)
+		if block == nil {
+			t.Fatalf("InRelease is not clearsigned:\n%s", inRelease)
+		}
+		if _, err := openpgp.CheckDetachedSignature(keyring, bytes.NewReader(block.Bytes), block.ArmoredSignature.Body); err != nil {
+			t.Errorf("InRelease does not verify: %s", err)
+		}
+	}
+
+	// nothing is published when the signer fails or writes something else than a signature
+	for _, signer := range []*externalSignerConf{
+		{DetachSign: helper("fail"), ClearSign: helper("clearsign")},
+		{DetachSign: helper("garbage"), ClearSign: helper("clearsign")},
+		{DetachSign: helper("detach"), ClearSign: helper("garbage")},
+		{DetachSign: helper("detach")},
+		{DetachSign: helper("detach"), ClearSign: helper("clearsign-other")},
+		{DetachSign: helper("detach"), ClearSign: helper("clearsign"), PublicKey: pwd + "/testing/other.pub"},
+		{DetachSign: helper("armored-detach"), ClearSign: helper("clearsign"), PublicKey: pwd + "/testing/other.pub"},
+	} {
+		config.ExternalSigner = signer
+		if err := createRelease(config, "stable"); err == nil {
+			t.Errorf("createRelease() with %v should fail", signer)
+		}
+	}
+
+	if err := os.RemoveAll(config.RootRepoPath); err != nil {
+		t.Errorf("error cleaning up after createRelease(): %s", err)
+	}
+}
@@ -2,26 +2,31 @@ package main
 
 import (
 	"bytes"
-	"crypto/md5"
-	"crypto/sha1"
-	"crypto/sha256"
-	"encoding/hex"
 	"fmt"
 	"io"
+	"io/ioutil"
 	"log"
 	"os"
 	"path/filepath"
 	"strings"
+	"time"
 
 	"golang.org/x/crypto/openpgp"
 	"golang.org/x/crypto/openpgp/armor"
-	"golang.org/x/crypto/openpgp/clearsign"
 	"golang.org/x/crypto/openpgp/packet"
 )
 
-// createRelease scans for Packages files and builds a Release file summary, then signs it with a key.
-// Both Packages and Packages.gz files are included and hashed.
+// createRelease rebuilds, signs and publishes the Release file of a distro.
 func createRelease(config conf, distro string) error {
+	return publish(func(pub *publication) error {
+		return stageRelease(pub, config, distro)
+	})
+}
+
+// stageRelease scans for index files and builds a Release file summary, then signs it with a key.
+// Every compressed variant of the Packages, Sources and Contents files is included and hashed,
+// as staged in pub, so the Release file matches the index files it is published with.
+func stageRelease(pub *publication, config conf, distro string) error {
 
 	if *verbose {
 		log.Printf("Creating release file for \"%s\"", distro)
@@ -29,128 +34,130 @@ func createRelease(config conf, distro string) error {
 
 	workingDirectory := filepath.Join(config.RootRepoPath, "dists", distro)
 
-	outfile, err := os.Create(filepath.Join(workingDirectory, "Release"))
+	outfile, err := pub.create(filepath.Join(workingDirectory, "Release"))
 	if err != nil {
 		return fmt.Errorf("failed to create Release: %s", err)
 	}
 	defer outfile.Close()
 
-	currentTime := Now().UTC()
-	fmt.Fprintf(outfile, "Suite: %s\n", distro)
-	fmt.Fprintf(outfile, "Codename: %s\n", distro)
-	fmt.Fprintf(outfile, "Components: %s\n", strings.Join(config.Sections, " "))
-	fmt.Fprintf(outfile, "Architectures: %s\n", strings.Join(config.SupportArch, " "))
-	fmt.Fprintf(outfile, "Date: %s\n", currentTime.Format("Mon, 02 Jan 2006 15:04:05 UTC"))
+	fields, err := releaseFields(config, distro, Now().UTC())
+	if err != nil {
+		return err
+	}
+	outfile.WriteString(formatControlFields(fields))
 
-	var md5Sums strings.Builder
-	var sha1Sums strings.Builder
-	var sha256Sums strings.Builder
+	checksums := config.Checksums()
+	sums := make([]strings.Builder, len(checksums))
+	byHash := make(map[string]fileHashes)
 
-	err = filepath.Walk(workingDirectory, func(path string, file os.FileInfo, err error) error {
+	indexFiles, err := pub.indexFiles(workingDirectory)
+	if err != nil {
+		return fmt.Errorf("Error scanning for Packages files: %s", err)
+	}
+	for _, path := range indexFiles {
+		relPath, _ := filepath.Rel(workingDirectory, path)
+		spath := filepath.ToSlash(relPath)
+		f, err := pub.open(path)
 		if err != nil {
-			return err
+			return fmt.Errorf("Error opening %s for reading: %s", spath, err)
 		}
 
-		if strings.HasSuffix(path, "Packages.gz") || strings.HasSuffix(path, "Packages") {
-
-			var (
-				md5hash    = md5.New()
-				sha1hash   = sha1.New()
-				sha256hash = sha256.New()
-			)
-
-			relPath, _ := filepath.Rel(workingDirectory, path)
-			spath := filepath.ToSlash(relPath)
-			f, err := os.Open(path)
-
-			if err != nil {
-				log.Println("Error opening the Packages file for reading", err)
-			}
-
-			if _, err = io.Copy(io.MultiWriter(md5hash, sha1hash, sha256hash), f); err != nil {
-				return fmt.Errorf("Error hashing file for Release list: %s", err)
-			}
-			fmt.Fprintf(&md5Sums, " %s %d %s\n",
-				hex.EncodeToString(md5hash.Sum(nil)),
-				file.Size(), spath)
-			fmt.Fprintf(&sha1Sums, " %s %d %s\n",
-				hex.EncodeToString(sha1hash.Sum(nil)),
-				file.Size(), spath)
-			fmt.Fprintf(&sha256Sums, " %s %d %s\n",
-				hex.EncodeToString(sha256hash.Sum(nil)),
-				file.Size(), spath)
-
-			f = nil
+		hashes, err := hashReader(f, checksums...)
+		f.Close()
+		if err != nil {
+			return fmt.Errorf("Error hashing file for Release list: %s", err)
 		}
-		return nil
-	})
+		for i, checksum := range checksums {
+			fmt.Fprintf(&sums[i], " %s %d %s\n", hashes.get(checksum.name), hashes.Size, spath)
+		}
+		byHash[path] = hashes
+	}
 
-	if err != nil {
-		return fmt.Errorf("Error scanning for Packages files: %s", err)
+	if err := stageByHash(pub, config, byHash); err != nil {
+		return fmt.Errorf("Error creating by-hash files: %s", err)
 	}
 
-	outfile.WriteString("MD5Sum:\n")
-	outfile.WriteString(md5Sums.String())
-	outfile.WriteString("SHA1:\n")
-	outfile.WriteString(sha1Sums.String())
-	outfile.WriteString("SHA256:\n")
-	outfile.WriteString(sha256Sums.String())
+	for i, checksum := range checksums {
+		outfile.WriteString(checksum.release + ":\n")
+		outfile.WriteString(sums[i].String())
+	}
 
-	if err = signRelease(config, outfile.Name()); err != nil {
+	if err = signRelease(pub, config, filepath.Join(workingDirectory, "Release")); err != nil {
 		return fmt.Errorf("Error signing Release file: %s", err)
 	}
 
 	return nil
 }
 
-// signRelease takes the path to an existing Release file, and signs it with the configured private key.
-// Both Release.gpg (detached signature) and InRelease (inline signature) will be generated, in order to
-// ensure maximum compatibility
-func signRelease(config conf, filename string) error {
+// signRelease takes the path to a staged Release file, and signs it with the configured signer. Both
+// Release.gpg (detached signature) and InRelease (inline signature) will be generated, in order to ensure
+// maximum compatibility
+func signRelease(pub *publication, config conf, filename string) error {
 
 	if *verbose {
 		log.Printf("Signing release file \"%s\"", filename)
 	}
 
-	entity := createEntityFromPrivateKey(config.PrivateKey)
+	signer, err := newReleaseSigner(config)
+	if err != nil {
+		return err
+	}
 
 	workingDirectory := filepath.Dir(filename)
 
-	releaseFile, err := os.Open(filename)
+	releaseFile, err := pub.open(filename)
 	if err != nil {
 		return fmt.Errorf("Error opening Release file (%s) for writing: %s", filename, err)
 	}
+	defer releaseFile.Close()
 
-	releaseGpg, err := os.Create(filepath.Join(workingDirectory, "Release.gpg"))
+	releaseGpg, err := pub.create(filepath.Join(workingDirectory, "Release.gpg"))
 	if err != nil {
 		return fmt.Errorf("Error creating Release.gpg file for writing: %s", err)
 	}
 	defer releaseGpg.Close()
 
-	err = openpgp.ArmoredDetachSign(releaseGpg, entity, releaseFile, nil)
-	if err != nil {
+	if err := signer.detachSign(releaseGpg, releaseFile); err != nil {
 		return fmt.Errorf("Error writing signature to Release.gpg file: %s", err)
 	}
 
 	releaseFile.Seek(0, 0)
 
-	inlineRelease, err := os.Create(filepath.Join(workingDirectory, "InRelease"))
+	inlineRelease, err := pub.create(filepath.Join(workingDirectory, "InRelease"))
 	if err != nil {
 		return fmt.Errorf("Error creating InRelease file for writing: %s", err)
 	}
 	defer inlineRelease.Close()
 
-	writer, err := clearsign.Encode(inlineRelease, entity.PrivateKey, nil)
-	if err != nil {
+	if err := signer.clearSign(inlineRelease, releaseFile); err != nil {
 		return fmt.Errorf("Error signing InRelease file : %s", err)
 	}
 
-	io.Copy(writer, releaseFile)
-	writer.Close()
-
 	return nil
 }
 
+// loadKeyring reads a keyring of trusted public keys, which may be ASCII armored, as exported by
+// gpg --armor, or binary.
+func loadKeyring(path string) (openpgp.EntityList, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("error reading keyring: %s", err)
+	}
+	if block, err := armor.Decode(bytes.NewReader(data)); err == nil {
+		return openpgp.ReadKeyRing(block.Body)
+	}
+	return openpgp.ReadKeyRing(bytes.NewReader(data))
+}
+
+// checkSignature checks a detached signature, armored or binary, of signed against keyring and returns
+// the key that made it.
+func checkSignature(keyring openpgp.EntityList, signed io.Reader, signature []byte) (*openpgp.Entity, error) {
+	if bytes.HasPrefix(bytes.TrimSpace(signature), []byte("-----BEGIN")) {
+		return openpgp.CheckArmoredDetachedSignature(keyring, signed, bytes.NewReader(signature))
+	}
+	return openpgp.CheckDetachedSignature(keyring, signed, bytes.NewReader(signature))
+}
+
 // createKeyPair generates a new OpenPGP Entity with the provided name, comment and email.
 // The keys are returned as ASCII Armor encoded strings, ready to write to files.
 func createKeyPair(name, comment, email string) (*openpgp.Entity, string, string) {
@@ -194,45 +201,109 @@ func createKeyPair(name, comment, email string) (*openpgp.Entity, string, string
 	return entity, publicKey, privateKey
 }
 
-// createEntityFromPrivateKey creates a new OpenPGP Entity objects from the provided private key path.
-// The key should be in ASCII Armour format.
+// createEntityFromPrivateKey reads the ASCII armored private keyring at privateKeyPath, and returns an
+// OpenPGP Entity holding the key to sign with, decrypted with passphrase if it is protected by one.
+// The key is picked from the keyring by fingerprint, which may be that of a primary key or a subkey,
+// or is the first key with a private part when fingerprint is empty.
 // The returned entity can be used to sign files - the public key / identity is not needed.
-func createEntityFromPrivateKey(privateKeyPath string) *openpgp.Entity {
+func createEntityFromPrivateKey(privateKeyPath string, passphrase passphraseConf, fingerprint string) (*openpgp.Entity, error) {
+
+	signingKey, err := readSigningKey(privateKeyPath, fingerprint)
+	if err != nil {
+		return nil, err
+	}
+
+	if signingKey.PrivateKey.Encrypted {
+		if err := decryptPrivateKey(signingKey.PrivateKey, passphrase); err != nil {
+			return nil, fmt.Errorf("Error decrypting private key %s: %s", privateKeyPath, err)
+		}
+	}
+
+	e := openpgp.Entity{
+		PrimaryKey: signingKey.PublicKey,
+		PrivateKey: signingKey.PrivateKey,
+	}
+
+	return &e, nil
+}
+
+// readSigningKey reads the ASCII armored private keyring at privateKeyPath, and returns the key to sign
+// with, as createEntityFromPrivateKey picks it. The returned *openpgp.Key holds the primary key or subkey
+// to sign with, and its Entity field the entity that key belongs to. The key is not decrypted.
+func readSigningKey(privateKeyPath, fingerprint string) (*openpgp.Key, error) {
 
 	privateKeyData, err := os.Open(privateKeyPath)
 
 	if err != nil {
-		log.Fatalf("Error opening private key file: %s", err)
+		return nil, fmt.Errorf("Error opening private key file: %s", err)
 	}
 	defer privateKeyData.Close()
 
-	block, err := armor.Decode(privateKeyData)
+	keyring, err := openpgp.ReadArmoredKeyRing(privateKeyData)
 
 	if err != nil {
-		log.Fatalf("Error decoding private key data: %s", err)
+		return nil, fmt.Errorf("Error reading private key data: %s", err)
 	}
 
-	if block.Type != openpgp.PrivateKeyType {
-		log.Fatalf("Invalid private key type %s", block.Type)
+	var signingKey *openpgp.Key
+	for _, entity := range keyring {
+		if signingKey, err = selectSigningKey(entity, normalizeFingerprint(fingerprint), Now()); signingKey != nil || err != nil {
+			break
+		}
 	}
-
-	reader := packet.NewReader(block.Body)
-	pkt, err := reader.Next()
-
 	if err != nil {
-		log.Fatalf("Error reading private key data: %s", err)
+		return nil, fmt.Errorf("Error selecting signing key in %s: %s", privateKeyPath, err)
+	}
+	if signingKey == nil {
+		if fingerprint != "" {
+			return nil, fmt.Errorf("No private key with fingerprint %s in %s", fingerprint, privateKeyPath)
+		}
+		return nil, fmt.Errorf("No private key in %s", privateKeyPath)
 	}
+	return signingKey, nil
+}
 
-	privateKey, ok := pkt.(*packet.PrivateKey)
-	if !ok {
-		log.Fatalf("Error parsing private key")
+// selectSigningKey picks the key of entity to sign with. fingerprint selects a subkey, or the primary
+// key, in which case the signing subkey gpg would use is picked like it is without a fingerprint: the
+// first valid signing subkey, or the primary key itself if it has none and may sign. A nil key is returned
+// if entity has no private key, or none with the fingerprint.
+func selectSigningKey(entity *openpgp.Entity, fingerprint string, now time.Time) (*openpgp.Key, error) {
+	canSign := func(subkey openpgp.Subkey) bool {
+		return subkey.PrivateKey != nil && subkey.PublicKey.PubKeyAlgo.CanSign() && subkey.Sig.FlagsValid && subkey.Sig.FlagSign &&
+			subkey.Sig.SigType != packet.SigTypeSubkeyRevocation && !subkey.Sig.KeyExpired(now)
 	}
 
-	e := openpgp.Entity{
-		PrivateKey: privateKey,
+	for _, subkey := range entity.Subkeys {
+		if fingerprint != "" && publicKeyFingerprint(subkey.PublicKey) == fingerprint {
+			if !canSign(subkey) {
+				return nil, fmt.Errorf("subkey %s can't be used for signing", fingerprint)
+			}
+			return &openpgp.Key{Entity: entity, PublicKey: subkey.PublicKey, PrivateKey: subkey.PrivateKey, SelfSignature: subkey.Sig}, nil
+		}
+	}
+	if fingerprint != "" && keyFingerprint(entity) != fingerprint {
+		return nil, nil
 	}
 
-	return &e
+	for _, subkey := range entity.Subkeys {
+		if canSign(subkey) {
+			return &openpgp.Key{Entity: entity, PublicKey: subkey.PublicKey, PrivateKey: subkey.PrivateKey, SelfSignature: subkey.Sig}, nil
+		}
+	}
+	if entity.PrivateKey == nil {
+		if fingerprint != "" {
+			return nil, fmt.Errorf("key %s has no private signing key", fingerprint)
+		}
+		return nil, nil
+	}
+	maySign := len(entity.Identities) == 0
+	for _, identity := range entity.Identities {
+		maySign = maySign || !identity.SelfSignature.FlagsValid || identity.SelfSignature.FlagSign
+	}
+	if !maySign {
+		return nil, fmt.Errorf("key %s may not sign and has no signing subkey", keyFingerprint(entity))
+	}
+	return &openpgp.Key{Entity: entity, PublicKey: entity.PrimaryKey, PrivateKey: entity.PrivateKey}, nil
 }
 
 // createKeyHandler generates a new public and private key pair, and writes them out to workingDirectory.
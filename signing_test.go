@@ -3,13 +3,16 @@ package main
 import (
 	"bytes"
 	"io"
+	"io/ioutil"
 	"log"
 	"os"
+	"strings"
 	"testing"
 	"time"
 
 	"golang.org/x/crypto/openpgp"
 	"golang.org/x/crypto/openpgp/armor"
+	"golang.org/x/crypto/openpgp/clearsign"
 	"golang.org/x/crypto/openpgp/packet"
 )
 
@@ -18,6 +21,7 @@ Codename: stable
 Components: main blah
 Architectures: cats dogs
 Date: Thu, 20 Sep 2018 14:17:21 UTC
+Acquire-By-Hash: yes
 MD5Sum:
  40fb9665d0d186102bad50191484910f 1307 main/binary-cats/Packages
  5f05d1302a6a356198b2d2ffffa7933d 820 main/binary-cats/Packages.gz
@@ -89,6 +93,20 @@ func TestCreateRelease(t *testing.T) {
 		t.Errorf("Releases does not match, returned value is:\n %s \n\n should be:\n %s", buf.String(), goodReleaseOutput)
 	}
 
+	// merged Architecture: all packages are announced to apt
+	config.MergeArchAll = true
+	config.NoSupportForArchAll = true
+	if err := createRelease(config, "stable"); err != nil {
+		t.Errorf("error creating Releases file: %s", err)
+	}
+	release, err := ioutil.ReadFile(config.RootRepoPath + "/dists/stable/Release")
+	if err != nil {
+		t.Errorf("error reading Release file: %s", err)
+	}
+	if !strings.Contains(string(release), "Architectures: cats dogs\nNo-Support-for-Architecture-all: Packages\n") {
+		t.Errorf("Release does not contain No-Support-for-Architecture-all, returned value is:\n %s", release)
+	}
+
 	if err := os.RemoveAll(config.RootRepoPath); err != nil {
 		t.Errorf("error cleaning up after createRelease(): %s", err)
 	}
@@ -201,6 +219,205 @@ func TestSignRelease(t *testing.T) {
 	}
 }
 
+func TestSignReleaseMultipleKeys(t *testing.T) {
+	defer func(now func() time.Time) { Now = now }(Now)
+	Now = func() time.Time {
+		return time.Date(2018, 9, 20, 14, 17, 21, 000000000, time.UTC)
+	}
+
+	pwd, err := os.Getwd()
+	if err != nil {
+		t.Errorf("Unable to get current working directory: %s", err)
+	}
+	if err := os.MkdirAll(pwd+"/testing/dists/stable/main/binary-cats", 0755); err != nil {
+		t.Errorf("error creating directory: %s\n", err)
+	}
+	writeKey := func(name string) *openpgp.Entity {
+		entity, _, privateKey := createKeyPair("deb-simple "+name, "", name+"@go.go")
+		if err := ioutil.WriteFile(pwd+"/testing/"+name+".key", []byte(privateKey), 0600); err != nil {
+			t.Fatalf("error writing %s key: %s", name, err)
+		}
+		return entity
+	}
+	oldKey, newKey, retiredKey := writeKey("old"), writeKey("new"), writeKey("retired")
+
+	config := conf{ListenPort: "9666", RootRepoPath: pwd + "/testing", SupportArch: []string{"cats"}, DistroNames: []string{"stable"}, Sections: []string{"main"}, EnableSigning: true,
+		SigningKeys: []signingKeyConf{
+			{Path: pwd + "/testing/old.key", NotAfter: "2018-10-01"},
+			{Path: pwd + "/testing/new.key", NotBefore: "2018-09-01T00:00:00Z"},
+			{Path: pwd + "/testing/retired.key", NotAfter: "2018-01-01"},
+		}}
+	if err := config.validateSigningKeys(); err != nil {
+		t.Errorf("validateSigningKeys() failed: %s", err)
+	}
+	if err := createRelease(config, "stable"); err != nil {
+		t.Fatalf("error creating Releases file: %s", err)
+	}
+
+	release, _ := ioutil.ReadFile(config.RootRepoPath + "/dists/stable/Release")
+	releaseGpg, _ := ioutil.ReadFile(config.RootRepoPath + "/dists/stable/Release.gpg")
+	inRelease, _ := ioutil.ReadFile(config.RootRepoPath + "/dists/stable/InRelease")
+	for _, test := range []struct {
+		name   string
+		key    *openpgp.Entity
+		signed bool
+	}{{"old", oldKey, true}, {"new", newKey, true}, {"retired", retiredKey, false}} {
+		keyring := openpgp.EntityList{test.key}
+		_, err := openpgp.CheckArmoredDetachedSignature(keyring, bytes.NewReader(release), bytes.NewReader(releaseGpg))
+		if (err == nil) != test.signed {
+			t.Errorf("Release.gpg signature by the %s key: %v, should be signed: %v", test.name, err, test.signed)
+		}
+		block, _ := clearsign.Decode(inRelease)
+		if block == nil {
+			t.Fatalf("InRelease is not clearsigned:\n%s", inRelease)
+		}
+		_, err = openpgp.CheckDetachedSignature(keyring, bytes.NewReader(block.Bytes), block.ArmoredSignature.Body)
+		if (err == nil) != test.signed {
+			t.Errorf("InRelease signature by the %s key: %v, should be signed: %v", test.name, err, test.signed)
+		}
+	}
+
+	// once every key has expired nothing is published
+	Now = func() time.Time {
+		return time.Date(2017, 1, 1, 0, 0, 0, 0, time.UTC)
+	}
+	config.SigningKeys = config.SigningKeys[1:2]
+	if err := createRelease(config, "stable"); err == nil {
+		t.Errorf("createRelease() should fail without a valid signing key")
+	}
+
+	config.SigningKeys[0].NotAfter = "next week"
+	if err := config.validateSigningKeys(); err == nil {
+		t.Errorf("validateSigningKeys() should reject an invalid date")
+	}
+
+	if err := os.RemoveAll(config.RootRepoPath); err != nil {
+		t.Errorf("error cleaning up after createRelease(): %s", err)
+	}
+}
+
+func TestEncryptedSigningKey(t *testing.T) {
+	pwd, err := os.Getwd()
+	if err != nil {
+		t.Errorf("Unable to get current working directory: %s", err)
+	}
+	if err := os.MkdirAll(pwd+"/testing/dists/stable/main/binary-cats", 0755); err != nil {
+		t.Errorf("error creating directory: %s\n", err)
+	}
+
+	// every source yields the first line only
+	if err := ioutil.WriteFile(pwd+"/testing/passphrase", []byte("deb-simple\nsecond line\n"), 0600); err != nil {
+		t.Fatalf("error writing passphrase file: %s", err)
+	}
+	os.Setenv("DEB_SIMPLE_TEST_PASSPHRASE", "deb-simple")
+	defer os.Unsetenv("DEB_SIMPLE_TEST_PASSPHRASE")
+	for _, passphrase := range []passphraseConf{{Env: "DEB_SIMPLE_TEST_PASSPHRASE"}, {File: pwd + "/testing/passphrase"}} {
+		if secret, err := passphrase.read(); err != nil || string(secret) != "deb-simple" {
+			t.Errorf("read() of %+v returned %q, %v", passphrase, secret, err)
+		}
+	}
+
+	config := conf{ListenPort: "9666", RootRepoPath: pwd + "/testing", SupportArch: []string{"cats"}, DistroNames: []string{"stable"}, Sections: []string{"main"}, EnableSigning: true, PrivateKey: "samples/encrypted.key"}
+	if err := createRelease(config, "stable"); err == nil {
+		t.Errorf("createRelease() should fail without the passphrase of the key")
+	}
+	config.PrivateKeyPassphrase = passphraseConf{File: pwd + "/testing/missing"}
+	if err := loadSigningKeys(config); err == nil {
+		t.Errorf("loadSigningKeys() should fail when the passphrase can't be read")
+	}
+	os.Setenv("DEB_SIMPLE_TEST_PASSPHRASE", "wrong")
+	config.PrivateKeyPassphrase = passphraseConf{Env: "DEB_SIMPLE_TEST_PASSPHRASE"}
+	if err := loadSigningKeys(config); err == nil {
+		t.Errorf("loadSigningKeys() should fail with the wrong passphrase")
+	}
+
+	os.Setenv("DEB_SIMPLE_TEST_PASSPHRASE", "deb-simple")
+	if err := loadSigningKeys(config); err != nil {
+		t.Errorf("loadSigningKeys() failed: %s", err)
+	}
+	// the decrypted key is kept, the passphrase isn't needed anymore
+	os.Unsetenv("DEB_SIMPLE_TEST_PASSPHRASE")
+	if err := createRelease(config, "stable"); err != nil {
+		t.Fatalf("error creating Releases file: %s", err)
+	}
+	keyring, err := loadKeyring("samples/encrypted.pub")
+	if err != nil {
+		t.Fatalf("loadKeyring() failed: %s", err)
+	}
+	release, _ := os.Open(config.RootRepoPath + "/dists/stable/Release")
+	defer release.Close()
+	releaseGpg, _ := ioutil.ReadFile(config.RootRepoPath + "/dists/stable/Release.gpg")
+	if _, err := checkSignature(keyring, release, releaseGpg); err != nil {
+		t.Errorf("Release.gpg is not signed by the encrypted key: %s", err)
+	}
+
+	if err := os.RemoveAll(config.RootRepoPath); err != nil {
+		t.Errorf("error cleaning up after createRelease(): %s", err)
+	}
+}
+
+func TestSigningSubkeys(t *testing.T) {
+	// samples/subkeys.key has a certify-only primary key, a signing subkey, an encryption subkey and
+	// another signing subkey
+	tests := []struct {
+		fingerprint string
+		keyID       string
+	}{
+		{"", "C2010DF9ACE6ACFE"},
+		{"C75E 922E 23F9 CEB9 653D  3325 B431 A69C 4895 0176", "C2010DF9ACE6ACFE"},
+		{"1690882091f99489cda0a1d8fae5382cac76bc7e", "FAE5382CAC76BC7E"},
+		// the encryption subkey
+		{"2D3FBC1D0E9E434393EEB5A57C744D1AF688151F", ""},
+		{"0000000000000000000000000000000000000000", ""},
+	}
+	for _, test := range tests {
+		entity, err := createEntityFromPrivateKey("samples/subkeys.key", passphraseConf{}, test.fingerprint)
+		if test.keyID == "" {
+			if err == nil {
+				t.Errorf("createEntityFromPrivateKey() with fingerprint %s should fail", test.fingerprint)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("createEntityFromPrivateKey() with fingerprint %q failed: %s", test.fingerprint, err)
+			continue
+		}
+		if entity.PrivateKey.KeyIdString() != test.keyID {
+			t.Errorf("createEntityFromPrivateKey() with fingerprint %q selected %s, should be %s", test.fingerprint, entity.PrivateKey.KeyIdString(), test.keyID)
+		}
+	}
+
+	pwd, err := os.Getwd()
+	if err != nil {
+		t.Errorf("Unable to get current working directory: %s", err)
+	}
+	if err := os.MkdirAll(pwd+"/testing/dists/stable/main/binary-cats", 0755); err != nil {
+		t.Errorf("error creating directory: %s\n", err)
+	}
+	config := conf{ListenPort: "9666", RootRepoPath: pwd + "/testing", SupportArch: []string{"cats"}, DistroNames: []string{"stable"}, Sections: []string{"main"}, EnableSigning: true,
+		PrivateKey: "samples/subkeys.key", PrivateKeyFingerprint: "1690882091F99489CDA0A1D8FAE5382CAC76BC7E"}
+	if err := createRelease(config, "stable"); err != nil {
+		t.Fatalf("error creating Releases file: %s", err)
+	}
+	keyring, err := loadKeyring("samples/subkeys.pub")
+	if err != nil {
+		t.Fatalf("loadKeyring() failed: %s", err)
+	}
+	release, _ := os.Open(config.RootRepoPath + "/dists/stable/Release")
+	defer release.Close()
+	releaseGpg, _ := ioutil.ReadFile(config.RootRepoPath + "/dists/stable/Release.gpg")
+	signer, err := checkSignature(keyring, release, releaseGpg)
+	if err != nil {
+		t.Errorf("Release.gpg is not signed by the subkey: %s", err)
+	} else if keyFingerprint(signer) != "C75E922E23F9CEB9653D3325B431A69C48950176" {
+		t.Errorf("Release.gpg is signed by %s", keyFingerprint(signer))
+	}
+
+	if err := os.RemoveAll(config.RootRepoPath); err != nil {
+		t.Errorf("error cleaning up after createRelease(): %s", err)
+	}
+}
+
 func createEntityFromPublicKey(publicKeyPath string) *openpgp.Entity {
 
 	publicKeyData, err := os.Open(publicKeyPath)
@@ -0,0 +1,28 @@
+//go:build unix
+
+package main
+
+import (
+	"os"
+	"syscall"
+	"testing"
+)
+
+func TestPassphraseFD(t *testing.T) {
+	r, w, err := os.Pipe()
+	if err != nil {
+		t.Fatalf("error creating pipe: %s", err)
+	}
+	w.WriteString("deb-simple\nsecond line\n")
+	w.Close()
+	defer r.Close()
+	// read() closes the descriptor it is given
+	fd, err := syscall.Dup(int(r.Fd()))
+	if err != nil {
+		t.Fatalf("error duplicating pipe: %s", err)
+	}
+	passphrase := passphraseConf{FD: &fd}
+	if secret, err := passphrase.read(); err != nil || string(secret) != "deb-simple" {
+		t.Errorf("read() of %+v returned %q, %v", passphrase, secret, err)
+	}
+}
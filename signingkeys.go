@@ -0,0 +1,200 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"sync"
+	"time"
+
+	"golang.org/x/crypto/openpgp"
+	"golang.org/x/crypto/openpgp/packet"
+)
+
+// signingKeyConf is a key Release files are signed with. A key is only used between NotBefore and
+// NotAfter, when set, so a new key can be phased in and an old one phased out without a config change
+// at the exact moment of a rotation.
+type signingKeyConf struct {
+	// Path is the ASCII armored private key file
+	Path string `json:"path"`
+	// NotBefore and NotAfter are dates such as "2024-06-01", or RFC 3339 times
+	NotBefore string `json:"notBefore"`
+	NotAfter  string `json:"notAfter"`
+	// Passphrase is where the passphrase of an encrypted key is read from
+	Passphrase passphraseConf `json:"passphrase"`
+	// Fingerprint selects the key to sign with when the file holds several, either a primary key or
+	// a signing subkey
+	Fingerprint string `json:"fingerprint"`
+}
+
+// passphraseConf tells where the passphrase of an encrypted private key comes from: an environment
+// variable, a file, or a file descriptor inherited from the process that started deb-simple.
+type passphraseConf struct {
+	Env  string `json:"env"`
+	File string `json:"file"`
+	FD   *int   `json:"fd"`
+}
+
+// read returns the passphrase. Like gpg, only the first line of a file or file descriptor is used.
+func (p passphraseConf) read() ([]byte, error) {
+	switch {
+	case p.Env != "":
+		passphrase, ok := os.LookupEnv(p.Env)
+		if !ok {
+			return nil, fmt.Errorf("environment variable %s is not set", p.Env)
+		}
+		return []byte(passphrase), nil
+	case p.File != "":
+		data, err := ioutil.ReadFile(p.File)
+		if err != nil {
+			return nil, fmt.Errorf("error reading passphrase file: %s", err)
+		}
+		line, _, _ := bytes.Cut(data, []byte("\n"))
+		return bytes.TrimSuffix(line, []byte("\r")), nil
+	case p.FD != nil:
+		f := os.NewFile(uintptr(*p.FD), "passphrase")
+		if f == nil {
+			return nil, fmt.Errorf("invalid passphrase file descriptor %d", *p.FD)
+		}
+		if *p.FD > 2 {
+			defer f.Close()
+		}
+		line, err := bufio.NewReader(f).ReadBytes('\n')
+		if err != nil && len(line) == 0 {
+			return nil, fmt.Errorf("error reading passphrase from file descriptor %d: %s", *p.FD, err)
+		}
+		return bytes.TrimRight(line, "\r\n"), nil
+	}
+	return nil, errors.New("key is encrypted, but no passphrase is configured")
+}
+
+// decryptPrivateKey decrypts an encrypted private key in place. The passphrase is wiped from memory
+// once it has been used.
+func decryptPrivateKey(privateKey *packet.PrivateKey, passphrase passphraseConf) error {
+	secret, err := passphrase.read()
+	if err != nil {
+		return err
+	}
+	defer func() {
+		for i := range secret {
+			secret[i] = 0
+		}
+	}()
+	return privateKey.Decrypt(secret)
+}
+
+// decryptedKeys holds the signing keys that were decrypted, keyed by path and fingerprint. They are only ever kept in
+// memory, and are loaded once as a passphrase from a file descriptor can't be read again.
+var decryptedKeys = struct {
+	sync.Mutex
+	entities map[string]*openpgp.Entity
+}{entities: make(map[string]*openpgp.Entity)}
+
+// loadSigningKey returns the private key of a signing key. Keys with a passphrase are only read and
+// decrypted the first time, others are read every time so they can be replaced on disk.
+func loadSigningKey(key signingKeyConf) (*openpgp.Entity, error) {
+	decryptedKeys.Lock()
+	defer decryptedKeys.Unlock()
+	id := key.Path + "#" + normalizeFingerprint(key.Fingerprint)
+	if entity, ok := decryptedKeys.entities[id]; ok {
+		return entity, nil
+	}
+	entity, err := createEntityFromPrivateKey(key.Path, key.Passphrase, key.Fingerprint)
+	if err != nil {
+		return nil, err
+	}
+	if key.Passphrase != (passphraseConf{}) {
+		decryptedKeys.entities[id] = entity
+	}
+	return entity, nil
+}
+
+// loadSigningKeys loads every configured signing key, so that a missing key or passphrase is reported
+// on startup rather than when the repo is first published.
+func loadSigningKeys(config conf) error {
+	for _, key := range config.ReleaseSigningKeys() {
+		if _, err := loadSigningKey(key); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// parseKeyDate parses a signing key date, either a plain date, meaning midnight UTC, or an RFC 3339 time.
+func parseKeyDate(value string) (time.Time, error) {
+	if date, err := time.Parse("2006-01-02", value); err == nil {
+		return date, nil
+	}
+	return time.Parse(time.RFC3339, value)
+}
+
+// active reports whether the key may sign at the given time.
+func (k signingKeyConf) active(at time.Time) (bool, error) {
+	if k.NotBefore != "" {
+		notBefore, err := parseKeyDate(k.NotBefore)
+		if err != nil {
+			return false, fmt.Errorf("invalid notBefore for %s: %s", k.Path, err)
+		}
+		if at.Before(notBefore) {
+			return false, nil
+		}
+	}
+	if k.NotAfter != "" {
+		notAfter, err := parseKeyDate(k.NotAfter)
+		if err != nil {
+			return false, fmt.Errorf("invalid notAfter for %s: %s", k.Path, err)
+		}
+		if at.After(notAfter) {
+			return false, nil
+		}
+	}
+	return true, nil
+}
+
+// ReleaseSigningKeys returns the keys configured to sign Release files, falling back to privateKey when
+// no signingKeys are configured.
+func (c conf) ReleaseSigningKeys() []signingKeyConf {
+	if len(c.SigningKeys) > 0 {
+		return c.SigningKeys
+	}
+	return []signingKeyConf{{Path: c.PrivateKey, Passphrase: c.PrivateKeyPassphrase, Fingerprint: c.PrivateKeyFingerprint}}
+}
+
+// validateSigningKeys checks that the validity dates of every signing key parse.
+func (c conf) validateSigningKeys() error {
+	for _, key := range c.SigningKeys {
+		for _, date := range []string{key.NotBefore, key.NotAfter} {
+			if _, err := parseKeyDate(date); date != "" && err != nil {
+				return fmt.Errorf("invalid date for %s: %s", key.Path, err)
+			}
+		}
+	}
+	return nil
+}
+
+// activeSigningEntities loads every signing key that is valid at the given time, in the order they
+// are configured.
+func activeSigningEntities(config conf, at time.Time) ([]*openpgp.Entity, error) {
+	var entities []*openpgp.Entity
+	for _, key := range config.ReleaseSigningKeys() {
+		active, err := key.active(at)
+		if err != nil {
+			return nil, err
+		}
+		if !active {
+			continue
+		}
+		entity, err := loadSigningKey(key)
+		if err != nil {
+			return nil, err
+		}
+		entities = append(entities, entity)
+	}
+	if len(entities) == 0 {
+		return nil, fmt.Errorf("no signing key is valid at %s", at.Format(time.RFC3339))
+	}
+	return entities, nil
+}
@@ -0,0 +1,397 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"golang.org/x/crypto/openpgp/clearsign"
+)
+
+// sourceFile is a file referenced by a .dsc or .changes, along with the size and checksums listed for it.
+type sourceFile struct {
+	Name string
+	// Section is the section a .changes lists the file under, it is empty for a .dsc
+	Section string
+	fileHashes
+}
+
+// sourceTarballSuffixes lists the compressions of the tarballs a source package can be made of, such as
+// hello_1.0.orig.tar.gz, hello_1.0-1.debian.tar.xz or the single tarball of a native package.
+var sourceTarballSuffixes = []string{".tar.gz", ".tar.xz", ".tar.bz2", ".tar.lzma"}
+
+// isSourceFile reports whether an uploaded file is part of a source package: the .dsc itself or
+// one of the tarballs or diffs it references, including the detached signature of an upstream tarball.
+func isSourceFile(name string) bool {
+	if strings.HasSuffix(name, ".dsc") || strings.HasSuffix(name, ".diff.gz") {
+		return true
+	}
+	name = strings.TrimSuffix(name, ".asc")
+	for _, suffix := range sourceTarballSuffixes {
+		if strings.HasSuffix(name, suffix) {
+			return true
+		}
+	}
+	return false
+}
+
+// dscText returns the control stanza of a .dsc, stripping the OpenPGP clearsign armor if present.
+func dscText(data []byte) string {
+	if block, _ := clearsign.Decode(data); block != nil {
+		return string(block.Plaintext)
+	}
+	return string(data)
+}
+
+// dscSourceFiles collects the files referenced by the Files and Checksums-* fields of a .dsc.
+func dscSourceFiles(fields []controlField) ([]sourceFile, error) {
+	return listedFiles(fields, ".dsc")
+}
+
+// listedFiles collects the files referenced by the Files and Checksums-* fields of a .dsc or .changes,
+// named by listedIn in errors. The Files field of a .changes also lists the section and priority of
+// each file.
+func listedFiles(fields []controlField, listedIn string) ([]sourceFile, error) {
+	var files []sourceFile
+	index := make(map[string]int)
+	for _, field := range fields {
+		checksum, ok := sourcesChecksum(field.Name)
+		if !ok {
+			continue
+		}
+		for _, line := range strings.Split(field.Value, "\n") {
+			parts := strings.Fields(line)
+			if len(parts) != 3 && (len(parts) != 5 || field.Name != "Files") {
+				continue
+			}
+			name := parts[len(parts)-1]
+			if name != filepath.Base(name) || name == "." || name == ".." {
+				return nil, uploadErrorf(http.StatusBadRequest, "invalid file name %s in %s", name, listedIn)
+			}
+			size, err := strconv.ParseInt(parts[1], 10, 64)
+			if err != nil {
+				return nil, uploadErrorf(http.StatusBadRequest, "invalid size for %s in %s: %s", name, listedIn, err)
+			}
+			i, ok := index[name]
+			if !ok {
+				i = len(files)
+				index[name] = i
+				files = append(files, sourceFile{Name: name, fileHashes: fileHashes{Size: size}})
+			}
+			if files[i].Size != size {
+				return nil, uploadErrorf(http.StatusBadRequest, "conflicting sizes for %s in %s", name, listedIn)
+			}
+			if len(parts) == 5 {
+				files[i].Section = parts[2]
+			}
+			files[i].set(checksum.name, parts[0])
+		}
+	}
+	if len(files) == 0 {
+		return nil, uploadErrorf(http.StatusBadRequest, "%s does not list any files", listedIn)
+	}
+	return files, nil
+}
+
+// verifySourceFile checks that the file at path has the size and checksums listed for it.
+func verifySourceFile(path string, expected sourceFile) error {
+	actual, err := hashFile(path)
+	if err != nil {
+		return fmt.Errorf("error hashing %s: %s", expected.Name, err)
+	}
+	if actual.Size != expected.Size {
+		return uploadErrorf(http.StatusBadRequest, "size mismatch for %s: got %d, expected %d", expected.Name, actual.Size, expected.Size)
+	}
+	for _, checksum := range checksumTypes {
+		if want := expected.get(checksum.name); want != "" && actual.get(checksum.name) != want {
+			return uploadErrorf(http.StatusBadRequest, "%s checksum mismatch for %s", strings.ToUpper(checksum.name), expected.Name)
+		}
+	}
+	return nil
+}
+
+// readDsc reads the .dsc at path and returns its fields and the files it references.
+func readDsc(path string) ([]controlField, []sourceFile, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, nil, fmt.Errorf("error reading %s: %s", filepath.Base(path), err)
+	}
+	fields := parseControlFields(dscText(data))
+	files, err := dscSourceFiles(fields)
+	if err != nil {
+		return nil, nil, err
+	}
+	return fields, files, nil
+}
+
+// publishSourceUpload verifies the .dsc files uploaded into stagingDir against the tarballs they
+// reference, then moves everything into the source directory of the distro and section.
+// Referenced files which were not part of the upload must already be present in the source
+// directory, as is usually the case for the .orig tarball of a new Debian revision.
+func publishSourceUpload(config conf, distro, section, stagingDir string) error {
+	if err := verifySourceUpload(config, distro, section, stagingDir); err != nil {
+		return err
+	}
+	return moveSourceUpload(config, distro, section, stagingDir)
+}
+
+// verifySourceUpload checks the source files staged in stagingDir the way publishSourceUpload does,
+// without publishing anything.
+func verifySourceUpload(config conf, distro, section, stagingDir string) error {
+	sourcePath := config.SourcePath(distro, section)
+	stagedList, err := ioutil.ReadDir(stagingDir)
+	if err != nil {
+		return fmt.Errorf("error reading staged upload: %s", err)
+	}
+
+	staged := make(map[string]bool)
+	var dscs []string
+	for _, file := range stagedList {
+		staged[file.Name()] = true
+		if strings.HasSuffix(file.Name(), ".dsc") {
+			dscs = append(dscs, file.Name())
+		}
+	}
+	if len(dscs) == 0 {
+		return uploadErrorf(http.StatusBadRequest, "source files were uploaded without a .dsc")
+	}
+
+	referenced := make(map[string]bool)
+	for _, dsc := range dscs {
+		referenced[dsc] = true
+		_, files, err := readDsc(filepath.Join(stagingDir, dsc))
+		if err != nil {
+			return err
+		}
+		for _, file := range files {
+			referenced[file.Name] = true
+			path := filepath.Join(stagingDir, file.Name)
+			if !staged[file.Name] {
+				path = filepath.Join(sourcePath, file.Name)
+				if _, err := os.Stat(path); os.IsNotExist(err) {
+					return uploadErrorf(http.StatusBadRequest, "%s references %s, which was not uploaded", dsc, file.Name)
+				}
+			}
+			if err := verifySourceFile(path, file); err != nil {
+				return err
+			}
+		}
+	}
+
+	for name := range staged {
+		if !referenced[name] {
+			return uploadErrorf(http.StatusBadRequest, "%s is not referenced by any uploaded .dsc", name)
+		}
+		existing, err := hashFile(filepath.Join(sourcePath, name))
+		if os.IsNotExist(err) {
+			continue
+		}
+		if err != nil {
+			return fmt.Errorf("error hashing existing %s: %s", name, err)
+		}
+		uploaded, err := hashFile(filepath.Join(stagingDir, name))
+		if err != nil {
+			return fmt.Errorf("error hashing %s: %s", name, err)
+		}
+		if existing.SHA256 != uploaded.SHA256 {
+			return uploadErrorf(http.StatusConflict, "%s already exists with different content", name)
+		}
+	}
+	return nil
+}
+
+// moveSourceUpload moves the verified source files staged in stagingDir into the source directory of
+// the distro and section.
+func moveSourceUpload(config conf, distro, section, stagingDir string) error {
+	sourcePath := config.SourcePath(distro, section)
+	stagedList, err := ioutil.ReadDir(stagingDir)
+	if err != nil {
+		return fmt.Errorf("error reading staged upload: %s", err)
+	}
+	staged := make(map[string]bool)
+	for _, file := range stagedList {
+		staged[file.Name()] = true
+	}
+
+	// move the referenced files first, so a .dsc never shows up before its files do
+	for _, last := range []bool{false, true} {
+		for name := range staged {
+			if strings.HasSuffix(name, ".dsc") != last {
+				continue
+			}
+			if err := os.Rename(filepath.Join(stagingDir, name), filepath.Join(sourcePath, name)); err != nil {
+				return fmt.Errorf("error publishing %s: %s", name, err)
+			}
+			if *verbose {
+				log.Printf("Source file %s has been uploaded to %s %s", name, distro, section)
+			}
+		}
+	}
+	return nil
+}
+
+// removeSourcePackage deletes a .dsc from the source directory, along with every file it references
+// that isn't also referenced by another .dsc.
+func removeSourcePackage(config conf, distro, section, dscName string) error {
+	sourcePath := config.SourcePath(distro, section)
+	_, files, err := readDsc(filepath.Join(sourcePath, filepath.Base(dscName)))
+	if err != nil {
+		return err
+	}
+
+	stillReferenced := make(map[string]bool)
+	dirList, err := ioutil.ReadDir(sourcePath)
+	if err != nil {
+		return fmt.Errorf("scanning: %s: %s", sourcePath, err)
+	}
+	for _, file := range dirList {
+		if !strings.HasSuffix(file.Name(), ".dsc") || file.Name() == filepath.Base(dscName) {
+			continue
+		}
+		_, otherFiles, err := readDsc(filepath.Join(sourcePath, file.Name()))
+		if err != nil {
+			log.Printf("error reading %s: %s", file.Name(), err)
+			continue
+		}
+		for _, other := range otherFiles {
+			stillReferenced[other.Name] = true
+		}
+	}
+
+	if err := os.Remove(filepath.Join(sourcePath, filepath.Base(dscName))); err != nil {
+		return err
+	}
+	for _, file := range files {
+		if stillReferenced[file.Name] {
+			continue
+		}
+		if err := os.Remove(filepath.Join(sourcePath, file.Name)); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+	return nil
+}
+
+// sourcesStanza builds the Sources index entry for a .dsc: the .dsc fields, with Source renamed
+// to Package, the .dsc itself added to the file lists, and a Directory field. The file lists are
+// those of the configured checksums, they take the place of the lists in the .dsc, and checksums
+// the .dsc doesn't list are computed from the files in the source directory.
+func sourcesStanza(config conf, distro, section, dscPath string) (string, error) {
+	fields, files, err := readDsc(dscPath)
+	if err != nil {
+		return "", err
+	}
+	hashes, err := hashFile(dscPath, config.Checksums()...)
+	if err != nil {
+		return "", fmt.Errorf("error hashing %s: %s", filepath.Base(dscPath), err)
+	}
+	name := filepath.Base(dscPath)
+	files = append(files, sourceFile{Name: name, fileHashes: hashes})
+
+	// checksums are listed in the order the .dsc lists them, followed by those it doesn't list
+	unlisted := make(map[string]bool)
+	for _, checksum := range config.Checksums() {
+		unlisted[checksum.name] = true
+	}
+	var checksums []checksumType
+	for _, field := range fields {
+		if checksum, ok := sourcesChecksum(field.Name); ok && unlisted[checksum.name] {
+			checksums = append(checksums, checksum)
+			delete(unlisted, checksum.name)
+		}
+	}
+	for _, checksum := range config.Checksums() {
+		if unlisted[checksum.name] {
+			checksums = append(checksums, checksum)
+		}
+	}
+	var fileLists []controlField
+	for _, checksum := range checksums {
+		var value strings.Builder
+		for i, file := range files {
+			if file.get(checksum.name) == "" {
+				computed, err := hashFile(filepath.Join(filepath.Dir(dscPath), file.Name), config.Checksums()...)
+				if err != nil {
+					return "", fmt.Errorf("error hashing %s: %s", file.Name, err)
+				}
+				files[i].fileHashes = computed
+			}
+			fmt.Fprintf(&value, "\n %s %d %s", files[i].get(checksum.name), file.Size, file.Name)
+		}
+		fileLists = append(fileLists, controlField{Name: checksum.sources, Value: value.String()})
+	}
+
+	stanza := []controlField{{Name: "Package"}}
+	for _, field := range fields {
+		if _, ok := sourcesChecksum(field.Name); ok {
+			// the file lists go where the first one of the .dsc was
+			stanza = append(stanza, fileLists...)
+			fileLists = nil
+			continue
+		}
+		if field.Name == "Source" {
+			stanza[0].Value = field.Value
+			continue
+		}
+		stanza = append(stanza, field)
+	}
+	stanza = append(stanza, fileLists...)
+	if stanza[0].Value == "" {
+		return "", fmt.Errorf("%s has no Source field", name)
+	}
+	stanza = append(stanza, controlField{Name: "Directory", Value: filepath.ToSlash(filepath.Join("dists", distro, section, "source"))})
+
+	return formatControlFields(stanza), nil
+}
+
+// createSourcesGz rebuilds and publishes the Sources file of a distro and section.
+func createSourcesGz(config conf, distro, section string) error {
+	return publish(func(pub *publication) error {
+		return stageSources(pub, config, distro, section)
+	})
+}
+
+// stageSources rebuilds the Sources file, in every configured compression, for the source
+// directory of a distro and section.
+func stageSources(pub *publication, config conf, distro, section string) error {
+
+	if *verbose {
+		log.Printf("Rebuilding Sources file for %s %s", distro, section)
+	}
+
+	writer, err := createIndexFiles(pub, config, filepath.Join(config.SourcePath(distro, section), "Sources"))
+	if err != nil {
+		return err
+	}
+	defer writer.Close()
+
+	dirList, err := ioutil.ReadDir(config.SourcePath(distro, section))
+	if err != nil {
+		return fmt.Errorf("scanning: %s: %s", config.SourcePath(distro, section), err)
+	}
+	written := 0
+	for _, dscFile := range dirList {
+		if !strings.HasSuffix(dscFile.Name(), ".dsc") {
+			continue
+		}
+		stanza, err := sourcesStanza(config, distro, section, filepath.Join(config.SourcePath(distro, section), dscFile.Name()))
+		if err != nil {
+			return err
+		}
+		if written > 0 {
+			writer.Write([]byte("\n"))
+		}
+		writer.Write([]byte(stanza))
+		written++
+	}
+
+	if err := writer.Close(); err != nil {
+		return fmt.Errorf("failed to write Sources: %s", err)
+	}
+	return nil
+}
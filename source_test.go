@@ -0,0 +1,183 @@
+package main
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/boltdb/bolt"
+)
+
+var goodSourcesOutput = `Package: hello-src
+Format: 3.0 (quilt)
+Binary: hello-src
+Architecture: all
+Version: 1.0-1
+Maintainer: deb-simple <deb-simple@go.go>
+Standards-Version: 4.6.0
+Package-List:
+ hello-src deb utils optional arch=all
+Checksums-Sha1:
+ 3bfc1ed9f60f137f3a77a3a6cfc07ca7b150234f 192 hello-src_1.0.orig.tar.gz
+ 2e1dd323d4e87a8deaeec80af0ef858b84aaa993 556 hello-src_1.0-1.debian.tar.xz
+ e8a5d3ebaf2a5c2ac6a43a8a9ab1a0ebbd2e6b0e 726 hello-src_1.0-1.dsc
+Checksums-Sha256:
+ e9899070cde38ec361224a1ee61b1cc0c7a0887058f4999e1e0ac7096e381d38 192 hello-src_1.0.orig.tar.gz
+ 6813906e774262af4b1d009af58fdb7b680d2a82335a13c8892ce30c42c637fe 556 hello-src_1.0-1.debian.tar.xz
+ 0b6d0a2c4e4f3cbbd0e6c73ee6cc2b1f2a9d65aa4e0cb6e8c1ea02a9f36ec3e5 726 hello-src_1.0-1.dsc
+Files:
+ f8d9649a5158af29cfa9acf8ff76d717 192 hello-src_1.0.orig.tar.gz
+ 3ac5aaa907f6c5dfa8f3642402b04708 556 hello-src_1.0-1.debian.tar.xz
+ 00000000000000000000000000000000 726 hello-src_1.0-1.dsc
+Directory: dists/stable/main/source
+`
+
+// multipartBody builds a multipart upload of the given files, each added under its base name.
+// A file may be given as name=path to upload it under a different name.
+func multipartBody(t testing.TB, files ...string) (*bytes.Buffer, string) {
+	body := &bytes.Buffer{}
+	writer := multipart.NewWriter(body)
+	for _, file := range files {
+		name, path := filepath.Base(file), file
+		if parts := strings.SplitN(file, "=", 2); len(parts) == 2 {
+			name, path = parts[0], parts[1]
+		}
+		part, err := writer.CreateFormFile("file", name)
+		if err != nil {
+			t.Errorf("error FormFile: %s", err)
+		}
+		f, err := os.Open(path)
+		if err != nil {
+			t.Errorf("error opening %s: %s", path, err)
+			continue
+		}
+		if _, err := io.Copy(part, f); err != nil {
+			t.Errorf("error copying %s to FormFile: %s", path, err)
+		}
+		f.Close()
+	}
+	if err := writer.Close(); err != nil {
+		t.Errorf("error closing form writer: %s", err)
+	}
+	return body, writer.FormDataContentType()
+}
+
+func TestIsSourceFile(t *testing.T) {
+	tests := map[string]bool{
+		"hello_1.0-1.dsc":                      true,
+		"hello_1.0.orig.tar.gz":                true,
+		"hello_1.0.orig-docs.tar.xz":           true,
+		"hello_1.0.orig.tar.gz.asc":            true,
+		"hello_1.0-1.debian.tar.xz":            true,
+		"hello_1.0.tar.bz2":                    true,
+		"hello_1.0-1.diff.gz":                  true,
+		"foo.tar-helper_1.0_amd64.deb":         false,
+		"hello_1.0-1_amd64.buildinfo":          false,
+		"hello_1.0.tar.gz.sig-notes_1_all.deb": false,
+	}
+	for name, want := range tests {
+		if got := isSourceFile(name); got != want {
+			t.Errorf("isSourceFile(%s) returned %v, should be %v", name, got, want)
+		}
+	}
+}
+
+func TestUploadHandlerSource(t *testing.T) {
+	pwd, err := os.Getwd()
+	if err != nil {
+		t.Errorf("Unable to get current working directory: %s", err)
+	}
+	config := conf{ListenPort: "9666", RootRepoPath: pwd + "/testing", SupportArch: []string{"cats"}, DistroNames: []string{"stable"}, Sections: []string{"main"}, EnableDirectoryWatching: false}
+	if err := createDirs(config); err != nil {
+		t.Errorf("createDirs() failed: %s", err)
+	}
+
+	// create temp db
+	db, err := bolt.Open(tempfile(), 0666, nil)
+	if err != nil {
+		t.Fatalf("error creating tempdb: %s", err)
+	}
+	defer db.Close()
+	uploadHandle := uploadHandler(config, db)
+	upload := func(files ...string) int {
+		body, contentType := multipartBody(t, files...)
+		req, _ := http.NewRequest("POST", "/upload?distro=stable&section=main", body)
+		req.Header.Add("Content-Type", contentType)
+		w := httptest.NewRecorder()
+		uploadHandle.ServeHTTP(w, req)
+		return w.Code
+	}
+
+	// the .dsc references a tarball that was not uploaded
+	if code := upload("samples/hello-src_1.0-1.dsc", "samples/hello-src_1.0-1.debian.tar.xz"); code != http.StatusBadRequest {
+		t.Errorf("uploadHandler POST returned %v, should be %v", code, http.StatusBadRequest)
+	}
+	// a tarball that doesn't match its checksum
+	if code := upload("samples/hello-src_1.0-1.dsc", "hello-src_1.0.orig.tar.gz=samples/control.tar.gz", "samples/hello-src_1.0-1.debian.tar.xz"); code != http.StatusBadRequest {
+		t.Errorf("uploadHandler POST returned %v, should be %v", code, http.StatusBadRequest)
+	}
+	// a tarball without a .dsc
+	if code := upload("samples/hello-src_1.0.orig.tar.gz"); code != http.StatusBadRequest {
+		t.Errorf("uploadHandler POST returned %v, should be %v", code, http.StatusBadRequest)
+	}
+	if files, _ := ioutil.ReadDir(config.SourcePath("stable", "main")); len(files) != 0 {
+		t.Errorf("rejected uploads should leave the source directory empty, found %d files", len(files))
+	}
+	if files, _ := ioutil.ReadDir(config.StagingPath()); len(files) != 1 || files[0].Name() != "incoming" {
+		t.Errorf("rejected uploads should leave nothing but the incoming directory in the staging directory, found %d files", len(files))
+	}
+
+	if code := upload("samples/hello-src_1.0-1.dsc", "samples/hello-src_1.0.orig.tar.gz", "samples/hello-src_1.0-1.debian.tar.xz"); code != http.StatusOK {
+		t.Errorf("uploadHandler POST returned %v, should be %v", code, http.StatusOK)
+	}
+	for _, name := range []string{"hello-src_1.0-1.dsc", "hello-src_1.0.orig.tar.gz", "hello-src_1.0-1.debian.tar.xz"} {
+		if _, err := os.Stat(filepath.Join(config.SourcePath("stable", "main"), name)); err != nil {
+			t.Errorf("%s was not published: %s", name, err)
+		}
+	}
+
+	sources, err := ioutil.ReadFile(filepath.Join(config.SourcePath("stable", "main"), "Sources"))
+	if err != nil {
+		t.Errorf("error reading Sources: %s", err)
+	}
+	dscHashes, _ := hashFile("samples/hello-src_1.0-1.dsc")
+	want := strings.NewReplacer(
+		"e8a5d3ebaf2a5c2ac6a43a8a9ab1a0ebbd2e6b0e", dscHashes.SHA1,
+		"0b6d0a2c4e4f3cbbd0e6c73ee6cc2b1f2a9d65aa4e0cb6e8c1ea02a9f36ec3e5", dscHashes.SHA256,
+		"00000000000000000000000000000000", dscHashes.MD5,
+	).Replace(goodSourcesOutput)
+	if string(sources) != want {
+		t.Errorf("Sources does not match, returned value is:\n %s \n\n should be:\n %s", sources, want)
+	}
+
+	// the .orig tarball is already published, so a new upload doesn't need to include it
+	if code := upload("samples/hello-src_1.0-1.dsc", "samples/hello-src_1.0-1.debian.tar.xz"); code != http.StatusOK {
+		t.Errorf("uploadHandler POST returned %v, should be %v", code, http.StatusOK)
+	}
+
+	// deleting the .dsc removes every file it references
+	deleteHandle := deleteHandler(config, db)
+	req, _ := http.NewRequest("DELETE", "", bytes.NewBufferString("{\"filename\":\"hello-src_1.0-1.dsc\",\"arch\":\"source\", \"distroName\":\"stable\", \"section\":\"main\"}"))
+	w := httptest.NewRecorder()
+	deleteHandle.ServeHTTP(w, req)
+	if w.Code != http.StatusOK {
+		t.Errorf("deleteHandler DELETE returned %v, should be %v", w.Code, http.StatusOK)
+	}
+	for _, name := range []string{"hello-src_1.0-1.dsc", "hello-src_1.0.orig.tar.gz", "hello-src_1.0-1.debian.tar.xz"} {
+		if _, err := os.Stat(filepath.Join(config.SourcePath("stable", "main"), name)); !os.IsNotExist(err) {
+			t.Errorf("%s should have been deleted", name)
+		}
+	}
+
+	// cleanup
+	if err := os.RemoveAll(config.RootRepoPath); err != nil {
+		t.Errorf("error cleaning up after uploadHandler(): %s", err)
+	}
+}
@@ -0,0 +1,170 @@
+package main
+
+import (
+	"bytes"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"golang.org/x/crypto/openpgp"
+	"golang.org/x/crypto/openpgp/armor"
+	"golang.org/x/crypto/openpgp/clearsign"
+	"golang.org/x/crypto/openpgp/packet"
+)
+
+// signatureTarget returns the name of the file a detached signature uploaded as name is for, if name is
+// a signature of a package or .dsc. Signatures of upstream tarballs are part of the source package and
+// are left alone.
+func signatureTarget(name string) (string, bool) {
+	for _, ext := range []string{".asc", ".sig"} {
+		target := strings.TrimSuffix(name, ext)
+		if target != name && (strings.HasSuffix(target, ".deb") || strings.HasSuffix(target, ".dsc")) {
+			return target, true
+		}
+	}
+	return "", false
+}
+
+// keyFingerprint returns the fingerprint of a key as upper case hex, the way gpg prints it without spaces.
+func keyFingerprint(entity *openpgp.Entity) string {
+	return publicKeyFingerprint(entity.PrimaryKey)
+}
+
+// publicKeyFingerprint returns the fingerprint of a primary key or subkey, formatted as keyFingerprint does.
+func publicKeyFingerprint(key *packet.PublicKey) string {
+	return strings.ToUpper(hex.EncodeToString(key.Fingerprint[:]))
+}
+
+// normalizeFingerprint formats a fingerprint from the config file as keyFingerprint does, as gpg prints
+// fingerprints with spaces and in lower case in various places.
+func normalizeFingerprint(fingerprint string) string {
+	return strings.ToUpper(strings.Join(strings.Fields(fingerprint), ""))
+}
+
+// verifyUpload checks that the file at path was signed by a key in the uploader keyring that may publish
+// to distro. The signature is a detached signature, armored or binary, or nil when the file itself is
+// clearsigned, as a .changes or .dsc signed with debsign is.
+func verifyUpload(config conf, path string, signature []byte, distro string) error {
+	keyring, err := loadKeyring(config.UploaderKeyring)
+	if err != nil {
+		return err
+	}
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return fmt.Errorf("error reading %s: %s", path, err)
+	}
+
+	signed := data
+	switch {
+	case signature == nil:
+		block, _ := clearsign.Decode(data)
+		if block == nil {
+			return uploadErrorf(http.StatusUnauthorized, "upload is not signed")
+		}
+		signed = block.Bytes
+		signature, err = ioutil.ReadAll(block.ArmoredSignature.Body)
+	default:
+		signature, err = dearmorSignature(signature)
+	}
+	if err != nil {
+		return uploadErrorf(http.StatusForbidden, "upload is not signed by a trusted uploader: %s", err)
+	}
+	signer, err := openpgp.CheckDetachedSignature(keyring, bytes.NewReader(signed), bytes.NewReader(signature))
+	if err != nil {
+		return uploadErrorf(http.StatusForbidden, "upload is not signed by a trusted uploader: %s", err)
+	}
+	// the openpgp package doesn't look at key expiry when checking a signature
+	if err := checkSigningKeyExpiry(signer, signature); err != nil {
+		return uploadErrorf(http.StatusForbidden, "upload is not signed by a trusted uploader: %s", err)
+	}
+
+	fingerprint := keyFingerprint(signer)
+	if distros, ok := config.UploaderDistros()[fingerprint]; ok && !contains(distros, distro) {
+		return uploadErrorf(http.StatusForbidden, "key %s may not upload to %s", fingerprint, distro)
+	}
+	return nil
+}
+
+// dearmorSignature returns the binary packets of a signature that may be armored.
+func dearmorSignature(signature []byte) ([]byte, error) {
+	if !bytes.HasPrefix(bytes.TrimSpace(signature), []byte("-----BEGIN")) {
+		return signature, nil
+	}
+	block, err := armor.Decode(bytes.NewReader(signature))
+	if err != nil {
+		return nil, fmt.Errorf("error decoding signature: %s", err)
+	}
+	return ioutil.ReadAll(block.Body)
+}
+
+// checkSigningKeyExpiry returns an error if the key of signer that made signature, its primary key or a
+// subkey, had expired by the time the signature was made. A subkey can't outlive its primary key.
+func checkSigningKeyExpiry(signer *openpgp.Entity, signature []byte) error {
+	p, err := packet.NewReader(bytes.NewReader(signature)).Next()
+	if err != nil {
+		return fmt.Errorf("error reading signature: %s", err)
+	}
+	var issuer uint64
+	var created time.Time
+	switch sig := p.(type) {
+	case *packet.Signature:
+		if sig.IssuerKeyId == nil {
+			return errors.New("signature doesn't name the key that made it")
+		}
+		issuer, created = *sig.IssuerKeyId, sig.CreationTime
+	case *packet.SignatureV3:
+		issuer, created = sig.IssuerKeyId, sig.CreationTime
+	default:
+		return errors.New("invalid signature")
+	}
+
+	// the most recent self-signature holds the current lifetime of the primary key
+	var selfSignature *packet.Signature
+	for _, identity := range signer.Identities {
+		if identity.SelfSignature != nil && (selfSignature == nil || identity.SelfSignature.CreationTime.After(selfSignature.CreationTime)) {
+			selfSignature = identity.SelfSignature
+		}
+	}
+	if selfSignature != nil && selfSignature.KeyExpired(created) {
+		return fmt.Errorf("key %s had expired when the upload was signed", keyFingerprint(signer))
+	}
+	for _, subkey := range signer.Subkeys {
+		if subkey.PublicKey.KeyId == issuer && subkey.Sig.KeyExpired(created) {
+			return fmt.Errorf("subkey %s of key %s had expired when the upload was signed", publicKeyFingerprint(subkey.PublicKey), keyFingerprint(signer))
+		}
+	}
+	return nil
+}
+
+// verifySourceSignatures checks the signature of every .dsc staged in stagingDir, which is either
+// uploaded alongside it or part of the .dsc itself. The other files of a source package are covered
+// by the checksums in its .dsc.
+func verifySourceSignatures(config conf, distro, stagingDir string, signatures map[string][]byte) error {
+	stagedList, err := ioutil.ReadDir(stagingDir)
+	if err != nil {
+		return fmt.Errorf("error reading staged upload: %s", err)
+	}
+	for _, file := range stagedList {
+		if !strings.HasSuffix(file.Name(), ".dsc") {
+			continue
+		}
+		if err := verifyUpload(config, filepath.Join(stagingDir, file.Name()), signatures[file.Name()], distro); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// UploaderDistros returns the distros each restricted uploader key may publish to, keyed by fingerprint.
+func (c conf) UploaderDistros() map[string][]string {
+	distros := make(map[string][]string)
+	for fingerprint, allowed := range c.Uploaders {
+		distros[normalizeFingerprint(fingerprint)] = allowed
+	}
+	return distros
+}
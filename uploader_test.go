@@ -0,0 +1,143 @@
+package main
+
+import (
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/boltdb/bolt"
+	"golang.org/x/crypto/openpgp"
+	"golang.org/x/crypto/openpgp/clearsign"
+)
+
+func TestSignedUploads(t *testing.T) {
+	pwd, err := os.Getwd()
+	if err != nil {
+		t.Errorf("Unable to get current working directory: %s", err)
+	}
+	trusted, _, _ := createKeyPair("deb-simple Uploader", "", "uploader@go.go")
+	untrusted, _, _ := createKeyPair("deb-simple Stranger", "", "stranger@go.go")
+	// gpg prints fingerprints in groups of four
+	var fingerprint []string
+	for i := 0; i < len(keyFingerprint(trusted)); i += 4 {
+		fingerprint = append(fingerprint, strings.ToLower(keyFingerprint(trusted)[i:i+4]))
+	}
+	config := conf{ListenPort: "9666", RootRepoPath: pwd + "/testing", SupportArch: []string{"all", "amd64"}, DistroNames: []string{"stable", "testing"}, Sections: []string{"main"},
+		RequireSignedUploads: true, UploaderKeyring: pwd + "/testing/uploaders.asc", Uploaders: map[string][]string{strings.Join(fingerprint, " "): {"stable"}}}
+	if err := createDirs(config); err != nil {
+		t.Errorf("createDirs() failed: %s", err)
+	}
+	// a trusted key that expired in 2020, made back then
+	defer func(now func() time.Time) { Now = now }(Now)
+	Now = func() time.Time { return time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC) }
+	expired, err := createSigningKey(keyOptions{name: "deb-simple Expired", email: "expired@go.go", bits: 2048, expires: time.Date(2020, 9, 20, 0, 0, 0, 0, time.UTC),
+		publicKey: pwd + "/testing/expired.asc", keyring: pwd + "/testing/expired.gpg", privateKey: pwd + "/testing/expired.key", revocation: pwd + "/testing/expired.rev"})
+	if err != nil {
+		t.Fatalf("error creating expired key: %s", err)
+	}
+	Now = time.Now
+	keyring, err := os.Create(config.UploaderKeyring)
+	if err != nil {
+		t.Fatalf("error writing uploader keyring: %s", err)
+	}
+	err = writeArmored(keyring, openpgp.PublicKeyType, func(w io.Writer) error {
+		if err := trusted.Serialize(w); err != nil {
+			return err
+		}
+		return expired.Serialize(w)
+	})
+	keyring.Close()
+	if err != nil {
+		t.Fatalf("error writing uploader keyring: %s", err)
+	}
+	db, err := bolt.Open(tempfile(), 0666, nil)
+	if err != nil {
+		t.Fatalf("error creating tempdb: %s", err)
+	}
+	defer db.Close()
+
+	sign := func(signer *openpgp.Entity, path string) string {
+		in, err := os.Open(path)
+		if err != nil {
+			t.Fatalf("error opening %s: %s", path, err)
+		}
+		defer in.Close()
+		out, err := ioutil.TempFile(config.RootRepoPath, "signature-")
+		if err != nil {
+			t.Fatalf("error creating signature: %s", err)
+		}
+		defer out.Close()
+		if err := openpgp.ArmoredDetachSign(out, signer, in, nil); err != nil {
+			t.Fatalf("error signing %s: %s", path, err)
+		}
+		return out.Name()
+	}
+	upload := func(handler http.Handler, url string, files ...string) int {
+		body, contentType := multipartBody(t, files...)
+		req, _ := http.NewRequest("POST", url, body)
+		req.Header.Add("Content-Type", contentType)
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, req)
+		return w.Code
+	}
+
+	deb := "samples/hello-zst_1.0-1_all.deb"
+	tests := []struct {
+		name  string
+		url   string
+		files []string
+		want  int
+	}{
+		{"unsigned", "/upload?distro=stable", []string{deb}, http.StatusUnauthorized},
+		{"signature after the package", "/upload?distro=stable", []string{deb, "hello-zst_1.0-1_all.deb.asc=" + sign(trusted, deb)}, http.StatusUnauthorized},
+		{"untrusted signer", "/upload?distro=stable", []string{"hello-zst_1.0-1_all.deb.asc=" + sign(untrusted, deb), deb}, http.StatusForbidden},
+		{"signer restricted to another distro", "/upload?distro=testing", []string{"hello-zst_1.0-1_all.deb.asc=" + sign(trusted, deb), deb}, http.StatusForbidden},
+		{"expired signer", "/upload?distro=stable", []string{"hello-zst_1.0-1_all.deb.asc=" + sign(expired, deb), deb}, http.StatusForbidden},
+		{"signature of other content", "/upload?distro=stable", []string{"hello-zst_1.0-1_all.deb.asc=" + sign(trusted, "samples/vim-tiny_7.4.052-1ubuntu3_amd64.deb"), deb}, http.StatusForbidden},
+		{"trusted signer", "/upload?distro=stable", []string{"hello-zst_1.0-1_all.deb.asc=" + sign(trusted, deb), deb}, http.StatusOK},
+	}
+	uploadHandle := uploadHandler(config, db)
+	for _, test := range tests {
+		if code := upload(uploadHandle, test.url, test.files...); code != test.want {
+			t.Errorf("uploadHandler POST (%s) returned %v, should be %v", test.name, code, test.want)
+		}
+	}
+	if _, err := os.Stat(filepath.Join(config.ArchPath("stable", "main", "all"), "hello-zst_1.0-1_all.deb")); err != nil {
+		t.Errorf("signed package should have been uploaded: %s", err)
+	}
+
+	// a .changes has to be clearsigned
+	changesHandle := changesHandler(config, db)
+	vim := "samples/vim-tiny_7.4.052-1ubuntu3_amd64.deb"
+	changesPath := filepath.Join(config.RootRepoPath, "vim_amd64.changes")
+	writeTestChanges(t, changesPath, "stable", vim)
+	if code := upload(changesHandle, "/changes", changesPath, vim); code != http.StatusUnauthorized {
+		t.Errorf("changesHandler POST of an unsigned .changes returned %v, should be %v", code, http.StatusUnauthorized)
+	}
+	changes, _ := ioutil.ReadFile(changesPath)
+	out, err := os.Create(changesPath)
+	if err != nil {
+		t.Fatalf("error creating %s: %s", changesPath, err)
+	}
+	w, err := clearsign.Encode(out, trusted.PrivateKey, nil)
+	if err != nil {
+		t.Fatalf("error signing %s: %s", changesPath, err)
+	}
+	io.WriteString(w, string(changes))
+	w.Close()
+	out.Close()
+	if code := upload(changesHandle, "/changes", changesPath, vim); code != http.StatusOK {
+		t.Errorf("changesHandler POST of a signed .changes returned %v, should be %v", code, http.StatusOK)
+	}
+
+	// cleanup
+	if err := os.RemoveAll(config.RootRepoPath); err != nil {
+		t.Errorf("error cleaning up after signed uploads: %s", err)
+	}
+}
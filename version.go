@@ -0,0 +1,103 @@
+package main
+
+import (
+	"strconv"
+	"strings"
+)
+
+// splitVersion splits a Debian version into its epoch, upstream version and Debian revision,
+// as in [epoch:]upstream[-revision].
+func splitVersion(version string) (int, string, string) {
+	epoch := 0
+	if i := strings.Index(version, ":"); i != -1 {
+		// an invalid epoch sorts like no epoch at all
+		epoch, _ = strconv.Atoi(version[:i])
+		version = version[i+1:]
+	}
+	revision := ""
+	if i := strings.LastIndex(version, "-"); i != -1 {
+		revision = version[i+1:]
+		version = version[:i]
+	}
+	return epoch, version, revision
+}
+
+// compareVersions compares two Debian versions the way dpkg does, returning a negative number if a
+// is older than b, a positive number if it is newer, and 0 if they are equal.
+func compareVersions(a, b string) int {
+	epochA, upstreamA, revisionA := splitVersion(a)
+	epochB, upstreamB, revisionB := splitVersion(b)
+	if epochA != epochB {
+		return epochA - epochB
+	}
+	if c := compareVersionPart(upstreamA, upstreamB); c != 0 {
+		return c
+	}
+	return compareVersionPart(revisionA, revisionB)
+}
+
+func isVersionDigit(c byte) bool {
+	return c >= '0' && c <= '9'
+}
+
+// versionOrder ranks a single character of a version: ~ sorts before anything, even the end of the
+// string, letters sort before every other non-digit character.
+func versionOrder(c byte) int {
+	switch {
+	case isVersionDigit(c):
+		return 0
+	case c >= 'a' && c <= 'z', c >= 'A' && c <= 'Z':
+		return int(c)
+	case c == '~':
+		return -1
+	case c != 0:
+		return int(c) + 256
+	}
+	return 0
+}
+
+// compareVersionPart compares an upstream version or revision, alternating between non-digit
+// runs, compared character by character, and digit runs, compared numerically.
+func compareVersionPart(a, b string) int {
+	at := func(s string, i int) byte {
+		if i < len(s) {
+			return s[i]
+		}
+		return 0
+	}
+	i, j := 0, 0
+	for i < len(a) || j < len(b) {
+		for (i < len(a) && !isVersionDigit(a[i])) || (j < len(b) && !isVersionDigit(b[j])) {
+			ac, bc := versionOrder(at(a, i)), versionOrder(at(b, j))
+			if ac != bc {
+				return ac - bc
+			}
+			i++
+			j++
+		}
+		for at(a, i) == '0' {
+			i++
+		}
+		for at(b, j) == '0' {
+			j++
+		}
+		firstDiff := 0
+		for isVersionDigit(at(a, i)) && isVersionDigit(at(b, j)) {
+			if firstDiff == 0 {
+				firstDiff = int(a[i]) - int(b[j])
+			}
+			i++
+			j++
+		}
+		if isVersionDigit(at(a, i)) {
+			return 1
+		}
+		if isVersionDigit(at(b, j)) {
+			return -1
+		}
+		if firstDiff != 0 {
+			return firstDiff
+		}
+	}
+	return 0
+}
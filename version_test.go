@@ -0,0 +1,38 @@
+package main
+
+import (
+	"testing"
+)
+
+func TestCompareVersions(t *testing.T) {
+	tests := []struct {
+		a, b string
+		want int
+	}{
+		{"1.0", "1.0", 0},
+		{"1.0-1", "1.0-2", -1},
+		{"1.0-10", "1.0-9", 1},
+		{"1.10", "1.9", 1},
+		{"1.01", "1.1", 0},
+		{"1:1.0", "2.0", 1},
+		{"0:1.0", "1.0", 0},
+		{"1.0~rc1", "1.0", -1},
+		{"1.0~rc1", "1.0~rc2", -1},
+		{"1.0~~", "1.0~", -1},
+		{"1.0", "1.0+b1", -1},
+		{"1.0a", "1.0+", -1},
+		{"1.0", "1.0a", -1},
+		{"2:7.4.052-1ubuntu3", "2:7.4.052-1ubuntu10", -1},
+		{"1.2-3-4", "1.2-3", 1},
+		{"1.0-1", "1.0", 1},
+	}
+	for _, test := range tests {
+		got := compareVersions(test.a, test.b)
+		if (got < 0 && test.want >= 0) || (got > 0 && test.want <= 0) || (got == 0 && test.want != 0) {
+			t.Errorf("compareVersions(%s, %s) returned %d, should be %d", test.a, test.b, got, test.want)
+		}
+		if reverse := compareVersions(test.b, test.a); (reverse < 0) != (got > 0) {
+			t.Errorf("compareVersions(%s, %s) is not the reverse of compareVersions(%s, %s)", test.b, test.a, test.a, test.b)
+		}
+	}
+}